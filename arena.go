@@ -0,0 +1,66 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package cuckoo
+
+import "hash"
+
+// Number of bits of a handle that hold the length, the rest hold the offset.
+const arenaLenBits = 24
+
+// Longest byte string a BytesCuckoo can hold as a key or a value.
+const MaxBytesLen = 1<<arenaLenBits - 1
+
+// An arena holds byte strings back to back in one []byte, which has no pointers for the GC to scan.
+// A string is named by a handle, its offset << arenaLenBits | its length. The strings are never
+// changed once added, a new copy is added instead, and the space of the old one is garbage until
+// the arena is compacted.
+type arena struct {
+	b       []byte
+	garbage int // bytes of strings no longer used
+}
+
+// Offset 0 is never used, so no handle is 0, the empty key.
+func newArena() *arena {
+	return &arena{b: make([]byte, 1, 4096)}
+}
+
+// Add s and get its handle.
+func (a *arena) put(s []byte) uint64 {
+	if len(s) > MaxBytesLen {
+		panic("put")
+	}
+	h := uint64(len(a.b))<<arenaLenBits | uint64(len(s))
+	a.b = append(a.b, s...)
+	return h
+}
+
+// Get the string with handle h. It must not be changed.
+func (a *arena) get(h uint64) []byte {
+	off, n := h>>arenaLenBits, h&MaxBytesLen
+	return a.b[off : off+n : off+n]
+}
+
+// Get the length of the string with handle h.
+func handleLen(h uint64) int {
+	return int(h & MaxBytesLen)
+}
+
+// The string with handle h is no longer used.
+func (a *arena) free(h uint64) {
+	a.garbage += handleLen(h)
+}
+
+// Get the bytes used by strings that are still in use.
+func (a *arena) live() int {
+	return len(a.b) - 1 - a.garbage
+}
+
+// Hash a byte string the way _calcHash hashes a serialized key.
+func (c *Cuckoo) hashBytes(hf hash.Hash64, seed uint64, b []byte) uint64 {
+	if c.hfb != nil {
+		return c.hfb(b, seed)
+	}
+	hf.Reset()
+	hf.Write(b)
+	return hf.Sum64()
+}
@@ -0,0 +1,269 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package cuckoo
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// State of each key in a batch.
+const (
+	batchPending = iota // not placed yet
+	batchExists         // already in the table, update it in place
+	batchSerial         // has to go through insert
+	batchDone           // placed
+)
+
+// Run f(w, lo, hi) over n items split into p contiguous chunks, one goroutine per chunk.
+func parallel(n, p int, f func(w, lo, hi int)) {
+	var wg sync.WaitGroup
+
+	if p > n {
+		p = n
+	}
+	if p <= 1 {
+		f(0, 0, n)
+		return
+	}
+	for w := 0; w < p; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			f(w, w*n/p, (w+1)*n/p)
+		}(w)
+	}
+	wg.Wait()
+}
+
+// Insert keys[i], vals[i] for all i, in order, using up to parallelism goroutines.
+// Returns the indexes of the KV pairs that could not be inserted, in order.
+// Unlike Insert it doesn't stop at the first failure.
+//
+// First the hashes and candidate buckets of all the keys are calculated in parallel and
+// keys already in the table are found. Then, one table at a time, the table's buckets are
+// split into regions, one per goroutine, and each goroutine places the keys whose candidate
+// bucket is in its region into a free slot. No goroutine touches another's buckets, so this
+// is safe. The keys left over, which need evictions, are inserted one at a time by insert.
+// Except when the load factor limit is reached, where the table ends up doesn't depend on parallelism.
+// The Cuckoo must not be used by anyone else during InsertBatch.
+// With subscribers, see Subscribe, the KV pairs are inserted one at a time by InsertL.
+// Like Insert it takes the slots of expired KV pairs and the KV pairs it inserts never expire.
+func (c *Cuckoo) InsertBatch(keys []Key, vals []Value, parallelism int) (fails []int) {
+	if len(keys) != len(vals) {
+		panic("InsertBatch: len(keys) != len(vals)")
+	}
+	if debug {
+		defer c.check("InsertBatch")
+	}
+	if c.subs != nil {
+		for i := range keys {
+			if ok, _ := c.InsertL(keys[i], vals[i]); !ok {
+				fails = append(fails, i)
+			}
+		}
+		return
+	}
+	if c.rec != nil {
+		c.rec.logBatch(keys, vals, parallelism)
+	}
+	fails = c.insertBatch(keys, vals, parallelism)
+	c.Mutations += len(keys) - len(fails)
+	return
+}
+
+func (c *Cuckoo) insertBatch(keys []Key, vals []Value, parallelism int) (fails []int) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	if uint64(c.Nbuckets) > math.MaxUint32 {
+		return c.insertSerial(keys, vals, nil)
+	}
+	var now int64
+	if c.clock != nil {
+		now = c.now()
+	}
+	nt := len(c.tables)
+	cands := make([]uint32, len(keys)*nt)
+	state := make([]uint8, len(keys))
+
+	// hash all the keys and look for the ones already in the table
+	parallel(len(keys), parallelism, func(w, lo, hi int) {
+		sc := newScratch()
+		for i := lo; i < hi; i++ {
+			k := keys[i]
+			if k == c.emptyKey {
+				state[i] = batchSerial
+				continue
+			}
+			for ti, t := range c.tables {
+				b := t.calcHashForTableS(&sc, k) % uint64(t.Nbuckets)
+				cands[i*nt+ti] = uint32(b)
+				for s := 0; s < t.Nslots; s++ {
+					if t.key(b, s) == k {
+						state[i] = batchExists
+					}
+				}
+			}
+		}
+	})
+
+	// updates are rare, do them here
+	var pending []int
+	for i := range keys {
+		switch state[i] {
+		case batchExists:
+			c.batchUpdate(cands[i*nt:(i+1)*nt], keys[i], vals[i])
+			state[i] = batchDone
+		case batchPending:
+			pending = append(pending, i)
+		}
+	}
+
+	// don't place more than the load factor allows, the rest go to insert which knows how to say no
+	var over []int
+	if budget := c.MaxElements - c.Elements; len(pending) > budget {
+		if budget < 0 {
+			budget = 0
+		}
+		over = append(over, pending[budget:]...)
+		pending = pending[:budget]
+	}
+	for ti, t := range c.tables {
+		if len(pending) == 0 {
+			break
+		}
+		regions := c.batchRegions(pending, cands, nt, ti, parallelism)
+		left := make([][]int, len(regions))
+		probes := make([]int, len(regions))
+		elements := make([]int, len(regions))
+		expired := make([]int, len(regions))
+		hists := make([]Histograms, len(regions))
+		parallel(len(regions), len(regions), func(w, lo, hi int) {
+			for r := lo; r < hi; r++ {
+				for _, i := range regions[r] {
+					b := uint64(cands[i*nt+ti])
+					free := -1
+					n := 0
+					for s := 0; s < t.Nslots; s++ {
+						n++
+						pk := t.key(b, s)
+						if pk == keys[i] {
+							// a duplicate in the batch, placed earlier
+							t.setVal(b, s, vals[i])
+							free = -2
+							break
+						}
+						if (pk == c.emptyKey || t.expired(b, s, now)) && free < 0 {
+							free = s
+						}
+					}
+					probes[r] += n
+					if free != -1 {
+						hists[r].record(n, 0, 0)
+					}
+					switch {
+					case free == -2:
+						state[i] = batchDone
+					case free >= 0:
+						if t.key(b, free) != c.emptyKey {
+							expired[r]++ // reclaimed, see reclaim
+						} else {
+							elements[r]++
+						}
+						t.set(b, free, keys[i], vals[i])
+						state[i] = batchDone
+					default:
+						left[r] = append(left[r], i)
+					}
+				}
+			}
+		})
+		pending = pending[:0]
+		for r := range regions {
+			pending = append(pending, left[r]...)
+			c.Probes += probes[r]
+			c.hists.Merge(&hists[r])
+			c.Elements += elements[r]
+			t.Elements += elements[r]
+			c.Expired += expired[r]
+			c.Mutations += expired[r]
+		}
+		sort.Ints(pending)
+	}
+	for i := range keys {
+		if state[i] == batchDone {
+			c.Inserts++
+		}
+		if state[i] == batchSerial {
+			pending = append(pending, i)
+		}
+	}
+	pending = append(pending, over...)
+	sort.Ints(pending)
+	return c.insertSerial(keys, vals, pending)
+}
+
+// Split the pending keys by the region of table ti their candidate bucket is in.
+// Each region's keys stay in batch order.
+func (c *Cuckoo) batchRegions(pending []int, cands []uint32, nt, ti, p int) [][]int {
+	nb := uint64(c.tables[ti].Nbuckets)
+	if uint64(p) > nb {
+		p = int(nb)
+	}
+	parts := make([][][]int, p) // parts[chunk][region]
+	parallel(len(pending), p, func(w, lo, hi int) {
+		parts[w] = make([][]int, p)
+		for _, i := range pending[lo:hi] {
+			r := uint64(cands[i*nt+ti]) * uint64(p) / nb
+			parts[w][r] = append(parts[w][r], i)
+		}
+	})
+	regions := make([][]int, p)
+	for _, part := range parts {
+		for r := range part {
+			regions[r] = append(regions[r], part[r]...)
+		}
+	}
+	return regions
+}
+
+// Replace the value of key, which is in one of its candidate buckets, and clear its expiry time.
+func (c *Cuckoo) batchUpdate(cands []uint32, key Key, val Value) {
+	for ti, t := range c.tables {
+		b := uint64(cands[ti])
+		for s := 0; s < t.Nslots; s++ {
+			if t.key(b, s) == key {
+				t.beginWrite(b)
+				t.setVal(b, s, val)
+				t.setExp(b, s, 0)
+				t.endWrite(b)
+				return
+			}
+		}
+	}
+	panic("batchUpdate")
+}
+
+// Insert the KV pairs at the indexes given, or all of them if idx is nil, one at a time.
+// An earlier KV pair in the batch may have put the key in a table insert doesn't look at
+// first, so this uses upsert.
+func (c *Cuckoo) insertSerial(keys []Key, vals []Value, idx []int) (fails []int) {
+	var one = func(i int) {
+		if ok, _, _ := c.upsert(keys[i], vals[i]); !ok {
+			fails = append(fails, i)
+		}
+	}
+
+	if idx == nil {
+		for i := range keys {
+			one(i)
+		}
+		return
+	}
+	for _, i := range idx {
+		one(i)
+	}
+	return
+}
@@ -0,0 +1,216 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+// +build !string
+
+package cuckoo
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Compact when garbage is more than this fraction of the arena, see SetCompaction.
+const DefaultCompaction = 0.5
+
+// Don't bother compacting an arena with less garbage than this.
+const minCompactBytes = 4096
+
+// A BytesCuckoo is a cuckoo hash table with byte string keys and values of any length up to
+// MaxBytesLen. The bytes live back to back in an arena, one []byte, and the buckets hold the
+// offset and length of each key and value, so the GC has no pointers to scan, just as with
+// the default uint64 Key and Value. Keys are hashed straight from their bytes.
+// Deleting a key or replacing a value leaves garbage in the arena, it's compacted when there's
+// too much, see SetCompaction. Like a Cuckoo it's not safe for concurrent use.
+type BytesCuckoo struct {
+	c          *Cuckoo
+	a          *arena
+	compaction float64
+	Compacts   int // number of times the arena was compacted
+}
+
+// Create a new cuckoo hash table with byte string keys and values. The arguments are the same as New.
+func NewBytes(tables, buckets, slots int, eseed int64, loadFactor float64, hashName string) *BytesCuckoo {
+	c := New(tables, buckets, slots, eseed, loadFactor, hashName)
+	if c == nil {
+		return nil
+	}
+	a := newArena()
+	c.arena, c.NumericKeySize = a, 0
+	return &BytesCuckoo{c: c, a: a, compaction: DefaultCompaction}
+}
+
+// Set when the arena is compacted, when its garbage is more than frac of it, 0 for never.
+func (bc *BytesCuckoo) SetCompaction(frac float64) {
+	bc.compaction = frac
+}
+
+// Find the slot that holds key.
+func (bc *BytesCuckoo) find(key []byte) (t *Table, b uint64, s int, ok bool) {
+	c := bc.c
+	for _, t = range c.tables {
+		b = c.hashBytes(t.hfs, t.seed, key) % uint64(t.Nbuckets)
+		for s = 0; s < t.Nslots; s++ {
+			h := uint64(t.key(b, s))
+			if h != 0 && handleLen(h) == len(key) && bytes.Equal(bc.a.get(h), key) {
+				return t, b, s, true
+			}
+		}
+	}
+	return nil, 0, 0, false
+}
+
+// Given key return the value and a "ok" bool indicating success or failure.
+// The value is a slice of the arena, it must not be changed. It stays valid after the key is
+// deleted or its value replaced.
+func (bc *BytesCuckoo) Lookup(key []byte) ([]byte, bool) {
+	bc.c.Lookups++
+	t, b, s, ok := bc.find(key)
+	if !ok {
+		return nil, false
+	}
+	return bc.a.get(uint64(t.val(b, s))), true
+}
+
+// Given key, value insert a KV pair, or replace the value if key is already there, and return ok.
+// key and val are copied into the arena. Panics if either is longer than MaxBytesLen.
+func (bc *BytesCuckoo) Insert(key, val []byte) (ok bool) {
+	c := bc.c
+	if t, b, s, found := bc.find(key); found {
+		// an update by the key's own handle, counted, sent, and recorded like any other
+		vh := uint64(t.val(b, s))
+		c.InsertL(t.key(b, s), Value(bc.a.put(val)))
+		bc.a.free(vh)
+		bc.maybeCompact()
+		return true
+	}
+	kh, vh := bc.a.put(key), bc.a.put(val)
+	if ok, _ = c.InsertL(Key(kh), Value(vh)); ok {
+		return true
+	}
+	if c.Elements >= c.MaxElements {
+		bc.a.free(kh)
+		bc.a.free(vh)
+		return false
+	}
+	// a failed insert leaves some KV pair, not always this one, with no slot
+	bc.recount()
+	bc.maybeCompact()
+	return false
+}
+
+// Given key delete the KV pair. Return the value found and a bool "ok" indicating success.
+// The value stays valid, see Lookup.
+func (bc *BytesCuckoo) Delete(key []byte) ([]byte, bool) {
+	t, b, s, found := bc.find(key)
+	if !found {
+		bc.c.Deletes++
+		return nil, false
+	}
+	kh, vh := uint64(t.key(b, s)), uint64(t.val(b, s))
+	bc.c.Delete(Key(kh))
+	bc.a.free(kh)
+	bc.a.free(vh)
+	v := bc.a.get(vh)
+	bc.maybeCompact()
+	return v, true
+}
+
+// Call iter for each KV pair. The slices must not be changed.
+func (bc *BytesCuckoo) Map(iter func(key, val []byte) (stop bool)) {
+	bc.c.Map(func(c *Cuckoo, key Key, val Value) bool {
+		return iter(bc.a.get(uint64(key)), bc.a.get(uint64(val)))
+	})
+}
+
+// Get the number of KV pairs.
+func (bc *BytesCuckoo) Len() int {
+	return bc.c.Elements
+}
+
+// Get the size of the arena and how much of it is garbage, in bytes.
+func (bc *BytesCuckoo) GetArenaSize() (size, garbage int) {
+	return len(bc.a.b), bc.a.garbage
+}
+
+// Set the garbage to what isn't used by a KV pair in a table.
+func (bc *BytesCuckoo) recount() {
+	used := 0
+	bc.each(func(t *Table, b uint64, s int) {
+		used += handleLen(uint64(t.key(b, s))) + handleLen(uint64(t.val(b, s)))
+	})
+	bc.a.garbage = len(bc.a.b) - 1 - used
+}
+
+// Call f with each slot in use.
+func (bc *BytesCuckoo) each(f func(t *Table, b uint64, s int)) {
+	for _, t := range bc.c.tables {
+		for b := 0; b < t.Nbuckets; b++ {
+			for s := 0; s < t.Nslots; s++ {
+				if t.key(uint64(b), s) != 0 {
+					f(t, uint64(b), s)
+				}
+			}
+		}
+	}
+}
+
+// Compact if there's enough garbage.
+func (bc *BytesCuckoo) maybeCompact() {
+	if bc.compaction > 0 && bc.a.garbage >= minCompactBytes && float64(bc.a.garbage) > bc.compaction*float64(len(bc.a.b)) {
+		bc.Compact()
+	}
+}
+
+// Copy the keys and values into a new arena with no garbage. No KV pair moves to another slot,
+// the hashes are of the bytes, not where they are.
+func (bc *BytesCuckoo) Compact() {
+	na := &arena{b: make([]byte, 1, 1+bc.a.live())}
+	bc.each(func(t *Table, b uint64, s int) {
+		t.set(b, s, Key(na.put(bc.a.get(uint64(t.key(b, s))))), Value(na.put(bc.a.get(uint64(t.val(b, s))))))
+	})
+	bc.a.b, bc.a.garbage = na.b, 0
+	bc.Compacts++
+}
+
+// Get a copy of the counters, see Cuckoo.GetCounters.
+func (bc *BytesCuckoo) GetCounters() Counters {
+	return bc.c.GetCounters()
+}
+
+// Get the value of some of the counters, see Cuckoo.GetCounter.
+func (bc *BytesCuckoo) GetCounter(stat string) int {
+	return bc.c.GetCounter(stat)
+}
+
+// Get a copy of the counters of each table, see Cuckoo.GetTableCounters.
+func (bc *BytesCuckoo) GetTableCounters() []TableCounters {
+	return bc.c.GetTableCounters()
+}
+
+// Check the tables are consistent, see Cuckoo.Validate, that every key and value is in the arena,
+// and that the garbage is what isn't used by a KV pair.
+func (bc *BytesCuckoo) Validate() (err error) {
+	if err = bc.c.Validate(); err != nil {
+		return
+	}
+	used := 0
+	seen := make(map[string]bool, bc.c.Elements)
+	bc.each(func(t *Table, b uint64, s int) {
+		for _, h := range []uint64{uint64(t.key(b, s)), uint64(t.val(b, s))} {
+			if off := h >> arenaLenBits; err == nil && (off == 0 || off+uint64(handleLen(h)) > uint64(len(bc.a.b))) {
+				err = fmt.Errorf("%w: handle %#x is outside an arena of %d bytes", ErrInvalid, h, len(bc.a.b))
+			}
+			used += handleLen(h)
+		}
+		if err == nil {
+			k := string(bc.a.get(uint64(t.key(b, s))))
+			if seen[k] {
+				err = fmt.Errorf("%w: key %q is stored twice", ErrInvalid, k)
+			}
+			seen[k] = true
+		}
+	})
+	if err == nil && used+bc.a.garbage != len(bc.a.b)-1 {
+		err = fmt.Errorf("%w: arena of %d bytes has %d used and garbage=%d", ErrInvalid, len(bc.a.b), used, bc.a.garbage)
+	}
+	return
+}
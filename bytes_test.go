@@ -0,0 +1,108 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+// +build !string
+
+package cuckoo_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	. "leb.io/cuckoo"
+)
+
+func TestBytes(t *testing.T) {
+	bc := NewBytes(4, 101, 8, 0, 0.9, hashName)
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key-%d", i)) }
+	val := func(i, gen int) []byte { return bytes.Repeat([]byte{byte(i), byte(gen)}, i%7) }
+	n := 2000
+	for i := 0; i < n; i++ {
+		if !bc.Insert(key(i), val(i, 0)) {
+			t.Fatalf("insert %d", i)
+		}
+	}
+	if !bc.Insert(nil, []byte("empty key")) {
+		t.Fatal("insert empty key")
+	}
+	check := func(gen func(i int) int) {
+		t.Helper()
+		if err := bc.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < n; i++ {
+			v, ok := bc.Lookup(key(i))
+			if g := gen(i); g < 0 {
+				if ok {
+					t.Fatalf("lookup %d found deleted key", i)
+				}
+			} else if !ok || !bytes.Equal(v, val(i, g)) {
+				t.Fatalf("lookup %d=%q, %v", i, v, ok)
+			}
+		}
+		if v, ok := bc.Lookup([]byte{}); !ok || string(v) != "empty key" {
+			t.Fatalf("empty key=%q, %v", v, ok)
+		}
+	}
+	check(func(i int) int { return 0 })
+
+	// replace the values of the odd keys, each one an insert and a mutation
+	for i := 1; i < n; i += 2 {
+		bc.Insert(key(i), val(i, 1))
+	}
+	if cs := bc.GetCounters(); cs.Inserts != n+1+n/2 || cs.Mutations != n+1+n/2 {
+		t.Fatalf("Inserts=%d, Mutations=%d after replacing values", cs.Inserts, cs.Mutations)
+	}
+	if bc.Len() != n+1 {
+		t.Fatalf("Len=%d", bc.Len())
+	}
+	if _, garbage := bc.GetArenaSize(); garbage == 0 {
+		t.Fatal("no garbage after replacing values")
+	}
+	check(func(i int) int { return i % 2 })
+
+	// deleting most keys compacts the arena, values returned stay good
+	var kept [][]byte
+	for i := 0; i < n; i++ {
+		if i%4 != 0 {
+			v, ok := bc.Delete(key(i))
+			if !ok {
+				t.Fatalf("delete %d", i)
+			}
+			kept = append(kept, v)
+		}
+	}
+	if bc.Compacts == 0 {
+		t.Fatal("no compaction")
+	}
+	for j, i := 0, 0; i < n; i++ {
+		if i%4 != 0 {
+			if !bytes.Equal(kept[j], val(i, i%2)) {
+				t.Fatalf("deleted value %d=%q", i, kept[j])
+			}
+			j++
+		}
+	}
+	check(func(i int) int {
+		if i%4 != 0 {
+			return -1
+		}
+		return i % 2
+	})
+
+	bc.Compact()
+	size, garbage := bc.GetArenaSize()
+	used := 0
+	bc.Map(func(k, v []byte) bool {
+		used += len(k) + len(v)
+		return false
+	})
+	if garbage != 0 || size != used+1 {
+		t.Fatalf("after Compact size=%d, garbage=%d, used=%d", size, garbage, used)
+	}
+
+	// keys are hashed from their bytes, no encoder
+	k := key(4)
+	if a := testing.AllocsPerRun(100, func() { bc.Lookup(k) }); a != 0 && !raceEnabled {
+		t.Fatalf("Lookup allocates %v", a)
+	}
+}
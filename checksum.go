@@ -0,0 +1,202 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package cuckoo
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// CRC32C, it has hardware support on most machines.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// A CorruptRange is a range of buckets [First, Last) of a table that failed its checksum.
+type CorruptRange struct {
+	Table int
+	First int
+	Last  int
+}
+
+// A CorruptError says which parts of a snapshot are damaged.
+// errors.Is(err, ErrSnapshotCorrupt) is true for a CorruptError.
+type CorruptError struct {
+	Meta      bool           // the header or table headers are damaged, nothing can be loaded
+	Truncated bool           // the snapshot ends early, the tables that are cut off are in Ranges
+	Ranges    []CorruptRange // damaged buckets
+	Salvaged  bool           // the damaged tables were emptied and the rest loaded, see SetSalvage
+}
+
+func (e *CorruptError) Error() string {
+	if e.Meta {
+		return "cuckoo: snapshot header is corrupt"
+	}
+	s := "cuckoo: snapshot is corrupt:"
+	if e.Truncated {
+		s += " truncated,"
+	}
+	for _, r := range e.Ranges {
+		s += fmt.Sprintf(" table %d buckets [%d, %d)", r.Table, r.First, r.Last)
+	}
+	if e.Salvaged {
+		s += ", damaged tables emptied"
+	}
+	return s
+}
+
+func (e *CorruptError) Unwrap() error {
+	return ErrSnapshotCorrupt
+}
+
+// Is any part of table ti damaged?
+func (e *CorruptError) damaged(ti int) bool {
+	for _, r := range e.Ranges {
+		if r.Table == ti {
+			return true
+		}
+	}
+	return false
+}
+
+// Mark all of table ti, which has nbuckets buckets, as damaged.
+func (e *CorruptError) table(ti, nbuckets int) {
+	r := e.Ranges[:0]
+	for _, cr := range e.Ranges {
+		if cr.Table != ti {
+			r = append(r, cr)
+		}
+	}
+	e.Ranges = append(r, CorruptRange{Table: ti, First: 0, Last: nbuckets})
+}
+
+// The first bucket of each checksummed chunk of a table with nbuckets buckets.
+func chunkBounds(nbuckets int) []int {
+	bounds := make([]int, 0, (nbuckets+snapChunk-1)/snapChunk)
+	for lo := 0; lo < nbuckets; lo += snapChunk {
+		bounds = append(bounds, lo)
+	}
+	return bounds
+}
+
+// CRC32C of every snapChunk buckets of the table.
+func (t *Table) chunkSums() []uint32 {
+	bounds := chunkBounds(t.Nbuckets)
+	sums := make([]uint32, len(bounds))
+	sl := makeSlots(Slots{}, t.Nslots)
+	for i, lo := range bounds {
+		hi := lo + snapChunk
+		if hi > t.Nbuckets {
+			hi = t.Nbuckets
+		}
+		if t.keys != nil {
+			for b := lo; b < hi; b++ {
+				sums[i] = crc32.Update(sums[i], castagnoli, t.splitBucketBytes(b, &sl))
+			}
+			continue
+		}
+		if slotsContiguous() {
+			sums[i] = crc32.Checksum(t.bucketBytes(lo, hi), castagnoli)
+			continue
+		}
+		for b := lo; b < hi; b++ {
+			sums[i] = crc32.Update(sums[i], castagnoli, t.bucketBytes(b, b+1))
+		}
+	}
+	return sums
+}
+
+// Compare the checksums of table ti and return the ranges of buckets that don't match.
+// Adjacent bad chunks are merged into one range.
+func sumRanges(ti, nbuckets int, got, want []uint32) (r []CorruptRange) {
+	for i := range got {
+		if got[i] == want[i] {
+			continue
+		}
+		lo, hi := i*snapChunk, (i+1)*snapChunk
+		if hi > nbuckets {
+			hi = nbuckets
+		}
+		if n := len(r); n > 0 && r[n-1].Last == lo {
+			r[n-1].Last = hi
+			continue
+		}
+		r = append(r, CorruptRange{Table: ti, First: lo, Last: hi})
+	}
+	return
+}
+
+// Check the checksums of the snapshot file at path without loading it.
+// Returns nil if it's intact, a *CorruptError saying which table and bucket ranges
+// are damaged if it isn't, or another error if it can't be read or isn't a snapshot.
+// The file doesn't have to have been written with this build's Key, Value, or hash function.
+func Verify(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cr := &countReader{r: bufio.NewReaderSize(f, 1<<16), limit: remaining(f)}
+	si, err := readSnapInfo(cr)
+	if err != nil {
+		return err
+	}
+	ce := &CorruptError{}
+	var buf []byte
+	for ti, st := range si.tables {
+		cr.align()
+		nb := int(st.Nbuckets)
+		if cr.need(st.Size * int64(si.BucketSize)); cr.err != nil {
+			nb = 0 // don't allocate for buckets that aren't there
+		}
+		bounds := chunkBounds(nb)
+		got := make([]uint32, len(bounds))
+		for i, lo := range bounds {
+			hi := lo + snapChunk
+			if hi > nb {
+				hi = nb
+			}
+			n := (hi - lo) * int(st.Nslots) * int(si.BucketSize)
+			if cap(buf) < n {
+				buf = make([]byte, n)
+			}
+			cr.full(buf[:n])
+			got[i] = crc32.Checksum(buf[:n], castagnoli)
+		}
+		want := make([]uint32, len(bounds))
+		cr.get(want)
+		var esum, ewant uint32
+		if si.Expiry {
+			cr.align()
+			cr.need(st.Size * 8)
+		}
+		if si.Expiry && cr.err == nil {
+			n := int(st.Size) * 8
+			if cap(buf) < n {
+				buf = make([]byte, n)
+			}
+			cr.full(buf[:n])
+			esum = crc32.Checksum(buf[:n], castagnoli)
+			cr.get(&ewant)
+		}
+		if cr.err == io.EOF || cr.err == io.ErrUnexpectedEOF {
+			ce.Truncated = true
+			for ; ti < len(si.tables); ti++ {
+				ce.Ranges = append(ce.Ranges, CorruptRange{Table: ti, First: 0, Last: int(si.tables[ti].Nbuckets)})
+			}
+			break
+		}
+		if cr.err != nil {
+			return cr.err
+		}
+		ce.Ranges = append(ce.Ranges, sumRanges(ti, nb, got, want)...)
+		if esum != ewant {
+			ce.table(ti, nb)
+		}
+	}
+	if ce.Truncated || len(ce.Ranges) > 0 {
+		return ce
+	}
+	return nil
+}
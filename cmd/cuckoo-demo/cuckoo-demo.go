@@ -0,0 +1,123 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+// This program inserts a sequence of keys into a cuckoo hash table, traces the inserts,
+// and writes a self-contained HTML page that animates the probes, evictions, and inserts
+// with the drawing functions of demo/demo.html.
+// The default build has 8 slots per bucket, build with -tags slice for any other number.
+//
+//	cuckoo-demo -t 4 -b 11 -n 40 -o CT4x11.html
+//	cuckoo-demo -t 2 -b 11 -keys 7,18,29,40 -o chain.html
+//	go run -tags slice leb.io/cuckoo/cmd/cuckoo-demo -s 1 -n 40 -o CT4x11x1.html
+//
+// With -x the page ends with a dry run of inserting one more key, see Cuckoo.ExplainInsert,
+// and the explanation is printed.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"leb.io/cuckoo"
+	"leb.io/cuckoo/demo"
+)
+
+var tables = flag.Int("t", 4, "number of tables")
+var buckets = flag.Int("b", 11, "number of buckets per table")
+var slots = flag.Int("s", cuckoo.Nslots, "number of slots per bucket")
+var lf = flag.Float64("lf", 1.0, "maximum load factor")
+var hash = flag.String("h", "aes", "hash function")
+var seed = flag.Int64("seed", 0, "eviction seed")
+var n = flag.Int("n", 20, "number of sequential keys to insert")
+var start = flag.Uint64("k", 1, "first sequential key")
+var keyList = flag.String("keys", "", "comma separated keys to insert instead of sequential ones")
+var interval = flag.Duration("i", 250*time.Millisecond, "time between animation steps")
+var title = flag.String("title", "", "page title")
+var out = flag.String("o", "cuckoo-demo.html", "output file")
+var explain = flag.String("x", "", "after the inserts explain an insert of this key and animate it")
+
+// A Tracer that keeps every event.
+type events []cuckoo.TraceEvent
+
+func (ev *events) Trace(e cuckoo.TraceEvent) {
+	*ev = append(*ev, e)
+}
+
+func keys() ([]cuckoo.Key, error) {
+	var ks []cuckoo.Key
+	if *keyList == "" {
+		for i := 0; i < *n; i++ {
+			ks = append(ks, cuckoo.Key(*start+uint64(i)))
+		}
+		return ks, nil
+	}
+	for _, f := range strings.Split(*keyList, ",") {
+		k, err := strconv.ParseUint(strings.TrimSpace(f), 0, 64)
+		if err != nil {
+			return nil, err
+		}
+		ks = append(ks, cuckoo.Key(k))
+	}
+	return ks, nil
+}
+
+func main() {
+	flag.Parse()
+	os.Exit(run())
+}
+
+// Make the page the flags ask for and return the exit code.
+func run() int {
+	ks, err := keys()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cuckoo-demo: bad key: %v\n", err)
+		return 2
+	}
+	c := cuckoo.New(*tables, *buckets, *slots, *seed, *lf, *hash)
+	if c == nil {
+		fmt.Fprintf(os.Stderr, "cuckoo-demo: New failed, the default build needs -s %d, use -tags slice for other slot counts\n", cuckoo.Nslots)
+		return 2
+	}
+	c.SetNumericKeySize(8)
+	c.SetGrow(false) // the page has a column for each table there is at the start
+	var ev events
+	c.SetTracer(&ev)
+	for _, k := range ks {
+		if ok, _ := c.InsertL(k, cuckoo.Value(k)); !ok {
+			fmt.Fprintf(os.Stderr, "cuckoo-demo: insert of %d failed\n", k)
+		}
+	}
+	c.SetTracer(nil)
+	if *explain != "" {
+		k, err := strconv.ParseUint(*explain, 0, 64)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cuckoo-demo: bad key: %v\n", err)
+			return 2
+		}
+		x := c.ExplainInsert(cuckoo.Key(k))
+		fmt.Print(x)
+		ev = append(ev, x.Events...)
+	}
+
+	if *title == "" {
+		*title = fmt.Sprintf("Cuckoo Hash Table %dx%dx%d", *tables, c.Nbuckets, *slots)
+	}
+	p := &demo.Page{Title: *title, Tables: *tables, Buckets: c.Nbuckets, Slots: *slots, Interval: *interval, Events: ev}
+	f, err := os.Create(*out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cuckoo-demo: %v\n", err)
+		return 1
+	}
+	if err := p.Write(f); err != nil {
+		fmt.Fprintf(os.Stderr, "cuckoo-demo: %v\n", err)
+		return 1
+	}
+	if err := f.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "cuckoo-demo: %v\n", err)
+		return 1
+	}
+	return 0
+}
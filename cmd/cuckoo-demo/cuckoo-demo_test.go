@@ -0,0 +1,25 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// With no flags the page has a trace of every insert.
+func TestDefaultFlags(t *testing.T) {
+	*out = filepath.Join(t.TempDir(), "cuckoo-demo.html")
+	if code := run(); code != 0 {
+		t.Fatalf("exit code %d", code)
+	}
+	b, err := ioutil.ReadFile(*out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := bytes.Count(b, []byte(`"op": "I"`)); i != *n {
+		t.Fatalf("%d inserts in the page, want %d", i, *n)
+	}
+}
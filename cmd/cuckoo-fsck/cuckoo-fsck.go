@@ -0,0 +1,64 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+// This program checks the checksums of cuckoo hash table snapshots
+// and reports which tables and bucket ranges are damaged.
+// The exit status is 1 if any file is damaged or can't be read.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"leb.io/cuckoo"
+)
+
+var quiet = flag.Bool("q", false, "only print damaged files")
+
+func fsck(path string) bool {
+	var ce *cuckoo.CorruptError
+
+	err := cuckoo.Verify(path)
+	switch {
+	case err == nil:
+		if !*quiet {
+			fmt.Printf("%s: ok\n", path)
+		}
+		return true
+	case errors.As(err, &ce):
+		switch {
+		case ce.Meta:
+			fmt.Printf("%s: header is corrupt\n", path)
+		case ce.Truncated:
+			fmt.Printf("%s: truncated\n", path)
+		default:
+			fmt.Printf("%s: corrupt\n", path)
+		}
+		for _, r := range ce.Ranges {
+			fmt.Printf("    table %d: buckets [%d, %d)\n", r.Table, r.First, r.Last)
+		}
+	default:
+		fmt.Printf("%s: %v\n", path, err)
+	}
+	return false
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: cuckoo-fsck [-q] snapshot...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	status := 0
+	for _, path := range flag.Args() {
+		if !fsck(path) {
+			status = 1
+		}
+	}
+	os.Exit(status)
+}
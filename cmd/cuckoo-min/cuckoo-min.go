@@ -0,0 +1,108 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+// This program shrinks a sequence of keys whose insert fails to the fewest keys and the
+// smallest table that still fail, and prints which buckets the keys hash to in each table
+// and whether the failure is a true cycle or the random walk giving up too soon.
+// The keys are read, whitespace separated, from the files named or stdin.
+// With -r it looks for a failing sequence itself, trying random keys -nt times.
+//
+//	cuckoo-min -t 4 -b 11 -s 8 -r 352 -nt 1000000
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+
+	"leb.io/cuckoo"
+)
+
+var tables = flag.Int("t", 4, "number of tables")
+var buckets = flag.Int("b", 11, "number of buckets per table")
+var slots = flag.Int("s", 8, "number of slots per bucket")
+var lf = flag.Float64("lf", 1.0, "maximum load factor")
+var hash = flag.String("h", "aes", "hash function")
+var seed = flag.Int64("seed", 0, "eviction seed")
+var startLevel = flag.Int("sl", cuckoo.InitialStartLevel, "start level")
+var lowestLevel = flag.Int("ll", cuckoo.InitialLowestLevel, "lowest level")
+var random = flag.Int("r", 0, "look for a failure inserting this many random keys")
+var trials = flag.Int("nt", 1000, "number of random trials")
+
+func readKeys(r io.Reader, keys []cuckoo.Key) ([]cuckoo.Key, error) {
+	sc := bufio.NewScanner(r)
+	sc.Split(bufio.ScanWords)
+	for sc.Scan() {
+		k, err := strconv.ParseUint(sc.Text(), 0, 64)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, cuckoo.Key(k))
+	}
+	return keys, sc.Err()
+}
+
+func find(s cuckoo.Shape) []cuckoo.Key {
+	keys := make([]cuckoo.Key, *random)
+	for t := 0; t < *trials; t++ {
+		r := rand.New(rand.NewSource(int64(t)))
+		for i := range keys {
+			keys[i] = cuckoo.Key(r.Int63())
+		}
+		if s.Fails(keys) {
+			fmt.Printf("trial %d fails\n", t)
+			return keys
+		}
+	}
+	return nil
+}
+
+func main() {
+	var keys []cuckoo.Key
+	var err error
+
+	flag.Parse()
+	s := cuckoo.Shape{Tables: *tables, Buckets: *buckets, Slots: *slots, Seed: *seed, LoadFactor: *lf,
+		HashName: *hash, KeySize: 8, StartLevel: *startLevel, LowestLevel: *lowestLevel}
+	if s.New() == nil {
+		fmt.Fprintf(os.Stderr, "cuckoo-min: can't make a %dx%dx%d table\n", *tables, *buckets, *slots)
+		os.Exit(2)
+	}
+	switch {
+	case *random > 0:
+		if keys = find(s); keys == nil {
+			fmt.Printf("no failures in %d trials\n", *trials)
+			return
+		}
+	case flag.NArg() == 0:
+		if keys, err = readKeys(os.Stdin, nil); err != nil {
+			fmt.Fprintf(os.Stderr, "cuckoo-min: %v\n", err)
+			os.Exit(2)
+		}
+	default:
+		for _, path := range flag.Args() {
+			f, err := os.Open(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cuckoo-min: %v\n", err)
+				os.Exit(2)
+			}
+			keys, err = readKeys(f, keys)
+			f.Close()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cuckoo-min: %s: %v\n", path, err)
+				os.Exit(2)
+			}
+		}
+	}
+	if !s.Fails(keys) {
+		fmt.Printf("%d keys insert without a failure\n", len(keys))
+		os.Exit(1)
+	}
+	n := len(keys)
+	s, keys = cuckoo.Minimize(s, keys)
+	fmt.Printf("minimized %d keys to %d\n", n, len(keys))
+	fmt.Print(cuckoo.FindConflicts(s, keys))
+}
@@ -0,0 +1,562 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package cuckoo
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Limits for the breadth first search for a displacement path.
+const (
+	ConcurrentStripes  = 1 << 12 // number of lock stripes
+	ConcurrentMaxDepth = 5       // longest displacement path searched for
+	ConcurrentMaxNodes = 4096    // most buckets examined in a search
+)
+
+// A ConcurrentCuckoo allows any number of goroutines to Insert, Delete, and Lookup at once.
+// Buckets are protected by a fixed number of lock stripes. Insert doesn't use the random walk.
+// Instead it does a breadth first search for a displacement path that ends in a free slot,
+// locks every bucket on the path in stripe order, checks the path is still good, and then moves
+// the KV pairs from the end of the path back to the start. A KV pair is always in some bucket,
+// so readers only need to lock the candidate buckets of their key.
+// Writers working on disjoint parts of the table proceed in parallel.
+// When no path can be found a hash table is added, which stops the world.
+// Inserts and deletes aren't sent to subscribers or logged by a Recorder, and there is no expiry,
+// so a Cuckoo with any of those can't be wrapped and can't be given them later, see Subscribe,
+// Record, and SetExpiry.
+type ConcurrentCuckoo struct {
+	elements   int64 // counters, all atomic and first so they are 64 bit aligned
+	inserts    int64
+	deletes    int64
+	lookups    int64
+	fails      int64
+	bumps      int64
+	retries    int64
+	maxPathLen int64
+	limited    int32
+
+	c       *Cuckoo
+	grow    sync.RWMutex                    // read locked by every operation, write locked to add a table
+	stripes [ConcurrentStripes]sync.RWMutex // locks for buckets
+	emu     sync.Mutex                      // protects the empty key
+	pool    sync.Pool                       // *scratch for readers and writers
+	tcs     []concurrentTableCounters       // per table counters, indexed like c.tables
+}
+
+type concurrentTableCounters struct {
+	elements int64
+	bumps    int64
+}
+
+// A slot on a displacement path and the key expected to be found there.
+type cslot struct {
+	ti  int
+	b   uint64
+	s   int
+	key Key
+}
+
+// A bucket examined by the search. It was reached by moving key from slot s of the parent bucket.
+type cnode struct {
+	ti     int
+	b      uint64
+	parent int
+	s      int
+	key    Key
+	depth  int
+}
+
+// Create a new cuckoo hash table with concurrent writers. The arguments are the same as New.
+func NewConcurrent(tables, buckets, slots int, eseed int64, loadFactor float64, hashName string, emptyKey ...Key) *ConcurrentCuckoo {
+	c := New(tables, buckets, slots, eseed, loadFactor, hashName, emptyKey...)
+	if c == nil {
+		return nil
+	}
+	return NewConcurrentFrom(c)
+}
+
+// Wrap an existing cuckoo hash table. The caller must not use c directly after this call.
+// c must have no subscribers, Recorder, or expiry.
+func NewConcurrentFrom(c *Cuckoo) *ConcurrentCuckoo {
+	if c.subs != nil || c.rec != nil || c.clock != nil {
+		panic("NewConcurrentFrom")
+	}
+	c.concurrent = true
+	cc := &ConcurrentCuckoo{c: c, elements: int64(c.Elements)}
+	for _, t := range c.tables {
+		cc.tcs = append(cc.tcs, concurrentTableCounters{elements: int64(t.Elements)})
+	}
+	initScratchPool(&cc.pool)
+	return cc
+}
+
+func (cc *ConcurrentCuckoo) stripe(ti int, b uint64) int {
+	return int((uint64(ti)*uint64(cc.c.Nbuckets) + b) % ConcurrentStripes)
+}
+
+// Lock the stripes for the slots, in order, so writers can't deadlock.
+func (cc *ConcurrentCuckoo) lock(slots []cslot, write bool) []int {
+	stripes := make([]int, 0, len(slots))
+	for _, p := range slots {
+		stripes = append(stripes, cc.stripe(p.ti, p.b))
+	}
+	sort.Ints(stripes)
+	j := 0
+	for i, s := range stripes {
+		if i == 0 || s != stripes[j-1] {
+			stripes[j] = s
+			j++
+		}
+	}
+	stripes = stripes[:j]
+	for _, s := range stripes {
+		if write {
+			cc.stripes[s].Lock()
+		} else {
+			cc.stripes[s].RLock()
+		}
+	}
+	return stripes
+}
+
+func (cc *ConcurrentCuckoo) unlock(stripes []int, write bool) {
+	for i := len(stripes) - 1; i >= 0; i-- {
+		if write {
+			cc.stripes[stripes[i]].Unlock()
+		} else {
+			cc.stripes[stripes[i]].RUnlock()
+		}
+	}
+}
+
+// The bucket in each table key could live in. Must hold cc.grow.
+func (cc *ConcurrentCuckoo) candidates(sc *scratch, key Key) []cslot {
+	cands := make([]cslot, len(cc.c.tables))
+	for ti, t := range cc.c.tables {
+		cands[ti] = cslot{ti: ti, b: t.calcHashForTableS(sc, key) % uint64(t.Nbuckets), s: -1}
+	}
+	return cands
+}
+
+// Given key return the value and a "ok" bool indicating success or failure.
+func (cc *ConcurrentCuckoo) Lookup(key Key) (v Value, ok bool) {
+	atomic.AddInt64(&cc.lookups, 1)
+	if key == cc.c.emptyKey {
+		cc.emu.Lock()
+		defer cc.emu.Unlock()
+		return cc.c.lookup(&cc.c.scratch, key)
+	}
+
+	sc := cc.pool.Get().(*scratch)
+	defer cc.pool.Put(sc)
+	cc.grow.RLock()
+	defer cc.grow.RUnlock()
+	cands := cc.candidates(sc, key)
+	stripes := cc.lock(cands, false)
+	defer cc.unlock(stripes, false)
+	for _, p := range cands {
+		t := cc.c.tables[p.ti]
+		for s := 0; s < t.Nslots; s++ {
+			if t.key(p.b, s) == key {
+				return t.val(p.b, s), true
+			}
+		}
+	}
+	return zeroVal, false
+}
+
+// Given key delete the bucket. Return the value found and a bool "ok" indicating success
+func (cc *ConcurrentCuckoo) Delete(key Key) (v Value, ok bool) {
+	atomic.AddInt64(&cc.deletes, 1)
+	if key == cc.c.emptyKey {
+		cc.emu.Lock()
+		defer cc.emu.Unlock()
+		if cc.c.emptyKeyValid {
+			cc.c.emptyKeyValid = false
+			atomic.AddInt64(&cc.elements, -1)
+			return cc.c.emptyValue, true
+		}
+		return zeroVal, false
+	}
+
+	sc := cc.pool.Get().(*scratch)
+	defer cc.pool.Put(sc)
+	cc.grow.RLock()
+	defer cc.grow.RUnlock()
+	cands := cc.candidates(sc, key)
+	stripes := cc.lock(cands, true)
+	defer cc.unlock(stripes, true)
+	for _, p := range cands {
+		t := cc.c.tables[p.ti]
+		for s := 0; s < t.Nslots; s++ {
+			if t.key(p.b, s) == key {
+				t.setKey(p.b, s, cc.c.emptyKey)
+				atomic.AddInt64(&cc.tcs[p.ti].elements, -1)
+				atomic.AddInt64(&cc.elements, -1)
+				return t.val(p.b, s), true
+			}
+		}
+	}
+	return zeroVal, false
+}
+
+// Reserve room for key, false if that would exceed MaxElements.
+func (cc *ConcurrentCuckoo) reserve(key Key) bool {
+	if n := atomic.AddInt64(&cc.elements, 1); n > int64(cc.c.MaxElements) {
+		atomic.AddInt64(&cc.elements, -1)
+		cc.c.limited(key, int(n-1), atomic.SwapInt32(&cc.limited, 1) == 0)
+		return false
+	}
+	return true
+}
+
+// With the candidate buckets locked, replace the value if key is present or use a free slot.
+// Returns done if the insert is finished, and ok if it succeeded.
+func (cc *ConcurrentCuckoo) place(cands []cslot, key Key, val Value) (done, ok bool) {
+	free := -1
+	fs := 0
+	for i, p := range cands {
+		t := cc.c.tables[p.ti]
+		for s := 0; s < t.Nslots; s++ {
+			switch t.key(p.b, s) {
+			case key:
+				t.setVal(p.b, s, val)
+				return true, true
+			case cc.c.emptyKey:
+				if free < 0 {
+					free, fs = i, s
+				}
+			}
+		}
+	}
+	if free < 0 {
+		return false, false
+	}
+	if !cc.reserve(key) {
+		return true, false
+	}
+	p := cands[free]
+	cc.c.tables[p.ti].set(p.b, fs, key, val)
+	atomic.AddInt64(&cc.tcs[p.ti].elements, 1)
+	return true, true
+}
+
+// Copy the keys in bucket b of table ti while holding its stripe.
+func (cc *ConcurrentCuckoo) readKeys(ti int, b uint64, keys []Key) []Key {
+	s := cc.stripe(ti, b)
+	cc.stripes[s].RLock()
+	keys = keys[:0]
+	t := cc.c.tables[ti]
+	for s := 0; s < t.Nslots; s++ {
+		keys = append(keys, t.key(b, s))
+	}
+	cc.stripes[s].RUnlock()
+	return keys
+}
+
+// Breadth first search from the candidate buckets for a bucket with a free slot.
+// Returns the path from a candidate slot to the free slot, or nil if none was found.
+// Nothing is locked for the whole search, so the path has to be checked again before it's used.
+func (cc *ConcurrentCuckoo) search(sc *scratch, cands []cslot) []cslot {
+	c := cc.c
+	nodes := make([]cnode, 0, 64)
+	visited := make(map[uint64]bool)
+	for _, p := range cands {
+		nodes = append(nodes, cnode{ti: p.ti, b: p.b, parent: -1, s: -1})
+		visited[uint64(p.ti)*uint64(c.Nbuckets)+p.b] = true
+	}
+	var keys []Key
+	for i := 0; i < len(nodes) && i < ConcurrentMaxNodes; i++ {
+		n := nodes[i]
+		keys = cc.readKeys(n.ti, n.b, keys)
+		for s, k := range keys {
+			if k == c.emptyKey {
+				return cc.path(nodes, i, s)
+			}
+		}
+		if n.depth >= ConcurrentMaxDepth {
+			continue
+		}
+		for s, k := range keys {
+			for ti, t := range c.tables {
+				if ti == n.ti {
+					continue
+				}
+				b := t.calcHashForTableS(sc, k) % uint64(t.Nbuckets)
+				id := uint64(ti)*uint64(c.Nbuckets) + b
+				if visited[id] {
+					continue
+				}
+				visited[id] = true
+				nodes = append(nodes, cnode{ti: ti, b: b, parent: i, s: s, key: k, depth: n.depth + 1})
+			}
+		}
+	}
+	return nil
+}
+
+// Walk back from free slot s of node i to a candidate bucket.
+func (cc *ConcurrentCuckoo) path(nodes []cnode, i, s int) []cslot {
+	var path []cslot
+	expect := cc.c.emptyKey
+	for {
+		n := nodes[i]
+		path = append(path, cslot{ti: n.ti, b: n.b, s: s, key: expect})
+		if n.parent < 0 {
+			break
+		}
+		expect, s, i = n.key, n.s, n.parent
+	}
+	for l, r := 0, len(path)-1; l < r; l, r = l+1, r-1 {
+		path[l], path[r] = path[r], path[l]
+	}
+	return path
+}
+
+// With everything on the path locked, check the path and if it's still good move the KV pairs
+// from the end back to the start and put key in the slot freed up at the start.
+func (cc *ConcurrentCuckoo) move(path []cslot, key Key, val Value) (done, ok bool) {
+	c := cc.c
+	for _, p := range path {
+		if c.tables[p.ti].key(p.b, p.s) != p.key {
+			return false, false
+		}
+	}
+	if !cc.reserve(key) {
+		return true, false
+	}
+	for i := len(path) - 1; i > 0; i-- {
+		to, from := path[i], path[i-1]
+		ft := c.tables[from.ti]
+		c.tables[to.ti].set(to.b, to.s, ft.key(from.b, from.s), ft.val(from.b, from.s))
+		atomic.AddInt64(&cc.tcs[to.ti].elements, 1)
+		atomic.AddInt64(&cc.tcs[from.ti].elements, -1)
+		atomic.AddInt64(&cc.tcs[from.ti].bumps, 1)
+	}
+	p := path[0]
+	c.tables[p.ti].set(p.b, p.s, key, val)
+	atomic.AddInt64(&cc.tcs[p.ti].elements, 1)
+
+	bumps := int64(len(path) - 1)
+	atomic.AddInt64(&cc.bumps, bumps)
+	for {
+		max := atomic.LoadInt64(&cc.maxPathLen)
+		if bumps <= max || atomic.CompareAndSwapInt64(&cc.maxPathLen, max, bumps) {
+			break
+		}
+	}
+	return true, true
+}
+
+// Try to insert once. Returns done if the insert is finished and ok if it succeeded.
+// If not done, ntables is the number of tables seen, so a table can be added.
+func (cc *ConcurrentCuckoo) try(sc *scratch, key Key, val Value) (done, ok bool, ntables int) {
+	cc.grow.RLock()
+	defer cc.grow.RUnlock()
+	ntables = len(cc.c.tables)
+	cands := cc.candidates(sc, key)
+
+	stripes := cc.lock(cands, true)
+	done, ok = cc.place(cands, key, val)
+	cc.unlock(stripes, true)
+	if done {
+		return
+	}
+
+	for {
+		path := cc.search(sc, cands)
+		if path == nil {
+			return false, false, ntables
+		}
+		// lock the candidates as well, key might have been inserted by someone else
+		stripes = cc.lock(append(path, cands...), true)
+		if done, ok = cc.place(cands, key, val); !done {
+			done, ok = cc.move(path, key, val)
+		}
+		cc.unlock(stripes, true)
+		if done {
+			return
+		}
+		atomic.AddInt64(&cc.retries, 1)
+	}
+}
+
+// Given key, value insert a KV pair and return ok.
+func (cc *ConcurrentCuckoo) Insert(key Key, val Value) (ok bool) {
+	ok, _ = cc.InsertL(key, val)
+	return
+}
+
+// Given key, value insert a KV pair and return ok and a level for compatibility with Cuckoo.
+// The level is StartLevel on success, 0 if the load factor limited the insert, and LowestLevel on failure.
+func (cc *ConcurrentCuckoo) InsertL(key Key, val Value) (ok bool, rlevel int) {
+	c := cc.c
+	atomic.AddInt64(&cc.inserts, 1)
+	if key == c.emptyKey {
+		cc.emu.Lock()
+		defer cc.emu.Unlock()
+		if !c.emptyKeyValid {
+			if !cc.reserve(key) {
+				return false, 0
+			}
+			c.emptyKeyValid = true
+		}
+		c.emptyValue = val
+		return true, c.StartLevel
+	}
+
+	sc := cc.pool.Get().(*scratch)
+	defer cc.pool.Put(sc)
+	for {
+		done, ok, ntables := cc.try(sc, key, val)
+		if done {
+			if !ok {
+				return false, 0
+			}
+			return true, c.StartLevel
+		}
+		if !c.grow {
+			atomic.AddInt64(&cc.fails, 1)
+			c.failed(key, val, key, val, c.LowestLevel)
+			return false, c.LowestLevel
+		}
+		cc.grow.Lock()
+		if len(c.tables) == ntables {
+			c.TableGrows++
+			c.addTable(1.0)
+			cc.tcs = append(cc.tcs, concurrentTableCounters{})
+			c.grew(key, c.StartLevel)
+		}
+		cc.grow.Unlock()
+	}
+}
+
+// Call iter for each KV pair. The world is stopped while iterating.
+// iter must not call Insert or Delete on cc or it will deadlock.
+func (cc *ConcurrentCuckoo) Map(iter func(c *Cuckoo, key Key, val Value) (stop bool)) {
+	cc.grow.Lock()
+	defer cc.grow.Unlock()
+	cc.emu.Lock()
+	defer cc.emu.Unlock()
+	cc.c.Map(iter)
+}
+
+// If the Key is a numeric data type set the length here. Call before the table is shared.
+func (cc *ConcurrentCuckoo) SetNumericKeySize(size int) {
+	cc.grow.Lock()
+	cc.c.SetNumericKeySize(size)
+	cc.grow.Unlock()
+}
+
+// Set the Logger, see Cuckoo.SetLogger. It must be safe to call from any number of goroutines.
+func (cc *ConcurrentCuckoo) SetLogger(l Logger) {
+	cc.grow.Lock()
+	cc.c.SetLogger(l)
+	cc.grow.Unlock()
+}
+
+// Set the Hooks, see Cuckoo.SetHooks. They're called from any number of goroutines at once,
+// OnGrow with the world stopped. There's no OnAbort, Insert doesn't do a random walk.
+func (cc *ConcurrentCuckoo) SetHooks(h Hooks) {
+	cc.grow.Lock()
+	cc.c.SetHooks(h)
+	cc.grow.Unlock()
+}
+
+// Get the number of times a displacement path was found to be stale and the search was redone.
+func (cc *ConcurrentCuckoo) Retries() int {
+	return int(atomic.LoadInt64(&cc.retries))
+}
+
+// Get a copy of the counters. Operations in progress may or may not be counted.
+func (cc *ConcurrentCuckoo) GetCounters() Counters {
+	cc.grow.RLock()
+	cs := cc.c.Counters
+	cc.grow.RUnlock()
+	cs.Elements = int(atomic.LoadInt64(&cc.elements))
+	cs.Inserts = int(atomic.LoadInt64(&cc.inserts))
+	cs.Deletes = int(atomic.LoadInt64(&cc.deletes))
+	cs.Lookups = int(atomic.LoadInt64(&cc.lookups))
+	cs.Fails = int(atomic.LoadInt64(&cc.fails))
+	cs.Bumps = int(atomic.LoadInt64(&cc.bumps))
+	cs.MaxPathLen = int(atomic.LoadInt64(&cc.maxPathLen))
+	cs.Limited = atomic.LoadInt32(&cc.limited) != 0
+	return cs
+}
+
+// Get the value of some of the counters, see Cuckoo.GetCounter
+func (cc *ConcurrentCuckoo) GetCounter(s string) int {
+	cs := cc.GetCounters()
+	switch s {
+	case "bumps":
+		return cs.Bumps
+	case "inserts":
+		return cs.Inserts
+	case "elements":
+		return cs.Elements
+	case "size":
+		return cc.c.Size
+	case "MaxPathLen":
+		return cs.MaxPathLen
+	case "limited":
+		if cs.Limited {
+			return 1
+		}
+		return 0
+	default:
+		panic("GetCounter")
+	}
+}
+
+// Get a copy of the counters of each table, see GetCounters.
+func (cc *ConcurrentCuckoo) GetTableCounters() []TableCounters {
+	cc.grow.RLock()
+	defer cc.grow.RUnlock()
+	tcs := make([]TableCounters, len(cc.c.tables))
+	for i, t := range cc.c.tables {
+		tcs[i].Size = t.Size
+		tcs[i].Elements = int(atomic.LoadInt64(&cc.tcs[i].elements))
+		tcs[i].Bumps = int(atomic.LoadInt64(&cc.tcs[i].bumps))
+	}
+	return tcs
+}
+
+// Check the tables are consistent, see Cuckoo.Validate. It stops the world while it looks.
+func (cc *ConcurrentCuckoo) Validate() error {
+	cc.grow.Lock()
+	defer cc.grow.Unlock()
+	tes := make([]int, len(cc.tcs))
+	for i := range cc.tcs {
+		tes[i] = int(atomic.LoadInt64(&cc.tcs[i].elements))
+	}
+	return cc.c.validate(&cc.c.scratch, int(atomic.LoadInt64(&cc.elements)), tes)
+}
+
+// Get where key can be and where it is, see Cuckoo.Locate. It stops the world while it looks.
+// There's no ExplainInsert, Insert doesn't do a random walk.
+func (cc *ConcurrentCuckoo) Locate(key Key) Location {
+	cc.grow.Lock()
+	defer cc.grow.Unlock()
+	return cc.c.Locate(key)
+}
+
+// Get the value of some of the table counters, see Cuckoo.GetTableCounter
+func (cc *ConcurrentCuckoo) GetTableCounter(t int, s string) int {
+	cc.grow.RLock()
+	defer cc.grow.RUnlock()
+	if t >= len(cc.c.tables) {
+		panic("GetTableCounter")
+	}
+	switch s {
+	case "size":
+		return cc.c.tables[t].Size
+	case "elements":
+		return int(atomic.LoadInt64(&cc.tcs[t].elements))
+	case "bumps":
+		return int(atomic.LoadInt64(&cc.tcs[t].bumps))
+	default:
+		panic("GetTableCounter")
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"hash"
 	"math"
 	"math/rand"
+	"sync/atomic"
 	"unsafe"
 
 	"github.com/alecthomas/binary"
@@ -43,25 +44,28 @@ type Bucket struct {
 
 // Counters. All public but we now have an API to access them.
 type Counters struct {
-	BucketSize    int  // size of a single bucket (1 slot) in bytes
-	SlotsSize     int  // size of a single bucket * slots
-	Elements      int  // number of elements currently residing in the data structure
-	Inserts       int  // number of time insert has been called
-	Probes        int  // number of probes to find a free element
-	Iterations    int  // number of iterations through all the hash tables in an attemp an insert
-	Deletes       int  // number of times delete has been called
-	Lookups       int  // number of lookups
-	Aborts        int  // number of times an insert had to aborted
-	Fails         int  // number of times that insert failed
-	Bumps         int  // number of evicted buckets
-	TableGrows    int  // number of hash tables added
-	TraceCnt      int  // number of trance records out
-	MaxPathLen    int  // longest chain of bumps
-	MaxProbes     int  // highest number of probes
-	MaxIterations int  // highest number of interations
-	MinLevel      int  // lowest level achieved
-	MinTraceCnt   int  // lowest trace count
-	Limited       bool // were inserts limited by a load factor
+	BucketSize      int  // size of a single bucket (1 slot) in bytes
+	SlotsSize       int  // size of a single bucket * slots
+	Elements        int  // number of elements currently residing in the data structure
+	Inserts         int  // number of time insert has been called
+	Probes          int  // number of probes to find a free element
+	Iterations      int  // number of iterations through all the hash tables in an attemp an insert
+	Deletes         int  // number of times delete has been called
+	Lookups         int  // number of lookups
+	Aborts          int  // number of times an insert had to aborted
+	Fails           int  // number of times that insert failed
+	Bumps           int  // number of evicted buckets
+	TableGrows      int  // number of hash tables added
+	TraceCnt        int  // number of trance records out
+	MaxPathLen      int  // longest chain of bumps
+	MaxProbes       int  // highest number of probes
+	MaxIterations   int  // highest number of interations
+	MinLevel        int  // lowest level achieved
+	MinTraceCnt     int  // lowest trace count
+	Limited         bool // were inserts limited by a load factor
+	Mutations       int  // number of successful inserts, updates, and deletes, the sequence number of the last one
+	MaxMultiplicity int  // most values seen for one key, see Multimap
+	Expired         int  // number of expired KV pairs reclaimed, see InsertTTL
 }
 
 // Per table stats, again all public.
@@ -89,15 +93,20 @@ type Config struct {
 	Size          int     // Size = Tables * Buckets * Slots
 	MaxElements   int     // maximum number of elements the data structure can hold
 	HashName      string  // name of hashing function used
+	Split         bool    // keys and values are in separate arrays, see NewSplit
 }
 
 // A Table is a 2 dimensional matrix of buckets, the first index is the bucket number
 // and the second index is the slot number
 type Table struct {
 	buckets       []Slots     // each indexed bucket contains a slice of Bucket, called Slots, defined in kv_array.go or kv_slice.go
+	keys          []Key       // with the split layout the keys of bucket b are keys[b*Nslots:(b+1)*Nslots] and buckets is nil
+	vals          []Value     // and their values are the same elements of vals
 	c             *Cuckoo     // point back to main data structure
 	seed          uint64      // seed used per table to make a unique hash function
 	hfs           hash.Hash64 // hash function to use, the design allows for different hash functions per table but that is not used
+	versions      []uint32    // per bucket version, odd while the bucket is being written, only used by OptimisticCuckoo
+	exp           []int64     // per slot expiry time in unix nanoseconds, 0 for never, nil unless SetExpiry was called
 	Nbuckets      int         // number of buckets
 	Nslots        int         // number of slots
 	Size          int         // Size = Tables * Buckets * Slots
@@ -117,6 +126,7 @@ type Cuckoo struct {
 	//r             uint64          // reciprocal of Buckets
 	//n             uint64          // Size
 	rot      int  // table rotator
+	calls    int  // number of calls to insert
 	fp       bool // first pass of table insert
 	Config        // config data
 	Counters      // stats
@@ -128,18 +138,37 @@ type Cuckoo struct {
 	hfb    func(data []byte, seed uint64) uint64
 
 	//b				[]byte			// used for result of marshalled data
-	buf     *buf            // for marshalling data
-	encoder *binary.Encoder // encoder for serializing Key
+	scratch // for marshalling data, used by the single writer
 	//rnd				func() float64	// random numbers for eviction
 	rnd            *rand.Rand // random numbers used for eviction
 	eseed          int64      // seed for evictions
+	src            *evictRNG  // the state of rnd, see ExplainInsert
 	emptyKey       Key        // empty key
 	emptyValue     Value      // if empty key store value lives here and not in a hash table
 	emptyKeyValid  bool       // something store here
 	ekiz           bool       // empty key is zero
 	grow           bool       // are we allowed to add a hash table as needed?
-	Trace          bool       // produce a trace on stdout
-	NumericKeySize int        // if key is numeric what is size in bytes
+	versioned      bool       // keep per bucket versions for optimistic readers
+	salvage        bool       // on load empty damaged tables and keep the rest
+	Trace          bool       // produce a trace on stdout, see SetTracer
+	tracer         Tracer     // receives the steps of inserts
+	NumericKeySize int        // bytes of the key hashed from memory, 0 if it's serialized, see SetNumericKeySize
+	logger         Logger     // see SetLogger, stdout if nil
+	hooks          Hooks      // see SetHooks
+	arena          *arena     // keys are handles of byte strings in it, see BytesCuckoo
+	keysOnly       bool       // the split layout with no values, see NewSet
+	multi          bool       // a key can be in more than one slot, see Multimap
+	concurrent     bool       // wrapped by a ConcurrentCuckoo, which doesn't emit, record, or expire
+	clock          Clock      // tells the time for expiry, nil if there is none, see SetExpiry
+	exp            int64      // expiry time of the KV pair being inserted, see InsertTTL
+	emptyExp       int64      // expiry time of the empty key
+	sweepT, sweepB int        // table and bucket the next Sweep starts at
+
+	subs []chan Mutation // subscribers to the change feed, see Subscribe
+	rec  *Recorder       // records the operations, see Record
+
+	hists  Histograms // work per insert, see GetHistograms
+	checks int        // operations validated or skipped with the debug build tag, see check
 }
 
 // Simple struct and a couple of methods that satisfy the io.Writer interface.
@@ -151,6 +180,18 @@ type buf struct {
 	i    int
 }
 
+// Per goroutine space used to serialize a key before it is hashed.
+// A Cuckoo has one for its own use, concurrent readers need their own.
+type scratch struct {
+	buf     *buf            // for marshalling data
+	encoder *binary.Encoder // encoder for serializing Key
+}
+
+func newScratch() scratch {
+	b := newBuf(2048)
+	return scratch{buf: b, encoder: binary.NewEncoder(b)}
+}
+
 func (b *buf) Reset() {
 	b.i = 0
 }
@@ -230,6 +271,9 @@ func (c *Counters) CountersAdd(add *Counters) {
 	if add.Limited {
 		c.Limited = true
 	}
+	c.Mutations += add.Mutations
+	c.MaxMultiplicity = max(c.MaxMultiplicity, add.MaxMultiplicity)
+	c.Expired += add.Expired
 }
 
 // Get the value of some of the counters, need to finish them all XXX
@@ -245,11 +289,34 @@ func (c *Cuckoo) GetCounter(s string) int {
 		return c.Size
 	case "MaxPathLen":
 		return c.MaxPathLen
+	case "MaxMultiplicity":
+		return c.MaxMultiplicity
+	case "Expired":
+		return c.Expired
+	case "limited":
+		if c.Limited {
+			return 1
+		}
+		return 0
 	default:
 		panic("GetCounter")
 	}
 }
 
+// Get a copy of all the counters.
+func (c *Cuckoo) GetCounters() Counters {
+	return c.Counters
+}
+
+// Get a copy of the counters of each table.
+func (c *Cuckoo) GetTableCounters() []TableCounters {
+	tcs := make([]TableCounters, len(c.tables))
+	for i, t := range c.tables {
+		tcs[i] = t.TableCounters
+	}
+	return tcs
+}
+
 // Get the value of some of the table counters
 func (c *Cuckoo) GetTableCounter(t int, s string) int {
 	if t > c.Ntables {
@@ -288,19 +355,35 @@ func (c *Cuckoo) addTable(growFactor float64) {
 	c.Size += buckets * slots
 	c.MaxElements = int(float64(c.Size) * c.MaxLoadFactor)
 	t := new(Table)
-	t.buckets = make([]Slots, buckets, buckets)
-	// we should do this lazily
-	for b, _ := range t.buckets {
-		if len(t.buckets[b]) == 0 {
-			t.buckets[b] = makeSlots(t.buckets[b], slots)
-			for s, _ := range t.buckets[b] {
-				t.buckets[b][s].val = c.emptyValue // ???
+	if c.Split {
+		t.keys = make([]Key, buckets*slots)
+		if !c.keysOnly {
+			t.vals = make([]Value, buckets*slots)
+			for i := range t.vals {
+				t.vals[i] = c.emptyValue
 			}
 		}
+	} else {
+		t.buckets = make([]Slots, buckets, buckets)
+		// we should do this lazily
+		for b, _ := range t.buckets {
+			if len(t.buckets[b]) == 0 {
+				t.buckets[b] = makeSlots(t.buckets[b], slots)
+				for s, _ := range t.buckets[b] {
+					t.buckets[b][s].val = c.emptyValue // ???
+				}
+			}
+		}
+	}
+	if c.versioned {
+		t.versions = make([]uint32, buckets)
+	}
+	if c.clock != nil {
+		t.exp = make([]int64, buckets*slots)
 	}
 	t.seed = uint64(len(c.tables) + 1)
 	t.hfs = c.getHash(c.HashName, t.seed)
-	t.Nbuckets = c.Nbuckets
+	t.Nbuckets = buckets
 	t.Nslots = c.Nslots
 	t.Size = t.Nbuckets * t.Nslots
 	t.MaxElements = int(float64(t.Size) * c.MaxLoadFactor)
@@ -310,6 +393,30 @@ func (c *Cuckoo) addTable(growFactor float64) {
 	// perhaps reset the stats ???
 }
 
+// Keep a version for every bucket from now on so readers can detect concurrent writes.
+func (c *Cuckoo) setVersioned() {
+	c.versioned = true
+	for _, t := range c.tables {
+		if t.versions == nil {
+			t.versions = make([]uint32, t.Nbuckets)
+		}
+	}
+}
+
+// Bracket a write to bucket b. The version is odd while the write is in progress.
+// Inlines to a nil check when versions aren't used.
+func (t *Table) beginWrite(b uint64) {
+	if t.versions != nil {
+		atomic.AddUint32(&t.versions[b], 1)
+	}
+}
+
+func (t *Table) endWrite(b uint64) {
+	if t.versions != nil {
+		atomic.AddUint32(&t.versions[b], 1)
+	}
+}
+
 // Create a new cuckoo hash table of size  = tables * buckets * slots.
 // If buckets is negative, the next prime number greater than abs(buckets) is automatically generated,
 // You can pass an eseed to seed the random number generator used to select a bucket for eviction.
@@ -322,6 +429,17 @@ func (c *Cuckoo) addTable(growFactor float64) {
 // If specified, use emptyKey as the key that signifies that an element is unused.
 // However, often the default, the Go zero initialization suffices as the emptyKey.
 func New(tables, buckets, slots int, eseed int64, loadFactor float64, hashName string, emptyKey ...Key) *Cuckoo {
+	return newCuckoo(layoutInterleaved, tables, buckets, slots, eseed, loadFactor, hashName, emptyKey...)
+}
+
+// Create a new cuckoo hash table like New but with the split layout: the keys of each table are
+// in one array and the values in another, so a probe of a bucket only touches its keys.
+// With a Value much bigger than the Key lookups and inserts touch much less memory.
+func NewSplit(tables, buckets, slots int, eseed int64, loadFactor float64, hashName string, emptyKey ...Key) *Cuckoo {
+	return newCuckoo(layoutSplit, tables, buckets, slots, eseed, loadFactor, hashName, emptyKey...)
+}
+
+func newCuckoo(layout int, tables, buckets, slots int, eseed int64, loadFactor float64, hashName string, emptyKey ...Key) *Cuckoo {
 	var s Slots
 	var b Bucket
 
@@ -359,8 +477,9 @@ func New(tables, buckets, slots int, eseed int64, loadFactor float64, hashName s
 	*/
 
 	c.Nbuckets, c.Nslots = buckets, slots
-	c.buf = newBuf(2048)
-	c.encoder = binary.NewEncoder(c.buf)
+	c.Split, c.keysOnly = layout != layoutInterleaved, layout == layoutKeys
+	c.scratch = newScratch()
+	c.NumericKeySize = keySize()
 	c.grow = true
 	c.StartLevel, c.LowestLevel = InitialStartLevel, InitialLowestLevel
 	c.MaxLoadFactor = loadFactor
@@ -370,13 +489,14 @@ func New(tables, buckets, slots int, eseed int64, loadFactor float64, hashName s
 	c.ekiz = c.emptyKey == zeroKey
 	//c.rnd = rand.Float64
 
-	c.eseed = int64(eseed)
-	src := rand.NewSource(int64(c.eseed))
-	r := rand.New(src)
-	c.rnd = r
+	c.SetEvictionSeed(eseed)
 
 	c.BucketSize = int(unsafe.Sizeof(b))
 	c.SlotsSize = int(unsafe.Sizeof(s))
+	if c.keysOnly {
+		c.BucketSize = int(unsafe.Sizeof(b.key))
+		c.SlotsSize = c.BucketSize * slots
+	}
 
 	for i := 0; i < tables; i++ {
 		c.addTable(1.0)
@@ -385,14 +505,11 @@ func New(tables, buckets, slots int, eseed int64, loadFactor float64, hashName s
 	return c
 }
 
-// If the Key is a numeric data type set the length here.
+// Set the number of bytes of the key that are hashed straight from memory, 0 to serialize it first.
+// New sets it to the size of the Key if the Key can be hashed from memory, see keySize.
+// A smaller size hashes the first bytes, on a little endian machine 4 for a uint64 Key that holds uint32 values.
 func (c *Cuckoo) SetNumericKeySize(size int) {
-	switch size {
-	case 4:
-		c.buf.b = c.buf.base[0:4]
-	case 8:
-		c.buf.b = c.buf.base[0:8]
-	default:
+	if size < 0 || size > int(unsafe.Sizeof(zeroKey)) || size > 0 && keySize() == 0 {
 		panic("SetNumericKeySize")
 	}
 	c.NumericKeySize = size
@@ -418,10 +535,40 @@ func (c *Cuckoo) SetGrow(b bool) {
 	c.grow = b
 }
 
-// Set if hash tables can be added dynamically if an insert fails.
+// Set what ReadFrom does with a snapshot whose tables fail their checksums or that is truncated.
+// By default it fails and c is unchanged. With salvage set the damaged tables are emptied,
+// the rest are loaded, and the *CorruptError returned says what was lost.
+func (c *Cuckoo) SetSalvage(b bool) {
+	c.salvage = b
+}
+
+// Set the seed of the random numbers that pick which slot to evict.
 func (c *Cuckoo) SetEvictionSeed(seed int64) {
 	c.eseed = seed
-	rand.Seed(seed)
+	c.src = &evictRNG{x: uint64(seed)}
+	c.rnd = rand.New(c.src)
+}
+
+// The random numbers used for eviction. A splitmix64 generator, unlike the source in math/rand
+// its state is one word so ExplainInsert can copy it.
+type evictRNG struct {
+	x uint64
+}
+
+func (s *evictRNG) Seed(seed int64) {
+	s.x = uint64(seed)
+}
+
+func (s *evictRNG) Uint64() uint64 {
+	s.x += 0x9e3779b97f4a7c15
+	z := s.x
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (s *evictRNG) Int63() int64 {
+	return int64(s.Uint64() >> 1)
 }
 
 /*
@@ -437,7 +584,13 @@ func (c *Cuckoo) SetEvictionSeed(seed int64) {
 
 // Given key calculate the hash for the specified table
 func (t *Table) calcHashForTable(key Key) uint64 {
-	return t.c.calcHash(t.hfs, t.seed, key)
+	return t.c.calcHash(&t.c.scratch, t.hfs, t.seed, key)
+}
+
+// Same as above but the key is serialized into the caller's scratch space,
+// so it can be called by concurrent readers.
+func (t *Table) calcHashForTableS(s *scratch, key Key) uint64 {
+	return t.c.calcHash(s, t.hfs, t.seed, key)
 }
 
 // end inlined functions
@@ -468,9 +621,14 @@ func (c *Cuckoo) lowHash(hash int64) {
 // Given key return the value and a "ok" bool indicating success or failure.
 func (c *Cuckoo) Lookup(key Key) (Value, bool) {
 	c.Lookups++
+	return c.lookup(&c.scratch, key)
+}
 
+// Internal version of Lookup. It doesn't touch the counters and uses the scratch
+// space passed in, so any number of readers can call it at the same time.
+func (c *Cuckoo) lookup(sc *scratch, key Key) (Value, bool) {
 	if key == c.emptyKey {
-		if c.emptyKeyValid {
+		if c.emptyKeyValid && !c.emptyExpired() {
 			return c.emptyValue, true
 		} else {
 			return zeroVal, false
@@ -478,13 +636,31 @@ func (c *Cuckoo) Lookup(key Key) (Value, bool) {
 	}
 
 	for _, t := range c.tables {
-		h := uint64(t.calcHashForTable(key))
+		h := uint64(t.calcHashForTableS(sc, key))
 		b := h % uint64(t.Nbuckets)
 
+		if t.keys != nil {
+			i := int(b) * t.Nslots
+			for s, k := range t.keys[i : i+t.Nslots] {
+				if k == key {
+					if t.exp != nil && t.expiredNow(b, s) {
+						return zeroVal, false
+					}
+					if t.vals == nil {
+						return zeroVal, true
+					}
+					return t.vals[i+s], true
+				}
+			}
+			continue
+		}
 		for s, _ := range t.buckets[b] {
 			//fmt.Printf("Lookup: key=%d, table=%d, bucket=%d, slot=%d, found key=%d\n", key, t, b, s, c.tbs[t][b][s].key)
 			if t.buckets[b][s].key == key {
 				//fmt.Printf("Lookup: table=%d, bucket=%d, slot=%d, key=%d, value=%d\n", t, b, s, key, c.tbs[t][b][s].val)
+				if t.exp != nil && t.expiredNow(b, s) {
+					return zeroVal, false
+				}
 				return t.buckets[b][s].val, true
 			}
 		}
@@ -492,15 +668,42 @@ func (c *Cuckoo) Lookup(key Key) (Value, bool) {
 	return zeroVal, false
 }
 
+// Find where key lives in the tables, not the empty key which lives outside them.
+func (c *Cuckoo) find(sc *scratch, key Key) (t *Table, b uint64, s int, ok bool) {
+	for _, t = range c.tables {
+		b = t.calcHashForTableS(sc, key) % uint64(t.Nbuckets)
+		for s = 0; s < t.Nslots; s++ {
+			if t.key(b, s) == key {
+				return t, b, s, true
+			}
+		}
+	}
+	return nil, 0, 0, false
+}
+
 // Given key delete the bucket. Return the value found and a bool "ok" indicating success
 func (c *Cuckoo) Delete(key Key) (Value, bool) {
 	c.Deletes++
+	if debug {
+		defer c.check("Delete")
+	}
+	if c.rec != nil {
+		c.rec.log(recDelete, key, zeroVal)
+	}
 
 	//fmt.Printf("key=%v, c.emptyKey=%v\n", key, c.emptyKey)
 	if key == c.emptyKey {
+		if c.emptyExpired() {
+			c.reclaimEmpty()
+			return zeroVal, false
+		}
 		if c.emptyKeyValid {
 			c.Elements--
 			c.emptyKeyValid = false
+			c.Mutations++
+			if c.subs != nil {
+				c.emit(MutationDelete, key, c.emptyValue)
+			}
 			return c.emptyValue, true
 		} else {
 			//fmt.Printf("Delete: can't find emptyKey %v\n", key)
@@ -510,17 +713,27 @@ func (c *Cuckoo) Delete(key Key) (Value, bool) {
 
 	for _, t := range c.tables {
 		b := t.calcHashForTable(key) % uint64(t.Nbuckets)
-		for s, _ := range t.buckets[b] {
+		for s := 0; s < t.Nslots; s++ {
 			//fmt.Printf("Delete: check key=%d, table=%d, bucket=%d, slot=%d, found key=%d\n", key, t, b, s, c.tbs[t][b][s].key)
-			if t.buckets[b][s].key == key {
+			if t.key(b, s) == key {
 				//fmt.Printf("Delete: found key=%d, value=%d, table=%d, bucket=%d, slot=%d\n", key, c.tbs[t][b][s].val, t, b, s)
-				t.buckets[b][s].key = c.emptyKey
+				if t.exp != nil && t.expiredNow(b, s) {
+					c.reclaim(t, b, s)
+					return zeroVal, false
+				}
+				t.beginWrite(b)
+				t.setKey(b, s, c.emptyKey)
+				t.endWrite(b)
 				t.Elements--
 				c.Elements--
 				if c.Elements < 0 {
 					panic("Delete")
 				}
-				return t.buckets[b][s].val, true
+				c.Mutations++
+				if c.subs != nil {
+					c.emit(MutationDelete, key, t.val(b, s))
+				}
+				return t.val(b, s), true
 			}
 		}
 	}
@@ -528,14 +741,14 @@ func (c *Cuckoo) Delete(key Key) (Value, bool) {
 	return zeroVal, false
 }
 
-var calls int
-
 // Internal version of insert routine.
 // Given key, value, and a starting level insert the KV pair. Return ok and level needed to insert.
 // If level 0 is returned it means the insert failed
 func (c *Cuckoo) insert(key Key, val Value, ilevel int) (ok bool, level int) {
 	var k Key
 	var v Value
+	var e int64 // expiry time of k
+	var now int64
 	var bumps int
 	var depth int
 
@@ -543,6 +756,7 @@ func (c *Cuckoo) insert(key Key, val Value, ilevel int) (ok bool, level int) {
 	ins = func(kx Key, vx Value) bool {
 		var sk Key
 		var sv Value
+		var se int64
 		var pk Key
 		//fmt.Printf("Insert: level=%d, key=%d, ", level, kx)
 		depth++
@@ -562,26 +776,33 @@ func (c *Cuckoo) insert(key Key, val Value, ilevel int) (ok bool, level int) {
 			// check all the slots in the current table and see if we can insert
 			//s := lowHash(h, )
 			//for {
-			for s, _ := range t.buckets[b] {
+			for s := 0; s < t.Nslots; s++ {
 				c.Probes++
-				pk = t.buckets[b][s].key // avoid previous allocation
+				pk = t.key(b, s) // avoid previous allocation
 				c.TraceCnt++
-				if c.Trace {
-					fmt.Printf("{%q: %d, %q: %d, %q: %q, %q: %d, %q: %d, %q: %d, %q: %v, %q: %v},\n",
-						"i", c.TraceCnt, "l", level, "op", "P", "t", t, "b", b, "s", s, "k", k, "v", v)
+				if c.Trace || c.tracer != nil {
+					c.trace(level, TraceProbe, ti, int(b), s, k, v)
+				}
+				if pk != c.emptyKey && t.expired(b, s, now) {
+					c.reclaim(t, b, s) // cheaper than evicting a live KV pair
+					pk = c.emptyKey
 				}
-				if pk == c.emptyKey || pk == k { // added replacement semantics
-					t.buckets[b][s].key, t.buckets[b][s].val = k, v
+				if pk == c.emptyKey || pk == k && !c.multi { // added replacement semantics
+					t.beginWrite(b)
+					t.set(b, s, k, v)
+					t.setExp(b, s, e)
+					t.endWrite(b)
 					c.TraceCnt++
-					if c.Trace {
-						fmt.Printf("{%q: %d, %q: %d, %q: %q, %q: %d, %q: %d, %q: %d, %q: %v, %q: %v},\n",
-							"i", c.TraceCnt, "l", level, "op", "I", "t", t, "b", b, "s", s, "k", k, "v", v)
+					if c.Trace || c.tracer != nil {
+						c.trace(level, TraceInsert, ti, int(b), s, k, v)
 					}
 					if pk == c.emptyKey || pk == k {
 						//fmt.Printf("Insert: h=%#x, level=%d, table=%d, bucket=%d, slot=%d, pk=%d, key=%d, value=%d\n", h, level, t, b, s, pk, k, v)
 					}
-					c.Elements++
-					t.Elements++
+					if pk == c.emptyKey { // not a replacement
+						c.Elements++
+						t.Elements++
+					}
 					return true
 				}
 			}
@@ -597,21 +818,25 @@ func (c *Cuckoo) insert(key Key, val Value, ilevel int) (ok bool, level int) {
 			t.Bumps++
 			victim := c.rbetween(0, t.Nslots-1)
 			//fmt.Printf("insert: level=%d, bump value=%d for value=%d, table=%d, bucket=%d, slot=%d\n", level, c.tbs[t][b][victim].val, val, t, b, victim)
-			sk, sv = t.buckets[b][victim].key, t.buckets[b][victim].val // avoid previous stack allocation
+			sk, sv = t.key(b, victim), t.val(b, victim) // avoid previous stack allocation
+			if t.exp != nil {
+				se = t.exp[int(b)*t.Nslots+victim]
+			}
 			c.TraceCnt++
-			if c.Trace {
-				fmt.Printf("{%q: %d, %q: %d, %q: %q, %q: %d, %q: %d, %q: %d, %q: %v, %q: %v},\n",
-					"i", c.TraceCnt, "l", level, "op", "E", "t", t, "b", b, "s", victim, "k", sk, "v", v)
+			if c.Trace || c.tracer != nil {
+				c.trace(level, TraceEvict, ti, int(b), victim, sk, sv)
 			}
-			t.buckets[b][victim].key = k
-			t.buckets[b][victim].val = v
+			t.beginWrite(b)
+			t.set(b, victim, k, v)
+			t.setExp(b, victim, e)
+			t.endWrite(b)
 			c.TraceCnt++
-			if c.Trace {
-				fmt.Printf("{%q: %d, %q: %d, %q: %q, %q: %d, %q: %d, %q: %d, %q: %v, %q: %v},\n",
-					"i", c.TraceCnt, "l", level, "op", "I", "t", t, "b", b, "s", victim, "k", k, "v", v)
+			if c.Trace || c.tracer != nil {
+				c.trace(level, TraceInsert, ti, int(b), victim, k, v)
 			}
 			k = sk
 			v = sv
+			e = se
 			//c.calcHashes(k) ??? XXX ???
 			//fmt.Printf("insert: level=%d, new key=%d, val=%d\n", level, k, v)
 			ti++
@@ -643,7 +868,6 @@ func (c *Cuckoo) insert(key Key, val Value, ilevel int) (ok bool, level int) {
 		// Give up, we call this a "fail"
 		if level <= c.LowestLevel {
 			c.Fails++
-			fmt.Printf("cukcoo: Insert FAILED, val=%v, key=%v\n", k, v)
 			return false
 		}
 		if level <= 0 {
@@ -658,7 +882,7 @@ func (c *Cuckoo) insert(key Key, val Value, ilevel int) (ok bool, level int) {
 			// This is an interesting case that I had never seen before. Insert fails and a random
 			// piece of data that was previusly inserted has been lost. Luckily the fix is pretty easy.
 			if !found {
-				fmt.Printf("insert: aborted at key=%d, value=%d, calls=%d, depth=%d, level=%d, aborts=%d\n", key, val, calls, depth, level, c.Aborts)
+				//fmt.Printf("insert: aborted at key=%d, value=%d, calls=%d, depth=%d, level=%d, aborts=%d\n", key, val, c.calls, depth, level, c.Aborts)
 				return false
 			}
 		}
@@ -668,18 +892,26 @@ func (c *Cuckoo) insert(key Key, val Value, ilevel int) (ok bool, level int) {
 
 	// insert starts here
 	//fmt.Printf("Insert: level=%d, key=%d, value=%d\n", level, key, val)
-	calls++
+	c.calls++
 	k = key
 	v = val
-	sva, svi := c.Probes, c.Iterations
+	e = c.exp
+	if c.clock != nil {
+		now = c.now()
+	}
+	sva, svi, sab := c.Probes, c.Iterations, c.Aborts
 	level = ilevel
 again:
-	if c.Elements >= c.MaxElements {
+	if c.Elements >= c.MaxElements && (c.clock == nil || c.reclaimBuckets(k, now) == 0) {
 		//fmt.Printf("insert: limited at %v\n", key)
+		c.limited(k, c.Elements, !c.Limited)
 		c.Limited = true
 		return false, 0
 	}
 	if k == c.emptyKey {
+		if c.emptyExpired() {
+			c.reclaimEmpty()
+		}
 		if c.emptyKeyValid {
 			panic("emptyKeyValid")
 		} else {
@@ -687,6 +919,7 @@ again:
 			c.Elements++
 			c.emptyKeyValid = true
 			c.emptyValue = v
+			c.emptyExp = e
 		}
 		return true, level
 	}
@@ -695,12 +928,17 @@ again:
 		c.Inserts++
 	} else {
 		if c.grow {
-			fmt.Printf("insert: add a table, level=%d, key=%v, val=%v\n", level, k, v)
+			//fmt.Printf("insert: add a table, level=%d, key=%v, val=%v\n", level, k, v)
 			c.TableGrows++
 			//c.Ntables++
-			c.addTable(0)
+			c.addTable(1.0)
+			c.grew(k, level)
 			goto again
 		}
+		c.failed(key, val, k, v, level)
+	}
+	if ok && c.Aborts > sab && c.hooks.OnAbort != nil {
+		c.hooks.OnAbort(AbortEvent{Key: key, Level: level, Iterations: c.Iterations - svi})
 	}
 	if c.Probes-sva > c.MaxProbes {
 		c.MaxProbes = c.Probes - sva
@@ -714,6 +952,7 @@ again:
 	if bumps > c.MaxPathLen {
 		c.MaxPathLen = bumps
 	}
+	c.hists.record(c.Probes-sva, bumps, c.Iterations-svi)
 	c.rot++
 	c.rot %= c.Ntables
 	//fmt.Printf("c.rot=%d, c.Ntables=%d\n", c.rot, c.Ntables)
@@ -721,29 +960,83 @@ again:
 	return
 }
 
-// Given key, value insert a KV pair and return ok.
+// Replace the value of key if it's in a table, otherwise insert the KV pair.
+// insert starts at a different table each time, so it can put a second copy of a key
+// that is already in a table it doesn't look at first.
+// Also return if it was an insert or an update.
+func (c *Cuckoo) upsert(key Key, val Value) (ok bool, level int, op MutationOp) {
+	if key == c.emptyKey {
+		if c.emptyKeyValid && !c.emptyExpired() {
+			c.emptyValue = val
+			c.emptyExp = c.exp
+			c.Inserts++
+			return true, c.StartLevel, MutationUpdate
+		}
+	} else if t, b, s, found := c.find(&c.scratch, key); found {
+		t.beginWrite(b)
+		t.setVal(b, s, val)
+		t.setExp(b, s, c.exp)
+		t.endWrite(b)
+		c.Inserts++
+		return true, c.StartLevel, MutationUpdate
+	}
+	ok, level = c.insert(key, val, c.StartLevel)
+	return ok, level, MutationInsert
+}
+
+// Given key, value insert a KV pair and return ok. If key is already there its value is replaced.
 func (c *Cuckoo) Insert(key Key, val Value) (ok bool) {
-	ok, _ = c.insert(key, val, c.StartLevel)
+	ok, _ = c.InsertL(key, val)
 	return
 }
 
 // Given key, value insert a KV pair and return ok and level needed to insert
 func (c *Cuckoo) InsertL(key Key, val Value) (ok bool, rlevel int) {
-	ok, rlevel = c.insert(key, val, c.StartLevel)
+	var op MutationOp
+
+	if debug {
+		defer c.check("InsertL")
+	}
+	if c.multi {
+		// a Multimap keeps every copy of a key
+		if c.rec != nil {
+			c.rec.log(recInsert, key, val)
+		}
+		if ok, rlevel = c.insert(key, val, c.StartLevel); ok {
+			c.Mutations++
+			if c.subs != nil {
+				c.emit(MutationInsert, key, val)
+			}
+		}
+		return
+	}
+	if c.rec != nil {
+		c.rec.log(recUpsert, key, val)
+	}
+	if ok, rlevel, op = c.upsert(key, val); ok {
+		c.Mutations++
+		if c.subs != nil {
+			c.emit(op, key, val)
+		}
+	}
 	return
 }
 
 // should this be redone??
 func (c *Cuckoo) Map(iter func(c *Cuckoo, key Key, val Value) (stop bool)) {
-	if c.emptyKeyValid {
+	var now int64
+	if c.clock != nil {
+		now = c.now()
+	}
+	if c.emptyKeyValid && !c.emptyExpired() {
 		iter(c, c.emptyKey, c.emptyValue)
 	}
 
 	for _, t := range c.tables {
-		for _, s := range t.buckets {
-			for _, b := range s {
-				if b.key != c.emptyKey {
-					if iter(c, b.key, b.val) {
+		for b := 0; b < t.Nbuckets; b++ {
+			for s := 0; s < t.Nslots; s++ {
+				if k := t.key(uint64(b), s); k != c.emptyKey && !t.expired(uint64(b), s, now) {
+					if iter(c, k, t.val(uint64(b), s)) {
 						return
 					}
 				}
@@ -755,11 +1048,11 @@ func (c *Cuckoo) Map(iter func(c *Cuckoo, key Key, val Value) (stop bool)) {
 // doesn't print the value if c.emptyKeyValid is true
 func (c *Cuckoo) Print() {
 	for ti, t := range c.tables {
-		for si, s := range t.buckets {
+		for si := 0; si < t.Nbuckets; si++ {
 			fmt.Printf("[%d][%d]: ", ti, si)
 			cnt := 0
-			for _, b := range s {
-				if b.key != c.emptyKey {
+			for s := 0; s < t.Nslots; s++ {
+				if t.key(uint64(si), s) != c.emptyKey {
 					cnt++
 				}
 			}
@@ -2,12 +2,32 @@
 package cuckoo_test
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unsafe"
 
 	. "leb.io/cuckoo"
+	"leb.io/cuckoo/demo"
+	"leb.io/cuckoo/exporter"
 	. "leb.io/cuckoo/internal/dstest"
 	"leb.io/hrff"
 )
@@ -31,6 +51,9 @@ type KeySet struct {
 
 var ks *KeySet
 
+// OptimisticCuckoo readers race with the writer by design, see race_test.go
+var raceEnabled bool
+
 func hu(v uint64, u string) hrff.Int64 {
 	return hrff.Int64{V: int64(v), U: u}
 }
@@ -47,6 +70,7 @@ type config struct {
 	tables int
 	slots  int
 	n      int
+	split  bool // see NewSplit
 }
 
 const ef = 1.01
@@ -117,7 +141,11 @@ type IB interface {
 func setup(t IB, cf config) (d *DSTest) { // testing.T
 	//New(tables, -int(float64(n)*ef+add)/(tables*slots), slots, 0, lf, hashName)
 	//start := time.Now()
-	c := New(cf.tables, -int(float64(cf.n)*cf.ef+cf.add)/(cf.tables*cf.slots), cf.slots, 0, cf.lf, hashName)
+	newc := New
+	if cf.split {
+		newc = NewSplit
+	}
+	c := newc(cf.tables, -int(float64(cf.n)*cf.ef+cf.add)/(cf.tables*cf.slots), cf.slots, 0, cf.lf, hashName)
 	if c == nil {
 		t.Logf("TestBasic: failed probably because slots don't match")
 		t.FailNow()
@@ -142,9 +170,25 @@ func TestBasic(t *testing.T) {
 }
 
 func TestMemoryEfficiency(t *testing.T) {
-	var cf = config{ef: 1.01, add: 32.0, lf: 1.0, flf: 1.0, tables: 2, slots: 8, n: 1000000}
+	for _, split := range []bool{false, true} {
+		var cf = config{ef: 1.01, add: 32.0, lf: 1.0, flf: 1.0, tables: 2, slots: 8, n: 1000000, split: split}
+		t.Run(layoutName(split), func(t *testing.T) {
+			memoryEfficiency(t, cf)
+		})
+	}
+}
+
+func layoutName(split bool) string {
+	if split {
+		return "split"
+	}
+	return "interleaved"
+}
+
+func memoryEfficiency(t *testing.T, cf config) {
 	var msb, msa runtime.MemStats
 
+	runtime.GC()
 	runtime.ReadMemStats(&msb)
 	d := setup(t, cf)
 	//d := setup(t, cf)
@@ -152,6 +196,7 @@ func TestMemoryEfficiency(t *testing.T) {
 	//	c.Insert(k, v)
 	//}
 	fs := d.Fill(cf.tables, cf.n/(cf.tables*cf.slots), cf.slots, 1.0, cf.flf, false, false, false, true)
+	runtime.GC()
 	runtime.ReadMemStats(&msa)
 
 	//dump_mstats(&msb, true, false, false)
@@ -162,7 +207,7 @@ func TestMemoryEfficiency(t *testing.T) {
 
 	c := (d.I).(*Cuckoo)
 	t.Logf("Cuckoo Hash LoadFactor:       %0.2f", c.GetLoadFactor())
-	t.Logf("Cuckoo Hash memory allocated: %0.0f MiB", float64(msa.Alloc-msb.Alloc)/float64(1<<20))
+	t.Logf("Cuckoo Hash memory allocated: %0.0f MiB", float64(int64(msa.Alloc)-int64(msb.Alloc))/float64(1<<20))
 	t.Logf("Go map memory allocated:      %0.0f MiB", float64(ks.AllocBytes)/float64(1<<20))
 	//t.Logf("stats=%#v\n", fs)
 	fs.Fails = fs.Fails
@@ -170,81 +215,2498 @@ func TestMemoryEfficiency(t *testing.T) {
 	//fmt.Printf("Counters=%#v\n\n", c.Counters)
 }
 
-func benchmarkCuckooInsert(ef, add, lf float64, tables, slots int, hash string, b *testing.B) {
-	//t.Logf("BenchmarkCuckooInsert: N=%d, ef=%f, add=%f, lf=%f, tables=%d, slots=%d\n", b.N, ef, add, lf, tables, slots)
-	d := setup(b, cf)
-	//fmt.Printf("Config=%#v\n", c.Config)
-	//fmt.Printf("N=%d\n", b.N)
-	b.ResetTimer()
+func TestSyncCuckoo(t *testing.T) {
+	const n = 20000
+	const readers = 8
+	var wg sync.WaitGroup
 
-	if true {
-		for i := 0; i < b.N; i++ {
-			d.I.Insert(ks.Keys[i%n], ks.Vals[i%n])
+	c := NewSync(4, -n/(4*8)*2, 8, 0, 1.0, hashName)
+	if c == nil {
+		t.Fatalf("TestSyncCuckoo: NewSync failed probably because slots don't match")
+	}
+	c.SetNumericKeySize(8)
+	for i := 1; i <= n/2; i++ {
+		c.Insert(Key(i), Value(i))
+	}
+
+	// readers look up the first half while the writer adds the second half
+	errs := make(chan string, readers)
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 1; i <= n/2; i++ {
+				if v, ok := c.Lookup(Key(i)); !ok || v != Value(i) {
+					errs <- fmt.Sprintf("Lookup(%d)=%v, %v", i, v, ok)
+					return
+				}
+			}
+		}()
+	}
+	for i := n/2 + 1; i <= n; i++ {
+		if !c.Insert(Key(i), Value(i)) {
+			t.Fatalf("Insert(%d) failed", i)
 		}
-	} else {
-		// func (d *DSTest) Fill(tables, buckets, slots, ibase int, flf float64, verbose, pl, progress bool, r bool) *FillStats {
+	}
+	wg.Wait()
+	close(errs)
+	for e := range errs {
+		t.Error(e)
+	}
 
-		fs := d.Fill(tables, b.N, slots, 1, flf, false, false, false, true)
-		fs.Fails = fs.Fails
-		//b.Logf("stats=%#v\n", fs)
+	cs := c.GetCounters()
+	if cs.Elements != n || cs.Lookups != readers*n/2 {
+		t.Errorf("Elements=%d, Lookups=%d", cs.Elements, cs.Lookups)
 	}
-	//fmt.Printf("Config=%#v\n", c.Config)
-	//fmt.Printf("Counters=%#v\n\n", c.Counters)
-	b.ReportAllocs()
 }
 
-func benchmarkCuckooSearch(ef, add, lf float64, tables, slots int, hash string, b *testing.B) {
-	var cf = config{ef: 1.01, add: 32.0, lf: 1.0, flf: 0.8, tables: 4, slots: 8, n: 1000000}
-	d := setup(b, cf)
-	for i := 0; i < b.N; i++ {
-		d.I.Insert(ks.Keys[i%n], ks.Vals[i%n])
+func TestOptimisticCuckoo(t *testing.T) {
+	const n = 20000
+	const readers = 8
+	var wg sync.WaitGroup
+
+	if raceEnabled {
+		t.Skip("lock free readers race with the writer by design")
+	}
+	// small table with few slots so inserts bump a lot and grow
+	c := NewOptimistic(2, -n/(2*8), 8, 0, 1.0, hashName)
+	if c == nil {
+		t.Fatalf("TestOptimisticCuckoo: NewOptimistic failed probably because slots don't match")
+	}
+	c.SetNumericKeySize(8)
+	for i := 1; i <= n/2; i++ {
+		c.Insert(Key(i), Value(i))
 	}
-	b.ResetTimer()
-	b.ReportAllocs()
 
-	for i := 0; i < b.N; i++ {
-		d.I.Lookup(ks.Keys[i%n])
+	// readers keep looking up the first half until the writer is done with the second half
+	var done int32
+	errs := make(chan string, readers)
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&done) == 0 {
+				for i := 1; i <= n/2; i++ {
+					if v, ok := c.Lookup(Key(i)); !ok || v != Value(i) {
+						errs <- fmt.Sprintf("Lookup(%d)=%v, %v", i, v, ok)
+						return
+					}
+				}
+			}
+		}()
+	}
+	for i := n/2 + 1; i <= n; i++ {
+		if !c.Insert(Key(i), Value(i)) {
+			t.Fatalf("Insert(%d) failed", i)
+		}
+	}
+	atomic.StoreInt32(&done, 1)
+	wg.Wait()
+	close(errs)
+	for e := range errs {
+		t.Error(e)
 	}
+	for i := 1; i <= n; i++ {
+		if v, ok := c.Lookup(Key(i)); !ok || v != Value(i) {
+			t.Fatalf("Lookup(%d)=%v, %v", i, v, ok)
+		}
+	}
+	t.Logf("retries=%d", c.Retries())
 }
 
-func benchmarkCuckooDelete(ef, add, lf float64, tables, slots int, hash string, b *testing.B) {
-	d := setup(b, cf)
-	for i := 0; i < b.N; i++ {
-		d.I.Insert(ks.Keys[i%n], ks.Vals[i%n])
+// Lookups of missing keys have to finish while a writer never stops, and expired KV pairs
+// aren't found.
+func TestOptimisticMiss(t *testing.T) {
+	const n = 2000
+	const readers = 4
+	var wg sync.WaitGroup
+
+	if raceEnabled {
+		t.Skip("lock free readers race with the writer by design")
 	}
-	b.ResetTimer()
-	b.ReportAllocs()
+	clk := &fakeClock{now: time.Unix(1e9, 0)}
+	cc := New(2, -n/(2*8), 8, 0, 1.0, hashName)
+	cc.SetExpiry(clk)
+	for i := 1; i <= n/2; i++ {
+		cc.InsertTTL(Key(i), Value(i), time.Minute)
+	}
+	clk.now = clk.now.Add(time.Minute)
+	c := NewOptimisticFrom(cc)
 
-	for i := 0; i < b.N; i++ {
-		d.I.Delete(ks.Keys[i%n])
+	var done int32
+	go func() {
+		for atomic.LoadInt32(&done) == 0 {
+			for i := n/2 + 1; i <= n; i++ {
+				c.Insert(Key(i), Value(i))
+			}
+			for i := n/2 + 1; i <= n; i++ {
+				c.Delete(Key(i))
+			}
+		}
+	}()
+	errs := make(chan string, readers)
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				for i := 1; i <= n/2; i++ {
+					if v, ok := c.Lookup(Key(i)); ok {
+						errs <- fmt.Sprintf("Lookup(%d)=%v, %v after the TTL", i, v, ok)
+						return
+					}
+				}
+			}
+		}()
 	}
+	wg.Wait()
+	atomic.StoreInt32(&done, 1)
+	close(errs)
+	for e := range errs {
+		t.Error(e)
+	}
+	t.Logf("retries=%d", c.Retries())
 }
 
-func BenchmarkCuckoo2T2SInsert(b *testing.B) {
-	benchmarkCuckooInsert(ef, add, lf, tables, slots, hashName, b)
+// A ConcurrentCuckoo doesn't emit, record, or expire, so it refuses a Cuckoo that does,
+// and the Cuckoo it wraps refuses to start.
+func TestConcurrentRefuses(t *testing.T) {
+	mustPanic := func(name string, f func()) {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("%s didn't panic", name)
+			}
+		}()
+		f()
+	}
+	mk := func() *Cuckoo {
+		return New(2, 11, 8, 0, 1.0, hashName)
+	}
+	c := mk()
+	c.Subscribe()
+	mustPanic("NewConcurrentFrom with a subscriber", func() { NewConcurrentFrom(c) })
+	c = mk()
+	c.SetExpiry(nil)
+	mustPanic("NewConcurrentFrom with expiry", func() { NewConcurrentFrom(c) })
+	c = mk()
+	if _, err := c.Record(ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	mustPanic("NewConcurrentFrom with a Recorder", func() { NewConcurrentFrom(c) })
+
+	c = mk()
+	NewConcurrentFrom(c)
+	mustPanic("Subscribe", func() { c.Subscribe() })
+	mustPanic("Record", func() { c.Record(ioutil.Discard) })
+	mustPanic("SetExpiry", func() { c.SetExpiry(nil) })
+	mustPanic("InsertTTL", func() { c.InsertTTL(Key(1), Value(1), time.Minute) })
 }
 
-func BenchmarkCuckoo2T2SSearch(b *testing.B) {
-	benchmarkCuckooSearch(ef, add, lf, tables, slots, hashName, b)
+// Many goroutines insert, delete, and look up at once. Each one owns a range of keys and
+// checks the table against its own map. Displacement paths move everyone's keys around.
+// Run with -race.
+func TestConcurrentCuckooStress(t *testing.T) {
+	const workers = 8
+	const keys = 3000 // per worker
+	const ops = 20000 // per worker
+	var wg sync.WaitGroup
+
+	// about 70% of the keys are live at any time, so this is a load factor over 90%
+	// and inserts have to displace and sometimes add a table
+	c := NewConcurrent(2, -workers*keys*3/4/(2*8), 8, 0, 1.0, hashName)
+	if c == nil {
+		t.Fatalf("TestConcurrentCuckooStress: NewConcurrent failed probably because slots don't match")
+	}
+	c.SetNumericKeySize(8)
+
+	oracles := make([]map[Key]Value, workers)
+	errs := make(chan string, workers)
+	for w := 0; w < workers; w++ {
+		oracles[w] = make(map[Key]Value)
+		wg.Add(1)
+		go func(w int, m map[Key]Value) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(w)))
+			base := w*keys + 1
+			for i := 0; i < ops; i++ {
+				k := Key(base + r.Intn(keys))
+				switch op := r.Intn(10); {
+				case op < 5:
+					v := Value(r.Int63())
+					if c.Insert(k, v) {
+						m[k] = v
+					}
+				case op < 7:
+					v, ok := c.Delete(k)
+					mv, mok := m[k]
+					if ok != mok || v != mv {
+						errs <- fmt.Sprintf("Delete(%d)=%v, %v expected %v, %v", k, v, ok, mv, mok)
+						return
+					}
+					delete(m, k)
+				default:
+					v, ok := c.Lookup(k)
+					mv, mok := m[k]
+					if ok != mok || v != mv {
+						errs <- fmt.Sprintf("Lookup(%d)=%v, %v expected %v, %v", k, v, ok, mv, mok)
+						return
+					}
+				}
+			}
+		}(w, oracles[w])
+	}
+	wg.Wait()
+	close(errs)
+	for e := range errs {
+		t.Fatal(e)
+	}
+
+	tot := 0
+	for _, m := range oracles {
+		tot += len(m)
+		for k, v := range m {
+			if cv, ok := c.Lookup(k); !ok || cv != v {
+				t.Fatalf("Lookup(%d)=%v, %v expected %v", k, cv, ok, v)
+			}
+		}
+	}
+	cnt := 0
+	c.Map(func(c *Cuckoo, key Key, val Value) (stop bool) {
+		cnt++
+		return
+	})
+	cs := c.GetCounters()
+	if cs.Elements != tot || cnt != tot {
+		t.Fatalf("Elements=%d, Map=%d, expected %d", cs.Elements, cnt, tot)
+	}
+	t.Logf("elements=%d, bumps=%d, MaxPathLen=%d, TableGrows=%d, retries=%d", cs.Elements, cs.Bumps, cs.MaxPathLen, cs.TableGrows, c.Retries())
 }
 
-func BenchmarkCuckoo2T2SDelete(b *testing.B) {
-	benchmarkCuckooDelete(ef, add, lf, tables, slots, hashName, b)
+func TestSharded(t *testing.T) {
+	const shards = 4
+	const n = 100000
+
+	s := NewSharded(shards, 4, -n/(shards*4*8)*10/9, 8, 0, 1.0, hashName)
+	if s == nil {
+		t.Fatalf("TestSharded: NewSharded failed probably because slots don't match")
+	}
+	s.SetNumericKeySize(8)
+	keys := make([]Key, n)
+	vals := make([]Value, n)
+	for i := range keys {
+		keys[i], vals[i] = Key(i+1), Value(i+1)
+	}
+	if fails := s.Load(keys, vals); len(fails) != 0 {
+		t.Fatalf("Load: %d fails", len(fails))
+	}
+	for i, k := range keys {
+		if v, ok := s.Lookup(k); !ok || v != vals[i] {
+			t.Fatalf("Lookup(%d)=%v, %v", k, v, ok)
+		}
+	}
+
+	// every shard should get a fair share of the keys
+	for i := 0; i < shards; i++ {
+		if e := s.GetShardCounters(i).Elements; e < n/shards*9/10 || e > n/shards*11/10 {
+			t.Errorf("shard %d has %d elements", i, e)
+		}
+	}
+	cs := s.GetCounters()
+	if cs.Elements != n || cs.Inserts != n {
+		t.Fatalf("Elements=%d, Inserts=%d", cs.Elements, cs.Inserts)
+	}
+	cnt := 0
+	s.Map(func(c *Cuckoo, key Key, val Value) (stop bool) {
+		cnt++
+		return
+	})
+	if cnt != n {
+		t.Fatalf("Map=%d", cnt)
+	}
+	for _, k := range keys[:n/2] {
+		if _, ok := s.Delete(k); !ok {
+			t.Fatalf("Delete(%d) failed", k)
+		}
+	}
+	if e := s.GetCounter("elements"); e != n/2 {
+		t.Fatalf("elements=%d after delete", e)
+	}
 }
 
-/*
-func BenchmarkCuckoo4T4SInsert(b *testing.B) {
-	benchmarkCuckooInsert(1.0, 32.0, 0.99, 4, 4, "m332", b)
+// Only shard 0 gets keys, so it grows a table the other shards don't have.
+func TestShardedTableCounter(t *testing.T) {
+	const n = 2000
+
+	s := NewSharded(4, 2, -n/(2*8), 8, 0, 1.0, hashName)
+	s.SetNumericKeySize(8)
+	for i := 1; len(s.GetTableCounters()) < 3; i++ {
+		if i > 4*n {
+			t.Fatal("shard 0 didn't grow")
+		}
+		if sh, _ := s.Locate(Key(i)); sh == 0 {
+			s.Insert(Key(i), Value(i))
+		}
+	}
+	tcs := s.GetTableCounters()
+	for _, stat := range []string{"size", "elements"} {
+		if v := s.GetTableCounter(2, stat); v == 0 {
+			t.Fatalf("GetTableCounter(2, %q)=0", stat)
+		}
+	}
+	if v := s.GetTableCounter(2, "elements"); v != tcs[2].Elements {
+		t.Fatalf("GetTableCounter(2, elements)=%d, GetTableCounters=%d", v, tcs[2].Elements)
+	}
 }
 
-func BenchmarkCuckoo4T4SSearch(b *testing.B) {
-	benchmarkCuckooSearch(1.0, 32.0, 0.99, 4, 4, "m332", b)
+func TestInsertBatch(t *testing.T) {
+	const n = 60000
+
+	// keys n/4..n/2 are inserted first, the batch updates them and has duplicates of its own
+	keys := make([]Key, n)
+	vals := make([]Value, n)
+	for i := range keys {
+		keys[i], vals[i] = Key(i%(n*3/4)+1), Value(i+1)
+	}
+	m := make(map[Key]Value)
+	for i := range keys {
+		m[keys[i]] = vals[i]
+	}
+
+	type kv struct {
+		key Key
+		val Value
+	}
+	var kvs []kv
+	for _, p := range []int{1, 3, 8} {
+		c := New(2, -n*3/4/(2*8)*100/95, 8, 1, 1.0, hashName)
+		c.SetNumericKeySize(8)
+		for i := n / 4; i < n/2; i++ {
+			if !c.Insert(Key(i+1), Value(0)) {
+				t.Fatalf("Insert(%d) failed", i+1)
+			}
+		}
+		if fails := c.InsertBatch(keys, vals, p); len(fails) != 0 {
+			t.Fatalf("p=%d: %d fails", p, len(fails))
+		}
+		if c.Elements != len(m) || c.Inserts != n/4+n {
+			t.Fatalf("p=%d: Elements=%d, Inserts=%d", p, c.Elements, c.Inserts)
+		}
+		for k, v := range m {
+			if cv, ok := c.Lookup(k); !ok || cv != v {
+				t.Fatalf("p=%d: Lookup(%d)=%v, %v want %v", p, k, cv, ok, v)
+			}
+		}
+
+		// the parallelism shouldn't change where anything ends up
+		var got []kv
+		c.Map(func(c *Cuckoo, key Key, val Value) (stop bool) {
+			got = append(got, kv{key, val})
+			return
+		})
+		if kvs == nil {
+			kvs = got
+			continue
+		}
+		if len(got) != len(kvs) {
+			t.Fatalf("p=%d: Map=%d", p, len(got))
+		}
+		for i := range got {
+			if got[i] != kvs[i] {
+				t.Fatalf("p=%d: Map[%d]=%v, want %v", p, i, got[i], kvs[i])
+			}
+		}
+	}
+
+	// a full table fails the KV pairs it can't hold and keeps going
+	c := New(2, 64, 8, 1, 0.5, hashName)
+	fails := c.InsertBatch(keys[:1000], vals[:1000], 4)
+	if len(fails) != 1000-c.MaxElements || !c.Limited || c.GetCounter("limited") != 1 {
+		t.Fatalf("fails=%d, MaxElements=%d, Limited=%v", len(fails), c.MaxElements, c.Limited)
+	}
 }
 
-func BenchmarkCuckoo4T4SDelete(b *testing.B) {
-	benchmarkCuckooDelete(1.0, 32.0, 0.99, 4, 4, "m332", b)
+func TestFillParallel(t *testing.T) {
+	c := New(4, -100000/(4*8), 8, 0, 1.0, hashName)
+	c.SetNumericKeySize(8)
+	d := NewTester(c, c.LowestLevel, 0)
+	d.P = 4
+	fs := d.Fill(4, c.Nbuckets/4, 8, 1, 0.9, false, false, false, false)
+	if fs.Failed || fs.Limited || fs.Used != fs.Thresh {
+		t.Fatalf("Fill: %+v", fs)
+	}
+	if !d.Verify(1, fs.Used, false) {
+		t.Fatalf("Verify failed")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	const n = 20000
+
+	c := New(4, -n/(4*8)*10/9, 8, 3, 1.0, hashName)
+	c.SetNumericKeySize(8)
+	for i := 0; i < n; i++ {
+		if !c.Insert(Key(i), Value(i*3)) { // includes the empty key
+			t.Fatalf("Insert(%d) failed", i)
+		}
+	}
+	c.Lookup(Key(7))
+	type kv struct {
+		k Key
+		v Value
+	}
+	var kvs = func(c *Cuckoo) (r []kv) {
+		c.Map(func(c *Cuckoo, key Key, val Value) (stop bool) {
+			r = append(r, kv{key, val})
+			return
+		})
+		return
+	}
+
+	data, err := c.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	var c2 Cuckoo
+	if err := c2.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	if c2.Config != c.Config || c2.Counters != c.Counters {
+		t.Fatalf("Config or Counters differ: %#v, %#v", c2.Config, c2.Counters)
+	}
+	// exact slot positions, so Map returns the same sequence
+	a, b := kvs(c), kvs(&c2)
+	if len(a) != n || len(a) != len(b) {
+		t.Fatalf("Map=%d, %d", len(a), len(b))
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("Map[%d]=%v, want %v", i, b[i], a[i])
+		}
+	}
+	for i := 0; i < n; i++ {
+		if v, ok := c2.Lookup(Key(i)); !ok || v != Value(i*3) {
+			t.Fatalf("Lookup(%d)=%v, %v", i, v, ok)
+		}
+	}
+	if !c2.Insert(Key(n), Value(1)) {
+		t.Fatalf("Insert after load failed")
+	}
+
+	// streaming
+	var buf bytes.Buffer
+	wn, err := c.WriteTo(&buf)
+	if err != nil || wn != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("WriteTo=%d, %v want %d", wn, err, len(data))
+	}
+	c3 := New(2, 11, 8, 0, 1.0, hashName)
+	rn, err := c3.ReadFrom(&buf)
+	if err != nil || rn != wn || c3.Elements != c.Elements {
+		t.Fatalf("ReadFrom=%d, %v, Elements=%d", rn, err, c3.Elements)
+	}
+
+	// refuse what we can't load, and don't touch the table
+	for _, h := range []string{"aes", "j264"} {
+		if h == hashName {
+			continue
+		}
+		c4 := New(2, 11, 8, 0, 1.0, h)
+		if err := c4.UnmarshalBinary(data); !errors.Is(err, ErrSnapshotHash) || c4.Ntables != 2 {
+			t.Fatalf("different hash: %v", err)
+		}
+	}
+	bad := append([]byte(nil), data...)
+	bad[0] = 'X'
+	if err := c3.UnmarshalBinary(bad); err != ErrSnapshotMagic {
+		t.Fatalf("bad magic: %v", err)
+	}
+	copy(bad, data)
+	bad[13]++ // KeySize
+	if err := c3.UnmarshalBinary(bad); !errors.Is(err, ErrSnapshotCorrupt) {
+		t.Fatalf("bad header: %v", err)
+	}
+	var ce *CorruptError
+	if err := c3.UnmarshalBinary(data[:len(data)-1]); !errors.As(err, &ce) || !ce.Truncated || c3.Elements != c.Elements {
+		t.Fatalf("short: %v", err)
+	}
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	const n = 20000
+
+	c := New(4, -n/(4*8)*10/9, 8, 0, 1.0, hashName)
+	c.SetNumericKeySize(8)
+	for i := 1; i <= n; i++ {
+		c.Insert(Key(i), Value(i))
+	}
+	data, err := c.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "c.cht")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(path); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	// flip a bit in the last table, which is followed by its one checksum
+	bad := append([]byte(nil), data...)
+	bad[len(bad)-4-100] ^= 1
+	if err := ioutil.WriteFile(path, bad, 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := CorruptRange{Table: 3, First: 0, Last: c.Nbuckets}
+	var ce *CorruptError
+	if err := Verify(path); !errors.As(err, &ce) || len(ce.Ranges) != 1 || ce.Ranges[0] != want {
+		t.Fatalf("Verify: %v", err)
+	}
+	if _, err := OpenMapped(path); !errors.As(err, &ce) {
+		t.Fatalf("OpenMapped: %v", err)
+	}
+	c2 := New(2, 11, 8, 0, 1.0, hashName)
+	if err := c2.UnmarshalBinary(bad); !errors.As(err, &ce) || c2.Ntables != 2 {
+		t.Fatalf("fail fast: %v", err)
+	}
+
+	// salvage keeps tables 0-2
+	c2.SetSalvage(true)
+	if err := c2.UnmarshalBinary(bad); !errors.As(err, &ce) || !ce.Salvaged {
+		t.Fatalf("salvage: %v", err)
+	}
+	if c2.Elements != n-c.GetTableCounter(3, "elements") || c2.GetTableCounter(3, "elements") != 0 {
+		t.Fatalf("salvage: Elements=%d", c2.Elements)
+	}
+	cnt := 0
+	for i := 1; i <= n; i++ {
+		if v, ok := c2.Lookup(Key(i)); ok {
+			if v != Value(i) {
+				t.Fatalf("Lookup(%d)=%v", i, v)
+			}
+			cnt++
+		}
+	}
+	if cnt != c2.Elements {
+		t.Fatalf("found %d, Elements=%d", cnt, c2.Elements)
+	}
+
+	// silent truncation
+	if err := ioutil.WriteFile(path, data[:len(data)*3/4], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(path); !errors.As(err, &ce) || !ce.Truncated || ce.Ranges[0].Table != 2 {
+		t.Fatalf("Verify truncated: %v", err)
+	}
+
+	// a header that claims a huge table is refused before the table is allocated
+	huge := ResizeSnapshotTable(data, 1<<37, 1<<40)
+	if err := c2.UnmarshalBinary(ResizeSnapshotTable(data, 1<<37, 1<<37)); !errors.As(err, &ce) || !ce.Meta {
+		t.Fatalf("size isn't buckets*slots: %v", err)
+	}
+	c2.SetSalvage(false)
+	if err := c2.UnmarshalBinary(huge); !errors.As(err, &ce) || !ce.Truncated {
+		t.Fatalf("huge table: %v", err)
+	}
+	if err := ioutil.WriteFile(path, huge, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(path); !errors.As(err, &ce) || !ce.Truncated || ce.Ranges[0].Table != 0 {
+		t.Fatalf("Verify huge table: %v", err)
+	}
+	if _, err := OpenMapped(path); err != io.ErrUnexpectedEOF {
+		t.Fatalf("OpenMapped huge table: %v", err)
+	}
+}
+
+func TestSnapshotKeeps(t *testing.T) {
+	const n = 2000
+	mk := func() *Cuckoo {
+		c := New(2, -n/(2*8), 8, 0, 1.0, hashName)
+		c.SetLogger(nil)
+		return c
+	}
+	contents := func(c *Cuckoo) map[Key]Value {
+		m := make(map[Key]Value)
+		c.Map(func(c *Cuckoo, key Key, val Value) bool {
+			m[key] = val
+			return false
+		})
+		return m
+	}
+	src := mk()
+	for i := 1; i <= n/2; i++ {
+		src.Insert(Key(i), Value(i))
+	}
+	snap, err := src.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := mk()
+	tl := &testLogger{}
+	c.SetLogger(tl)
+	grows := 0
+	c.SetHooks(Hooks{OnGrow: func(e GrowEvent) { grows++ }})
+	var log bytes.Buffer
+	r, err := c.Record(&log)
+	if err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	for i := 2 * n; i < 2*n+100; i++ {
+		c.Insert(Key(i), Value(i))
+	}
+	h := c.GetHistograms()
+	if err := c.UnmarshalBinary(snap); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	if ha := c.GetHistograms(); ha.Probes.Total() != h.Probes.Total() {
+		t.Fatal("the histograms were dropped")
+	}
+	// enough to add a table, the Logger and Hooks are still there
+	for i := n/2 + 1; i <= 2*n; i++ {
+		c.Insert(Key(i), Value(i))
+	}
+	if grows == 0 || len(tl.msgs) == 0 {
+		t.Fatalf("grows=%d, %d messages", grows, len(tl.msgs))
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// the Recorder logged the load, a replay ends up the same
+	rc := &Cuckoo{}
+	if _, err := Replay(&log, rc); err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	m, rm := contents(c), contents(rc)
+	if len(m) != len(rm) || rc.Bumps != c.Bumps {
+		t.Fatalf("replay has %d KV pairs and %d bumps, want %d and %d", len(rm), rc.Bumps, len(m), c.Bumps)
+	}
+	for k, v := range m {
+		if rv, ok := rm[k]; !ok || rv != v {
+			t.Fatalf("replay: key %d is %v, %v want %v", k, rv, ok, v)
+		}
+	}
+}
+
+func TestOpenMapped(t *testing.T) {
+	const n = 20000
+
+	c := New(4, -n/(4*8)*10/9, 8, 0, 1.0, hashName)
+	c.SetNumericKeySize(8)
+	for i := 0; i < n; i++ {
+		c.Insert(Key(i), Value(i+1))
+	}
+	data, err := c.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "c.cht")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := OpenMapped(path)
+	if err != nil {
+		t.Fatalf("OpenMapped: %v", err)
+	}
+	if r.Len() != n || r.GetConfig() != c.Config {
+		t.Fatalf("Len=%d, Config=%#v", r.Len(), r.GetConfig())
+	}
+	for i := 0; i < n; i++ {
+		if v, ok := r.Lookup(Key(i)); !ok || v != Value(i+1) {
+			t.Fatalf("Lookup(%d)=%v, %v", i, v, ok)
+		}
+	}
+	if _, ok := r.Lookup(Key(n)); ok {
+		t.Fatalf("Lookup(%d) found", n)
+	}
+	var keys []Key
+	c.Map(func(c *Cuckoo, key Key, val Value) (stop bool) {
+		keys = append(keys, key)
+		return
+	})
+	i := 0
+	r.Map(func(key Key, val Value) (stop bool) {
+		if v, _ := c.Lookup(key); key != keys[i] || val != v {
+			t.Fatalf("Map[%d]=%v, %v", i, key, val)
+		}
+		i++
+		return
+	})
+	if i != n {
+		t.Fatalf("Map=%d", i)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, data[:len(data)-100], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenMapped(path); err != io.ErrUnexpectedEOF {
+		t.Fatalf("truncated: %v", err)
+	}
+}
+
+func TestDurable(t *testing.T) {
+	const n = 5000
+
+	dir := t.TempDir()
+	m := make(map[Key]Value)
+	mk := func() *Cuckoo {
+		c := New(4, -n/(4*8)*2, 8, 0, 1.0, hashName)
+		c.SetNumericKeySize(8)
+		return c
+	}
+	check := func(d *Durable) {
+		t.Helper()
+		cnt := 0
+		d.Map(func(c *Cuckoo, key Key, val Value) (stop bool) {
+			cnt++
+			return
+		})
+		if cnt != len(m) {
+			t.Fatalf("Map=%d, want %d", cnt, len(m))
+		}
+		for k, v := range m {
+			if dv, ok := d.Lookup(k); !ok || dv != v {
+				t.Fatalf("Lookup(%d)=%v, %v want %v", k, dv, ok, v)
+			}
+		}
+	}
+	ops := func(d *Durable, lo, hi int) {
+		t.Helper()
+		for i := lo; i < hi; i++ {
+			k := Key(i % (n / 2)) // updates too
+			if ok, err := d.Insert(k, Value(i)); !ok || err != nil {
+				t.Fatalf("Insert(%d)=%v, %v", k, ok, err)
+			}
+			m[k] = Value(i)
+			if i%7 == 0 {
+				if _, ok, err := d.Delete(k); !ok || err != nil {
+					t.Fatalf("Delete(%d)=%v, %v", k, ok, err)
+				}
+				delete(m, k)
+			}
+		}
+	}
+
+	// log only
+	d, err := Open(dir, &DurableOptions{New: mk, Sync: SyncNever})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	ops(d, 0, n)
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	d, err = Open(dir, &DurableOptions{Sync: SyncEvery, SyncInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	check(d)
+	seq := d.Seq()
+
+	// snapshot plus log
+	if err := d.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint: %v", err)
+	}
+	ops(d, n, 2*n)
+	time.Sleep(5 * time.Millisecond)
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// a record torn by a crash is dropped
+	f, err := os.OpenFile(filepath.Join(dir, "wal"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{1, 2, 3, 4, 5})
+	f.Close()
+	d, err = Open(dir, &DurableOptions{Sync: SyncAlways, CheckpointBytes: 64 << 10})
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	check(d)
+	if d.Seq() <= seq {
+		t.Fatalf("Seq=%d, was %d", d.Seq(), seq)
+	}
+
+	// automatic checkpoints keep the log small
+	ops(d, 2*n, 3*n)
+	if fi, err := os.Stat(filepath.Join(dir, "wal")); err != nil || fi.Size() >= 64<<10 {
+		t.Fatalf("wal: %v, %v", fi.Size(), err)
+	}
+	d.Close()
+	d, err = Open(dir, nil)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	check(d)
+	d.Close()
+	if names, _ := filepath.Glob(filepath.Join(dir, "snapshot-*")); len(names) != 1 {
+		t.Fatalf("snapshots: %v", names)
+	}
+}
+
+func TestDurableFailures(t *testing.T) {
+	dir := t.TempDir()
+	contents := func(d *Durable) map[Key]Value {
+		m := make(map[Key]Value)
+		d.Map(func(c *Cuckoo, key Key, val Value) bool {
+			m[key] = val
+			return false
+		})
+		return m
+	}
+	same := func(a, b map[Key]Value) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			if bv, ok := b[k]; !ok || bv != v {
+				return false
+			}
+		}
+		return true
+	}
+
+	// a failed insert with one table loses a KV pair already there, a restart loses it too
+	mk := func() *Cuckoo {
+		c := New(1, 16, 8, 0, 1.0, hashName)
+		c.SetGrow(false)
+		c.SetStartLevel(2)
+		c.SetLowestLevel(-1) // fail before getting the key back
+		c.SetLogger(nil)
+		return c
+	}
+	opts := &DurableOptions{New: mk, Sync: SyncNever}
+	d, err := Open(dir, opts)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	lost := 0
+	d.SetHooks(Hooks{OnFail: func(e FailEvent) {
+		if e.Lost {
+			lost++
+		}
+	}})
+	for i := 1; lost == 0 && i < 1000; i++ {
+		if _, err := d.Insert(Key(i), Value(i)); err != nil {
+			t.Fatalf("Insert(%d): %v", i, err)
+		}
+	}
+	if lost == 0 {
+		t.Fatal("no KV pair was lost")
+	}
+	m := contents(d)
+	d.Close()
+	if d, err = Open(dir, opts); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if !same(contents(d), m) {
+		t.Fatal("a restart doesn't have the same KV pairs")
+	}
+	if err := d.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a change that can't be logged is undone
+	var k Key
+	for k = range m {
+		break
+	}
+	d.CloseLog()
+	if ok, err := d.Insert(k, m[k]+Value(1)); ok || err == nil {
+		t.Fatalf("update with no log=%v, %v", ok, err)
+	}
+	if v, ok := d.Lookup(k); !ok || v != m[k] {
+		t.Fatalf("update wasn't undone, Lookup(%d)=%v, %v", k, v, ok)
+	}
+	if _, _, err := d.Delete(k); err == nil {
+		t.Fatal("Delete after the log failed")
+	}
+	d.Close()
+	if d, err = Open(dir, opts); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	d.CloseLog()
+	if ok, err := d.Insert(Key(5000), Value(1)); ok || err == nil {
+		t.Fatalf("insert with no log=%v, %v", ok, err)
+	}
+	if _, ok := d.Lookup(Key(5000)); ok || !same(contents(d), m) {
+		t.Fatal("insert wasn't undone")
+	}
+	d.Close()
+	if d, err = Open(dir, opts); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	d.CloseLog()
+	if _, ok, err := d.Delete(k); ok || err == nil {
+		t.Fatalf("Delete with no log=%v, %v", ok, err)
+	}
+	if !same(contents(d), m) {
+		t.Fatal("Delete wasn't undone")
+	}
+	d.Close()
+
+	// an op only a Recorder writes fails the check like a torn record
+	if d, err = Open(dir, opts); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	d.Insert(k, Value(100))
+	d.Insert(k, Value(101))
+	seq := d.Seq()
+	d.Close()
+	wal := filepath.Join(dir, "wal")
+	buf, err := ioutil.ReadFile(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := buf[len(buf)-(13+int(unsafe.Sizeof(k))+int(unsafe.Sizeof(Value(0)))):]
+	rec[12] = 0x83
+	binary.LittleEndian.PutUint32(rec, crc32.Checksum(rec[4:], crc32.MakeTable(crc32.Castagnoli)))
+	ioutil.WriteFile(wal, buf, 0644)
+	if d, err = Open(dir, opts); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if v, _ := d.Lookup(k); v != Value(100) || d.Seq() != seq-1 {
+		t.Fatalf("Seq=%d, was %d, the record with a Recorder op was applied", d.Seq(), seq)
+	}
+
+	// a bad record in the middle isn't torn, the records after it are kept and Open fails
+	d.Insert(k, Value(102))
+	d.Insert(k, Value(103))
+	d.Close()
+	if buf, err = ioutil.ReadFile(wal); err != nil {
+		t.Fatal(err)
+	}
+	buf[len(buf)-2*len(rec)+20] ^= 1
+	ioutil.WriteFile(wal, buf, 0644)
+	if _, err = Open(dir, opts); !errors.Is(err, ErrLogCorrupt) {
+		t.Fatalf("Open of a log with a bad record in the middle: %v", err)
+	}
+	if after, err := ioutil.ReadFile(wal); err != nil || !bytes.Equal(after, buf) {
+		t.Fatalf("the log was changed: %v", err)
+	}
+}
+
+// The Hooks of the table made by DurableOptions.New are kept, along with the one Durable adds.
+func TestDurableHooks(t *testing.T) {
+	grows := 0
+	opts := &DurableOptions{New: func() *Cuckoo {
+		c := New(1, 2, 8, 0, 1.0, hashName)
+		c.SetHooks(Hooks{OnGrow: func(e GrowEvent) { grows++ }})
+		return c
+	}}
+	d, err := Open(t.TempDir(), opts)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer d.Close()
+	for i := 1; i <= 200; i++ {
+		if _, err := d.Insert(Key(i), Value(i)); err != nil {
+			t.Fatalf("Insert %d: %v", i, err)
+		}
+	}
+	if grows == 0 {
+		t.Fatal("OnGrow set by New wasn't called")
+	}
+	limits := 0
+	d.SetHooks(Hooks{OnLimit: func(e LimitEvent) { limits++ }})
+	grows = 0
+	for i := 201; i <= 1000; i++ {
+		d.Insert(Key(i), Value(i))
+	}
+	if grows != 0 || limits == 0 {
+		t.Fatalf("SetHooks didn't replace the hooks, %d grows, %d limits", grows, limits)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	const n = 5000
+
+	mk := func() *Cuckoo {
+		c := New(4, -n/(4*8)*2, 8, 0, 1.0, hashName)
+		c.SetNumericKeySize(8)
+		return c
+	}
+
+	// ops and sequence numbers
+	c := mk()
+	ch := c.Subscribe()
+	c.Insert(Key(1), Value(10))
+	c.Insert(Key(1), Value(11))
+	c.Insert(Key(2), Value(20))
+	c.Delete(Key(1))
+	c.Delete(Key(3)) // not there, not sent
+	c.Unsubscribe(ch)
+	want := []Mutation{{1, MutationInsert, Key(1), Value(10), 0}, {2, MutationUpdate, Key(1), Value(11), 0}, {3, MutationInsert, Key(2), Value(20), 0}, {4, MutationDelete, Key(1), Value(11), 0}}
+	i := 0
+	for m := range ch {
+		if i >= len(want) || m != want[i] {
+			t.Fatalf("mutation %d=%+v, want %+v", i, m, want)
+		}
+		i++
+	}
+	if i != len(want) {
+		t.Fatalf("got %d mutations, want %d", i, len(want))
+	}
+	if v, ok := c.Lookup(Key(2)); c.Elements != 1 || !ok || v != Value(20) {
+		t.Fatalf("Len=%d Lookup(2)=%v, %v", c.Elements, v, ok)
+	}
+	r := NewReplica(mk())
+	if err := r.Apply(want[1]); !errors.Is(err, ErrMutationGap) {
+		t.Fatalf("Apply out of order=%v, want ErrMutationGap", err)
+	}
+
+	// the primary streams a snapshot and then its mutations through a pipe
+	c = mk()
+	for i := 1; i <= n/2; i++ {
+		c.Insert(Key(i), Value(i))
+	}
+	ch = c.Subscribe()
+	var buf bytes.Buffer
+	if _, err := c.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write(buf.Bytes())
+		_, err := WriteMutations(pw, ch)
+		pw.CloseWithError(err)
+	}()
+	rc := mk()
+	r = NewReplica(rc)
+	done := make(chan error)
+	go func() {
+		_, err := r.ReadFrom(pr)
+		done <- err
+	}()
+	for i := 1; i <= n; i++ {
+		k := Key(i%(n/2) + 1) // updates too
+		if ok, _ := c.InsertL(k, Value(i+n)); !ok {
+			t.Fatalf("InsertL(%d) failed", k)
+		}
+		if i%7 == 0 {
+			c.Delete(k)
+		}
+	}
+	c.Unsubscribe(ch)
+	if err := <-done; err != nil {
+		t.Fatalf("Replica.ReadFrom: %v", err)
+	}
+	if r.Seq() != uint64(c.Mutations) {
+		t.Fatalf("Seq=%d, want %d", r.Seq(), c.Mutations)
+	}
+	if rc.Elements != c.Elements {
+		t.Fatalf("replica Len=%d, want %d", rc.Elements, c.Elements)
+	}
+	c.Map(func(c *Cuckoo, key Key, val Value) (stop bool) {
+		if v, ok := rc.Lookup(key); !ok || v != val {
+			t.Fatalf("replica Lookup(%d)=%v, %v want %v", key, v, ok, val)
+		}
+		return
+	})
+
+	// a replica of a Multimap keeps every value of a key
+	m, rm := NewMultimap(2, 31, 8, 0, 1.0, hashName), NewMultimap(2, 31, 8, 0, 1.0, hashName)
+	ch = m.Cuckoo().Subscribe()
+	m.Add(Key(1), Value(10))
+	m.Add(Key(1), Value(11))
+	m.Cuckoo().Unsubscribe(ch)
+	r = NewReplica(rm.Cuckoo())
+	for mu := range ch {
+		if err := r.Apply(mu); err != nil {
+			t.Fatalf("Apply(%+v): %v", mu, err)
+		}
+	}
+	if rm.Count(Key(1)) != 2 {
+		t.Fatalf("replica Count(1)=%d, want 2", rm.Count(Key(1)))
+	}
+}
+
+func TestTracer(t *testing.T) {
+	const n = 500
+
+	c := New(4, -n/(4*8), 8, 0, 1.0, hashName)
+	c.SetNumericKeySize(8)
+	rt := NewRingTracer(1 << 20)
+	c.SetTracer(rt)
+	for i := 1; i <= n; i++ {
+		c.Insert(Key(i), Value(i))
+	}
+	c.SetTracer(nil)
+
+	// replaying the inserts gives the contents of the tables
+	events := rt.Events()
+	if len(events) == 0 || events[len(events)-1].Seq != c.TraceCnt {
+		t.Fatalf("got %d events, TraceCnt=%d", len(events), c.TraceCnt)
+	}
+	cells := make(map[[3]int]TraceEvent)
+	for i, e := range events {
+		if e.Table < 0 || e.Table >= c.Ntables || e.Bucket < 0 || e.Bucket >= c.Nbuckets || e.Slot < 0 || e.Slot >= c.Nslots {
+			t.Fatalf("event %d out of range: %+v", i, e)
+		}
+		if i > 0 && e.Seq != events[i-1].Seq+1 {
+			t.Fatalf("event %d Seq=%d after %d", i, e.Seq, events[i-1].Seq)
+		}
+		switch e.Op {
+		case TraceInsert:
+			cells[[3]int{e.Table, e.Bucket, e.Slot}] = e
+		case TraceEvict:
+			if cells[[3]int{e.Table, e.Bucket, e.Slot}].Key != e.Key {
+				t.Fatalf("event %d evicts a key that isn't there: %+v", i, e)
+			}
+		}
+	}
+	if len(cells) != c.Elements {
+		t.Fatalf("replay has %d KV pairs, want %d", len(cells), c.Elements)
+	}
+	for _, e := range cells {
+		if v, ok := c.Lookup(e.Key); !ok || v != e.Value {
+			t.Fatalf("Lookup(%d)=%v, %v want %v", e.Key, v, ok, e.Value)
+		}
+	}
+
+	// a small ring keeps the newest
+	small := NewRingTracer(10)
+	for _, e := range events {
+		small.Trace(e)
+	}
+	if got := small.Events(); len(got) != 10 || got[9] != events[len(events)-1] || got[0] != events[len(events)-10] {
+		t.Fatalf("ring kept %v", got)
+	}
+
+	// the sinks
+	var jb, sb bytes.Buffer
+	jt, st := NewJSONTracer(&jb), NewJSTracer(&sb)
+	e := TraceEvent{Seq: 3, Level: 2000, Op: TraceEvict, Table: 2, Bucket: 7, Slot: 1, Key: Key(42), Value: Value(4)}
+	jt.Trace(e)
+	st.Trace(e)
+	if s := jb.String(); s != `{"seq":3,"level":2000,"op":"E","table":2,"bucket":7,"slot":1,"key":42,"value":4}`+"\n" {
+		t.Fatalf("JSONTracer wrote %q", s)
+	}
+	if s := sb.String(); s != `{"i": 3, "l": 2000, "op": "E", "t": 2, "b": 7, "s": 1, "k": 42, "v": 4},`+"\n" {
+		t.Fatalf("JSTracer wrote %q", s)
+	}
+}
+
+func TestDemoPage(t *testing.T) {
+	c := New(2, 3, 8, 0, 1.0, hashName)
+	c.SetNumericKeySize(8)
+	c.SetGrow(false)
+	rt := NewRingTracer(1000)
+	c.SetTracer(rt)
+	for i := 1; i <= 40; i++ {
+		c.Insert(Key(i), Value(i))
+	}
+	var b bytes.Buffer
+	p := &demo.Page{Title: "test", Tables: 2, Buckets: c.Nbuckets, Slots: 8, Events: rt.Events()}
+	if err := p.Write(&b); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	s := b.String()
+	for _, want := range []string{"function driver(timer, trace)", "function probe(t, b, s)", ".tab.evict:empty", "<th>Table 1.7</th>", "var trace = ["} {
+		if !strings.Contains(s, want) {
+			t.Fatalf("page has no %q", want)
+		}
+	}
+	if got := strings.Count(s, `{"i": `); got != len(rt.Events()) {
+		t.Fatalf("page has %d steps, want %d", got, len(rt.Events()))
+	}
+	if got := strings.Count(s, `<td class="tab">`); got != 2*8*c.Nbuckets {
+		t.Fatalf("page has %d cells, want %d", got, 2*8*c.Nbuckets)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	const n = 4000
+
+	mk := func() *Cuckoo {
+		c := New(2, -n/(2*8), 8, 0, 1.0, hashName)
+		c.SetNumericKeySize(8)
+		c.SetGrow(false)
+		c.SetStartLevel(20)
+		c.SetLowestLevel(-20)
+		return c
+	}
+	contents := func(c *Cuckoo) map[Key]Value {
+		m := make(map[Key]Value)
+		c.Map(func(c *Cuckoo, key Key, val Value) (stop bool) {
+			m[key] = val
+			return
+		})
+		return m
+	}
+
+	// the same seed makes the same evictions
+	a, b := mk(), mk()
+	a.SetEvictionSeed(7)
+	b.SetEvictionSeed(7)
+	for i := 1; i <= n/2; i++ {
+		a.Insert(Key(i), Value(i))
+		b.Insert(Key(i), Value(i))
+	}
+	if a.Bumps == 0 || a.Bumps != b.Bumps || a.Probes != b.Probes {
+		t.Fatalf("Bumps=%d, %d Probes=%d, %d", a.Bumps, b.Bumps, a.Probes, b.Probes)
+	}
+
+	// record a run that fails and replay it
+	var log bytes.Buffer
+	r, err := a.Record(&log)
+	if err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	rt := NewRingTracer(1 << 20)
+	a.SetTracer(rt)
+	keys, vals := make([]Key, 0, n/4), make([]Value, 0, n/4)
+	for i := n/2 + 1; i <= 3*n/4; i++ {
+		keys, vals = append(keys, Key(i)), append(vals, Value(i))
+	}
+	a.InsertBatch(keys, vals, 4)
+	for i := 3*n/4 + 1; i <= n+n/4; i++ {
+		a.Insert(Key(i), Value(i))
+		if i%5 == 0 {
+			a.Delete(Key(i - 3))
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	a.SetTracer(nil)
+	if a.Aborts == 0 || a.Fails == 0 {
+		t.Fatalf("no failures to replay, Aborts=%d Fails=%d", a.Aborts, a.Fails)
+	}
+	events := rt.Events()
+
+	c := New(1, 1, 8, 0, 1.0, hashName)
+	rt2 := NewRingTracer(1 << 20)
+	c.SetTracer(rt2)
+	ops, err := Replay(bytes.NewReader(log.Bytes()), c)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if want := 1 + n/2 + n/10; ops != want {
+		t.Fatalf("Replay applied %d ops, want %d", ops, want)
+	}
+	if got := rt2.Events(); len(got) != len(events) {
+		t.Fatalf("replay has %d trace events, want %d", len(got), len(events))
+	} else {
+		for i := range got {
+			if got[i] != events[i] {
+				t.Fatalf("trace event %d=%+v, want %+v", i, got[i], events[i])
+			}
+		}
+	}
+	if c.Aborts != a.Aborts || c.Fails != a.Fails || c.Bumps != a.Bumps {
+		t.Fatalf("replay Aborts=%d Fails=%d Bumps=%d, want %d %d %d", c.Aborts, c.Fails, c.Bumps, a.Aborts, a.Fails, a.Bumps)
+	}
+	am, cm := contents(a), contents(c)
+	if len(am) != len(cm) {
+		t.Fatalf("replay has %d KV pairs, want %d", len(cm), len(am))
+	}
+	for k, v := range am {
+		if cm[k] != v {
+			t.Fatalf("replay %d=%d, want %d", k, cm[k], v)
+		}
+	}
+
+	// a log cut off by a crash replays up to the last whole record
+	if ops, err := Replay(bytes.NewReader(log.Bytes()[:log.Len()-10]), mk()); err != nil || ops != 1+n/2+n/10-1 {
+		t.Fatalf("Replay of a torn log=%d, %v", ops, err)
+	}
+}
+
+func TestGrow(t *testing.T) {
+	const n = 1000
+	c := New(2, -n/(2*8), 8, 0, 1.0, hashName)
+	c.SetStartLevel(20)
+	c.SetLowestLevel(-20)
+	i := 1
+	for ; c.TableGrows == 0; i++ {
+		if !c.Insert(Key(i), Value(i)) {
+			t.Fatalf("insert %d failed with no table added", i)
+		}
+	}
+	// the new table is as big as the others
+	if c.Ntables != 3 || c.Size != 3*c.Nbuckets*c.Nslots {
+		t.Fatalf("Ntables=%d, Size=%d", c.Ntables, c.Size)
+	}
+	for j := i + n/2; i < j; i++ {
+		if !c.Insert(Key(i), Value(i)) {
+			t.Fatalf("insert %d", i)
+		}
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for j := 1; j < i; j++ {
+		if v, ok := c.Lookup(Key(j)); !ok || v != Value(j) {
+			t.Fatalf("Lookup(%d)=%v, %v", j, v, ok)
+		}
+	}
+}
+
+func TestMinimize(t *testing.T) {
+	s := Shape{Tables: 2, Buckets: 5, Slots: 8, LoadFactor: 1.0, HashName: hashName, KeySize: 8}
+	var keys []Key
+	for trial := 0; keys == nil; trial++ {
+		if trial == 1000 {
+			t.Fatalf("no failures")
+		}
+		r := rand.New(rand.NewSource(int64(trial)))
+		try := make([]Key, 80)
+		for i := range try {
+			try[i] = Key(r.Int63())
+		}
+		if s.Fails(try) {
+			keys = try
+		}
+	}
+	ms, mkeys := Minimize(s, keys)
+	if !ms.Fails(mkeys) || len(mkeys) >= len(keys) || ms.Tables > s.Tables || ms.Buckets > s.Buckets {
+		t.Fatalf("Minimize=%+v, %d keys", ms, len(mkeys))
+	}
+	for i := range mkeys {
+		less := append(append([]Key(nil), mkeys[:i]...), mkeys[i+1:]...)
+		if ms.Fails(less) {
+			t.Fatalf("still fails without key %d", i)
+		}
+	}
+	cf := FindConflicts(ms, mkeys)
+	if cf.Placeable || len(cf.Cycle) <= len(cf.Crowded)*ms.Slots {
+		t.Fatalf("want a true cycle: %v", cf)
+	}
+	if cf := FindConflicts(s, keys[:8]); !cf.Placeable || len(cf.Candidate) != 8 || len(cf.Candidate[0]) != 2 {
+		t.Fatalf("want placeable: %v", cf)
+	}
+}
+
+func TestExporter(t *testing.T) {
+	a := New(2, 11, 8, 0, 1.0, hashName)
+	a.SetNumericKeySize(8)
+	for i := 1; i <= 100; i++ {
+		a.Insert(Key(i), Value(i))
+	}
+	b := NewSharded(2, 2, 11, 8, 0, 1.0, hashName)
+	b.Insert(Key(1), Value(1))
+	e := exporter.New()
+	e.Add("a", a)
+	e.Add(`b"2`, b)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	s := string(body)
+	for _, want := range []string{
+		"# TYPE cuckoo_elements gauge\ncuckoo_elements{name=\"a\"} 100\ncuckoo_elements{name=\"b\\\"2\"} 1\n",
+		"# TYPE cuckoo_inserts_total counter\n",
+		fmt.Sprintf("cuckoo_max_path_len{name=\"a\"} %d\n", a.MaxPathLen),
+		"cuckoo_limited{name=\"a\"} 0\n",
+		fmt.Sprintf("cuckoo_table_elements{name=\"a\",table=\"1\"} %d\n", a.GetTableCounter(1, "elements")),
+		"cuckoo_table_bumps_total{name=\"b\\\"2\",table=\"0\"}",
+	} {
+		if !strings.Contains(s, want) {
+			t.Fatalf("no %q in\n%s", want, s)
+		}
+	}
+
+	e.Label = "cuckoo"
+	e.Remove(`b"2`)
+	var buf bytes.Buffer
+	e.WriteTo(&buf)
+	if s := buf.String(); strings.Contains(s, "b\\\"2") || !strings.Contains(s, "cuckoo_elements{cuckoo=\"a\"} 100\n") {
+		t.Fatalf("after Remove\n%s", s)
+	}
+
+	e.Publish("cuckoo_test")
+	var m map[string]struct {
+		Counters Counters
+		Tables   []TableCounters
+	}
+	if err := json.Unmarshal([]byte(expvar.Get("cuckoo_test").String()), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["a"].Counters.Elements != 100 || len(m["a"].Tables) != 2 {
+		t.Fatalf("expvar=%+v", m)
+	}
+}
+
+func TestHistograms(t *testing.T) {
+	c := New(4, 101, 8, 0, 1.0, hashName)
+	c.SetGrow(false)
+	c.SetNumericKeySize(8)
+	n := 0
+	for i := 1; i <= 3000; i++ {
+		if ok, _ := c.InsertL(Key(i), Value(i)); ok {
+			n++
+		}
+	}
+	h := c.GetHistograms()
+	if h.Probes.Total() != n || h.Bumps.Total() != n || h.Iterations.Total() != n {
+		t.Fatalf("totals=%d,%d,%d, inserts=%d", h.Probes.Total(), h.Bumps.Total(), h.Iterations.Total(), n)
+	}
+	buckets, elements := 0, 0
+	for i, b := range h.Occupancy {
+		buckets += b
+		elements += i * b
+	}
+	if buckets != c.Ntables*c.Nbuckets || elements != c.Elements {
+		t.Fatalf("occupancy: buckets=%d, elements=%d vs %d", buckets, elements, c.Elements)
+	}
+	last := 0
+	for _, q := range []float64{0, .5, .9, .99, .999, 1} {
+		v := h.Probes.Quantile(q)
+		if v < last || v < 1 {
+			t.Fatalf("Quantile(%v)=%d, previous %d", q, v, last)
+		}
+		last = v
+	}
+	if lo, hi := HistogramRange(0); lo != 0 || hi != 1 {
+		t.Fatalf("HistogramRange(0)=%d, %d", lo, hi)
+	}
+	if lo, hi := HistogramRange(3); lo != 4 || hi != 8 {
+		t.Fatalf("HistogramRange(3)=%d, %d", lo, hi)
+	}
+	var e Histogram
+	if e.Quantile(.5) != 0 {
+		t.Fatalf("empty Quantile")
+	}
+	var buf bytes.Buffer
+	h.Print(&buf)
+	if s := buf.String(); !strings.Contains(s, "p99") || !strings.Contains(s, "slots used") {
+		t.Fatalf("Print\n%s", s)
+	}
+
+	s := NewSharded(2, 2, 11, 8, 0, 1.0, hashName)
+	for i := 1; i <= 50; i++ {
+		s.Insert(Key(i), Value(i))
+	}
+	if sh := s.GetHistograms(); sh.Probes.Total() != 50 || len(sh.Occupancy) == 0 {
+		t.Fatalf("sharded total=%d", sh.Probes.Total())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	var zero Key
+	c := New(4, 101, 8, 0, 1.0, hashName)
+	c.SetNumericKeySize(8)
+	for i := 0; i < 2000; i++ {
+		c.Insert(Key(i), Value(i))
+	}
+	for i := 0; i < 2000; i += 3 {
+		c.Delete(Key(i))
+	}
+	c.Insert(zero, Value(1))
+	c.InsertBatch([]Key{Key(5000), Key(5001), Key(1)}, []Value{Value(1), Value(2), Value(3)}, 2)
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []DSTester{
+		NewSync(4, 101, 8, 0, 1.0, hashName),
+		NewOptimistic(4, 101, 8, 0, 1.0, hashName),
+		NewConcurrent(4, 101, 8, 0, 1.0, hashName),
+		NewSharded(4, 4, 101, 8, 0, 1.0, hashName),
+	} {
+		for i := 1; i <= 1000; i++ {
+			v.Insert(Key(i), Value(i))
+		}
+		v.Delete(Key(10))
+		if err := v.(Validator).Validate(); err != nil {
+			t.Fatalf("%T: %v", v, err)
+		}
+	}
+
+	d := NewTester(c, 2000, 0)
+	if !d.Verify(5000, 1, false) {
+		t.Fatal("Verify")
+	}
+}
+
+func TestInsertReplaces(t *testing.T) {
+	const n = 2000
+	c := New(4, 101, 8, 0, 1.0, hashName)
+	for i := 0; i < n; i++ {
+		c.Insert(Key(i), Value(i))
+	}
+	for i := 0; i < n; i++ {
+		if !c.Insert(Key(i), Value(i+1)) {
+			t.Fatalf("insert %d again", i)
+		}
+	}
+	if err := c.Validate(); err != nil || c.Elements != n {
+		t.Fatalf("Elements=%d, %v", c.Elements, err)
+	}
+	for i := 0; i < n; i++ {
+		if v, ok := c.Lookup(Key(i)); !ok || v != Value(i+1) {
+			t.Fatalf("Lookup(%d)=%v, %v", i, v, ok)
+		}
+	}
+
+	// insert itself starts at a different table each time, Validate catches the second copy it can make
+	for i := 1; i < n; i++ {
+		c.InsertNoLookup(Key(i), Value(i))
+		if err := c.Validate(); err != nil {
+			if !errors.Is(err, ErrInvalid) || !strings.Contains(err.Error(), fmt.Sprintf("key %v in table", Key(i))) {
+				t.Fatalf("Validate: %v", err)
+			}
+			return
+		}
+	}
+	t.Fatal("no second copy")
+}
+
+func TestExplain(t *testing.T) {
+	var zv Value // ExplainInsert inserts the zero value
+	c := New(4, 11, 8, 0, 1.0, hashName)
+	c.SetGrow(false)
+	c.SetNumericKeySize(8)
+	bumped := 0
+	for i := 1; i <= 340; i++ {
+		k := Key(i)
+		probes := c.Probes
+		x := c.ExplainInsert(k)
+		if c.Probes != probes || x.Found {
+			t.Fatalf("ExplainInsert(%d) changed c or found %v", i, x.Location)
+		}
+		rt := NewRingTracer(1 << 16)
+		c.SetTracer(rt)
+		ok, level := c.InsertL(k, zv)
+		c.SetTracer(nil)
+		if ok != x.OK || level != x.Level || c.Probes-probes != x.Probes {
+			t.Fatalf("key %d: insert ok=%v level=%d, explained\n%v", i, ok, level, x)
+		}
+		evs := rt.Events()
+		if len(evs) != len(x.Events) {
+			t.Fatalf("key %d: %d events, explained %d", i, len(evs), len(x.Events))
+		}
+		for j := range evs {
+			if evs[j] != x.Events[j] {
+				t.Fatalf("key %d: event %d is %+v, explained %+v", i, j, evs[j], x.Events[j])
+			}
+		}
+		if !ok {
+			continue
+		}
+		if x.Bumps > 0 {
+			bumped++
+		}
+		l := c.Locate(k)
+		last := x.Path[len(x.Path)-1]
+		for _, e := range x.Path {
+			if e.Key == k {
+				last = e
+			}
+		}
+		if !l.Found || l.Table != last.Table || l.Bucket != last.Bucket || l.Slot != last.Slot || l.Candidates[l.Table] != l.Bucket {
+			t.Fatalf("key %d: Locate=%v, path ends at %+v", i, l, last)
+		}
+	}
+	if bumped == 0 {
+		t.Fatalf("no evictions explained")
+	}
+	if l := c.Locate(Key(1 << 40)); l.Found || len(l.Candidates) != 4 || !strings.Contains(l.String(), "not found") {
+		t.Fatalf("Locate=%v", l)
+	}
+	if x := c.ExplainInsert(Key(1 << 40)); !strings.Contains(x.String(), "level=") {
+		t.Fatalf("String\n%v", x)
+	}
+
+	s := NewSharded(2, 2, 11, 8, 0, 1.0, hashName)
+	s.Insert(Key(7), Value(7))
+	if shard, l := s.Locate(Key(7)); !l.Found {
+		t.Fatalf("Sharded.Locate=%d %v", shard, l)
+	}
+}
+
+// Locate, ExplainInsert, and Validate only read, run them from several goroutines, go test -race to check.
+// "j364" serializes the key into scratch space to hash it, which the readers must not share.
+func TestReadersConcurrent(t *testing.T) {
+	const n, readers = 1000, 4
+	sc := NewSync(4, -n/(4*8)*2, 8, 0, 1.0, "j364")
+	d, err := Open(t.TempDir(), &DurableOptions{New: func() *Cuckoo { return New(4, -n/(4*8)*2, 8, 0, 1.0, "j364") }})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer d.Close()
+	for i := 1; i <= n; i++ {
+		sc.Insert(Key(i), Value(i))
+		d.Insert(Key(i), Value(i))
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*readers)
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := 1 + r; i <= n; i += readers {
+				if l := sc.Locate(Key(i)); !l.Found {
+					errs <- fmt.Errorf("SyncCuckoo.Locate=%v", l)
+					return
+				}
+				if l := d.Locate(Key(i)); !l.Found {
+					errs <- fmt.Errorf("Durable.Locate=%v", l)
+					return
+				}
+				if i%100 < readers {
+					if err := sc.Validate(); err != nil {
+						errs <- err
+						return
+					}
+					if err := d.Validate(); err != nil {
+						errs <- err
+						return
+					}
+				}
+				if i%50 == 0 {
+					if x := sc.ExplainInsert(Key(i)); !x.Found || !x.OK {
+						errs <- fmt.Errorf("SyncCuckoo.ExplainInsert=%v", x)
+						return
+					}
+					if x := d.ExplainInsert(Key(i)); !x.Found || !x.OK {
+						errs <- fmt.Errorf("Durable.ExplainInsert=%v", x)
+						return
+					}
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+type testLogger struct {
+	msgs []string
+}
+
+func (l *testLogger) Info(msg string, args ...interface{})  { l.msgs = append(l.msgs, "INFO "+msg) }
+func (l *testLogger) Warn(msg string, args ...interface{})  { l.msgs = append(l.msgs, "WARN "+msg) }
+func (l *testLogger) Error(msg string, args ...interface{}) { l.msgs = append(l.msgs, "ERROR "+msg) }
+
+func TestHooks(t *testing.T) {
+	var grows, aborts, fails, limits []int
+	hooks := Hooks{
+		OnGrow:  func(e GrowEvent) { grows = append(grows, e.Tables) },
+		OnAbort: func(e AbortEvent) { aborts = append(aborts, e.Level) },
+		OnFail:  func(e FailEvent) { fails = append(fails, e.Level) },
+		OnLimit: func(e LimitEvent) { limits = append(limits, e.Elements) },
+	}
+
+	// a table is added instead of failing, and nothing is lost
+	c := New(2, 11, 8, 0, 1.0, hashName)
+	c.SetNumericKeySize(8)
+	c.SetStartLevel(2)
+	c.SetLowestLevel(-2)
+	l := &testLogger{}
+	c.SetLogger(l)
+	c.SetHooks(hooks)
+	for i := 1; i <= 300; i++ {
+		if !c.Insert(Key(i), Value(i)) {
+			t.Fatalf("insert %d failed with grow", i)
+		}
+	}
+	if len(grows) == 0 || len(grows) != c.TableGrows || grows[len(grows)-1] != c.Ntables || len(fails) != 0 {
+		t.Fatalf("grows=%v, TableGrows=%d, Ntables=%d, fails=%v", grows, c.TableGrows, c.Ntables, fails)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 300; i++ {
+		if v, ok := c.Lookup(Key(i)); !ok || v != Value(i) {
+			t.Fatalf("lookup %d after grow", i)
+		}
+	}
+	if len(l.msgs) != len(grows) || l.msgs[0] != "INFO cuckoo: added a table" {
+		t.Fatalf("log=%q", l.msgs)
+	}
+	if len(aborts) > c.Aborts {
+		t.Fatalf("aborts=%d, Aborts=%d", len(aborts), c.Aborts)
+	}
+	for _, level := range aborts {
+		if level >= 0 {
+			t.Fatalf("abort level %d", level)
+		}
+	}
+
+	// without grow the inserts fail
+	grows, fails = nil, nil
+	c = New(2, 11, 8, 0, 1.0, hashName)
+	c.SetNumericKeySize(8)
+	c.SetGrow(false)
+	c.SetStartLevel(2)
+	c.SetLowestLevel(-2)
+	c.SetLogger(nil)
+	var lost []Key
+	c.SetHooks(Hooks{OnFail: func(e FailEvent) {
+		fails = append(fails, e.Level)
+		if e.Lost {
+			lost = append(lost, e.LostKey)
+		}
+	}})
+	n := 0
+	for i := 1; i <= 170; i++ {
+		if ok, _ := c.InsertL(Key(i), Value(i)); !ok {
+			n++
+		}
+	}
+	if n == 0 || len(fails) != n {
+		t.Fatalf("failed=%d, fails=%v", n, fails)
+	}
+	for _, k := range lost {
+		if _, ok := c.Lookup(k); ok {
+			t.Fatalf("lost key %v is still there", k)
+		}
+	}
+
+	// the load factor limit
+	c = New(2, 11, 8, 0, 0.5, hashName)
+	c.SetNumericKeySize(8)
+	l = &testLogger{}
+	c.SetLogger(l)
+	c.SetHooks(hooks)
+	for i := 1; i <= 100; i++ {
+		c.Insert(Key(i), Value(i))
+	}
+	if len(limits) != 100-c.MaxElements || limits[0] != c.MaxElements || len(l.msgs) != 1 || l.msgs[0] != "WARN cuckoo: load factor limit reached" {
+		t.Fatalf("limits=%v, MaxElements=%d, log=%q", limits, c.MaxElements, l.msgs)
+	}
+
+	// a ConcurrentCuckoo adds tables too
+	grows = nil
+	cc := NewConcurrent(2, 11, 8, 0, 1.0, hashName)
+	cc.SetLogger(nil)
+	cc.SetHooks(hooks)
+	for i := 1; i <= 300; i++ {
+		cc.Insert(Key(i), Value(i))
+	}
+	if len(grows) == 0 || cc.GetCounters().TableGrows != len(grows) {
+		t.Fatalf("concurrent grows=%v", grows)
+	}
+	if err := cc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyHashing(t *testing.T) {
+	for _, hn := range []string{"aes", "j264", "j364"} {
+		c := New(4, 101, 8, 0, 0.9, hn)
+		if c.NumericKeySize != 8 {
+			t.Fatalf("%s: New picked NumericKeySize=%d", hn, c.NumericKeySize)
+		}
+		// 0 serializes the key, the others hash the low bytes straight from memory
+		for _, size := range []int{8, 4, 2, 1, 0} {
+			c := New(4, 101, 8, 0, 0.9, hn)
+			c.SetNumericKeySize(size)
+			n := 2000
+			if size == 1 {
+				n = 255
+			}
+			for i := 1; i <= n; i++ {
+				if !c.Insert(Key(i), Value(i)) {
+					t.Fatalf("%s/%d: insert %d", hn, size, i)
+				}
+			}
+			if err := c.Validate(); err != nil {
+				t.Fatalf("%s/%d: %v", hn, size, err)
+			}
+			for i := 1; i <= n; i++ {
+				if v, ok := c.Lookup(Key(i)); !ok || v != Value(i) {
+					t.Fatalf("%s/%d: lookup %d=%v, %v", hn, size, i, v, ok)
+				}
+			}
+			if size == 0 {
+				continue
+			}
+			k := Key(n / 2)
+			if a := testing.AllocsPerRun(100, func() { c.Lookup(k) }); a != 0 && !raceEnabled {
+				t.Fatalf("%s/%d: Lookup allocates %v", hn, size, a)
+			}
+		}
+	}
+
+	// no more bytes than the Key has
+	for _, size := range []int{-1, 16} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("SetNumericKeySize(%d) didn't panic", size)
+				}
+			}()
+			New(4, 101, 8, 0, 0.9, hashName).SetNumericKeySize(size)
+		}()
+	}
+}
+
+func TestSplit(t *testing.T) {
+	const n = 20000
+	ci := New(4, -n/(4*8)*100/90, 8, 1, 1.0, hashName)
+	cs := NewSplit(4, -n/(4*8)*100/90, 8, 1, 1.0, hashName)
+	if ci.Split || !cs.Split {
+		t.Fatalf("Split=%v, %v", ci.Split, cs.Split)
+	}
+	var keys []Key
+	var vals []Value
+	for i := n + 1; i <= n+1000; i++ {
+		keys, vals = append(keys, Key(i)), append(vals, Value(i*3))
+	}
+	for _, c := range []*Cuckoo{ci, cs} {
+		for i := 1; i <= n; i++ {
+			if !c.Insert(Key(i), Value(i*3)) {
+				t.Fatalf("Split=%v: insert %d", c.Split, i)
+			}
+		}
+		for i := 1; i <= n; i += 3 {
+			c.Delete(Key(i))
+		}
+		if fails := c.InsertBatch(keys, vals, 1); len(fails) != 0 {
+			t.Fatalf("Split=%v: InsertBatch fails=%v", c.Split, fails)
+		}
+		if err := c.Validate(); err != nil {
+			t.Fatalf("Split=%v: %v", c.Split, err)
+		}
+	}
+
+	// the layout doesn't change the random walks, every key ends up in the same slot
+	for i := 1; i <= n+1000; i++ {
+		if li, ls := ci.Locate(Key(i)), cs.Locate(Key(i)); li.String() != ls.String() {
+			t.Fatalf("interleaved %v, split %v", li, ls)
+		}
+		for _, c := range []*Cuckoo{ci, cs} {
+			v, ok := c.Lookup(Key(i))
+			if want := i > n || i%3 != 1; ok != want || ok && v != Value(i*3) {
+				t.Fatalf("Split=%v: lookup %d=%v, %v", c.Split, i, v, ok)
+			}
+		}
+	}
+	if hi, hs := ci.GetHistograms(), cs.GetHistograms(); fmt.Sprint(hi.Occupancy) != fmt.Sprint(hs.Occupancy) {
+		t.Fatalf("occupancy interleaved %v, split %v", hi.Occupancy, hs.Occupancy)
+	}
+
+	// snapshots are the same, a split Cuckoo reads one back split
+	var bi, bs bytes.Buffer
+	if _, err := ci.WriteTo(&bi); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.WriteTo(&bs); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bi.Bytes(), bs.Bytes()) {
+		t.Fatal("snapshots differ")
+	}
+	c := NewSplit(1, 1, 8, 0, 1.0, hashName)
+	if _, err := c.ReadFrom(&bi); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Validate(); err != nil || !c.Split || c.Elements != cs.Elements {
+		t.Fatalf("ReadFrom: %v, Split=%v, Elements=%d want %d", err, c.Split, c.Elements, cs.Elements)
+	}
+	for i := n + 1; i <= n+1000; i++ {
+		if v, ok := c.Lookup(Key(i)); !ok || v != Value(i*3) {
+			t.Fatalf("ReadFrom: lookup %d=%v, %v", i, v, ok)
+		}
+	}
+}
+
+func TestSet(t *testing.T) {
+	const n = 20000
+	a := NewSet(4, -n/(4*8)*100/90, 8, 0, 1.0, hashName)
+	b := NewSet(4, -n/(4*8)*100/90, 8, 0, 1.0, hashName)
+	if bs := a.GetCounters().BucketSize; bs != int(unsafe.Sizeof(Key(0))) {
+		t.Fatalf("BucketSize=%d", bs)
+	}
+	// a has 0..n-1, the empty key too, b has the multiples of 3 from 0 to 2n
+	for i := 0; i < n; i++ {
+		if !a.Add(Key(i)) {
+			t.Fatalf("add %d", i)
+		}
+	}
+	for i := 0; i < 2*n; i += 3 {
+		b.Add(Key(i))
+	}
+	if !a.Add(Key(7)) || a.Len() != n {
+		t.Fatalf("adding a key twice, Len=%d", a.Len())
+	}
+	check := func(s *Set, name string, in func(i int) bool) {
+		t.Helper()
+		if err := s.Validate(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		cnt := 0
+		for i := 0; i < 2*n; i++ {
+			if s.Contains(Key(i)) != in(i) {
+				t.Fatalf("%s: Contains(%d)=%v", name, i, !in(i))
+			}
+			if in(i) {
+				cnt++
+			}
+		}
+		if s.Len() != cnt {
+			t.Fatalf("%s: Len=%d want %d", name, s.Len(), cnt)
+		}
+		m := 0
+		s.Map(func(key Key) bool {
+			m++
+			return false
+		})
+		if m != cnt {
+			t.Fatalf("%s: Map saw %d keys want %d", name, m, cnt)
+		}
+	}
+	check(a, "a", func(i int) bool { return i < n })
+
+	u := NewSet(4, -2*n/(4*8), 8, 0, 1.0, hashName)
+	u.Union(a)
+	if !u.Union(b) {
+		t.Fatal("Union failed")
+	}
+	check(u, "union", func(i int) bool { return i < n || i%3 == 0 })
+	u.Intersect(b)
+	check(u, "intersect", func(i int) bool { return i%3 == 0 })
+	a.Difference(b)
+	check(a, "difference", func(i int) bool { return i < n && i%3 != 0 })
+	if !a.Remove(Key(1)) || a.Remove(Key(1)) || a.Contains(Key(1)) {
+		t.Fatal("Remove")
+	}
+	a.Difference(a)
+	check(a, "empty", func(i int) bool { return false })
+}
+
+func TestMultimap(t *testing.T) {
+	m := NewMultimap(4, 131, 8, 0, 0.9, hashName)
+	vals := func(key Key) (vs []Value) {
+		m.LookupAll(key, func(v Value) bool {
+			vs = append(vs, v)
+			return false
+		})
+		sort.Slice(vs, func(i, j int) bool { return vs[i] < vs[j] })
+		return
+	}
+	// key i has i%5+1 values, the empty key 3, and the heavy key 50, most of them in overflow
+	const heavy = 7777
+	add := func(i int, n int) {
+		for j := 0; j < n; j++ {
+			if !m.Add(Key(i), Value(i*100+j)) {
+				t.Fatalf("add %d/%d", i, j)
+			}
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		add(i, i%5+1)
+	}
+	add(0, 2)
+	add(heavy, 50)
+	check := func(i int, want ...int) {
+		t.Helper()
+		key := Key(i)
+		vs := vals(key)
+		if m.Count(key) != len(want) || len(vs) != len(want) {
+			t.Fatalf("key %d has %v, Count=%d, want %v", i, vs, m.Count(key), want)
+		}
+		for j := range want {
+			if vs[j] != Value(i*100+want[j]) {
+				t.Fatalf("key %d has %v, want %v", i, vs, want)
+			}
+		}
+	}
+	check(0, 0, 0, 1)
+	check(8, 0, 1, 2, 3)
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if c := m.GetCounters(); c.MaxMultiplicity != 50 || m.Overflows != 3+50-8 || m.Len() != 3002+50 {
+		t.Fatalf("MaxMultiplicity=%d, Overflows=%d, Len=%d", c.MaxMultiplicity, m.Overflows, m.Len())
+	}
+	if m.GetCounter("MaxMultiplicity") != 50 {
+		t.Fatal("GetCounter")
+	}
+
+	// delete the first value of every key, then all of the heavy key
+	for i := 1; i < 1000; i++ {
+		if !m.DeleteOne(Key(i), Value(i*100)) || m.DeleteOne(Key(i), Value(i*100+9)) {
+			t.Fatalf("DeleteOne %d", i)
+		}
+	}
+	if !m.DeleteOne(Key(0), Value(0)) || !m.DeleteOne(Key(heavy), Value(heavy*100+49)) {
+		t.Fatal("DeleteOne from overflow")
+	}
+	check(0, 0, 1)
+	check(8, 1, 2, 3)
+	check(10)
+	if n := m.DeleteAll(Key(heavy)); n != 49 || m.Count(Key(heavy)) != 0 {
+		t.Fatalf("DeleteAll=%d, Count=%d", n, m.Count(Key(heavy)))
+	}
+	n := 0
+	m.Map(func(key Key, val Value) bool {
+		n++
+		return false
+	})
+	if err := m.Validate(); err != nil || n != m.Len() || n != 3002-1000 {
+		t.Fatalf("%v, Map saw %d, Len=%d", err, n, m.Len())
+	}
+
+	// with no room to grow the KV pair left by a failed insert goes to overflow, nothing is lost
+	m = NewMultimap(1, 11, 8, 0, 1.0, hashName)
+	m.SetGrow(false)
+	for i := 1; i <= 11*8; i++ {
+		add(i, 1)
+	}
+	if m.Overflows == 0 || m.Len() != 11*8 {
+		t.Fatalf("Overflows=%d, Len=%d", m.Overflows, m.Len())
+	}
+	for i := 1; i <= 11*8; i++ {
+		check(i, 0)
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A Clock for tests, the time only moves when it's told to.
+type fakeClock struct {
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	return f.now
+}
+
+func TestExpiry(t *testing.T) {
+	const n = 20000
+	clk := &fakeClock{now: time.Unix(1e9, 0)}
+	c := New(4, -n/(4*8)*100/90, 8, 0, 1.0, hashName)
+	c.SetExpiry(clk)
+	// the even keys, the empty key too, expire after a minute, the odd keys never do
+	for i := 0; i < n; i++ {
+		ok := false
+		if i%2 == 0 {
+			ok = c.InsertTTL(Key(i), Value(i), time.Minute)
+		} else {
+			ok = c.Insert(Key(i), Value(i))
+		}
+		if !ok {
+			t.Fatalf("insert %d", i)
+		}
+	}
+	if _, ok := c.Lookup(Key(2)); !ok || c.GetCounters().Bumps == 0 {
+		t.Fatalf("Lookup before the TTL, bumps=%d", c.GetCounters().Bumps)
+	}
+	clk.now = clk.now.Add(time.Minute)
+	for i := 0; i < n; i++ {
+		if v, ok := c.Lookup(Key(i)); ok != (i%2 == 1) || ok && v != Value(i) {
+			t.Fatalf("Lookup(%d)=%v,%v after the TTL", i, v, ok)
+		}
+	}
+	m := 0
+	c.Map(func(c *Cuckoo, key Key, val Value) bool {
+		m++
+		return false
+	})
+	if m != n/2 || c.Elements != n {
+		t.Fatalf("Map saw %d KV pairs, Elements=%d", m, c.Elements)
+	}
+	if _, ok := c.Delete(Key(4)); ok {
+		t.Fatal("Delete found an expired key")
+	}
+
+	// new keys take the slots of expired ones, the table is too full for them otherwise
+	for i := n; i < n+n/2; i++ {
+		if !c.Insert(Key(i), Value(i)) {
+			t.Fatalf("insert %d, Elements=%d", i, c.Elements)
+		}
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	lazy := c.GetCounter("Expired")
+	if lazy < n/2-c.MaxElements+n {
+		t.Fatalf("Expired=%d", lazy)
+	}
+	swept, budget := 0, c.Size/c.Nslots
+	for i := 0; i < budget; i += 10 {
+		swept += c.Sweep(10)
+	}
+	if lazy+swept != n/2 || c.Sweep(budget) != 0 || c.GetCounter("Expired") != n/2 {
+		t.Fatalf("%d expired on insert, %d swept", lazy, swept)
+	}
+	if c.Elements != n || c.GetCounters().Mutations != n+n/2+n/2 {
+		t.Fatalf("Elements=%d, Mutations=%d", c.Elements, c.GetCounters().Mutations)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n+n/2; i++ {
+		if _, ok := c.Lookup(Key(i)); ok != (i%2 == 1 || i >= n) {
+			t.Fatalf("Lookup(%d)=%v after the sweep", i, ok)
+		}
+	}
+}
+
+func TestExpiryBatch(t *testing.T) {
+	const n = 2000
+	clk := &fakeClock{now: time.Unix(1e9, 0)}
+	c := New(4, -n/(4*8)*100/90, 8, 0, 1.0, hashName)
+	c.SetExpiry(clk)
+	if !c.InsertTTL(Key(5), Value(5), time.Second) {
+		t.Fatal("InsertTTL")
+	}
+	clk.now = clk.now.Add(2 * time.Second)
+	keys, vals := make([]Key, 200), make([]Value, 200)
+	for i := range keys {
+		keys[i], vals[i] = Key(i+1), Value(i+1)
+	}
+	if fails := c.InsertBatch(keys, vals, 4); len(fails) != 0 {
+		t.Fatalf("fails=%v", fails)
+	}
+	for _, k := range keys {
+		if v, ok := c.Lookup(k); !ok || v != Value(k) {
+			t.Fatalf("Lookup(%d)=%v,%v", k, v, ok)
+		}
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a batch takes the slots of expired KV pairs before empty ones, as insert does
+	c = New(1, 1, 8, 0, 1.0, hashName)
+	c.SetGrow(false)
+	c.SetExpiry(clk)
+	for i := 1; i <= 8; i++ {
+		if !c.InsertTTL(Key(i), Value(i), time.Second) {
+			t.Fatalf("InsertTTL %d", i)
+		}
+	}
+	for i := 5; i <= 8; i++ {
+		c.Delete(Key(i))
+	}
+	clk.now = clk.now.Add(2 * time.Second)
+	keys, vals = []Key{Key(101), Key(102), Key(103), Key(104)}, []Value{Value(101), Value(102), Value(103), Value(104)}
+	if fails := c.InsertBatch(keys, vals, 4); len(fails) != 0 {
+		t.Fatalf("fails=%v", fails)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Elements != 4 || c.GetCounter("Expired") != 4 {
+		t.Fatalf("Elements=%d, Expired=%d", c.Elements, c.GetCounter("Expired"))
+	}
+	for _, k := range keys {
+		if v, ok := c.Lookup(k); !ok || v != Value(k) {
+			t.Fatalf("Lookup(%d)=%v,%v", k, v, ok)
+		}
+	}
+}
+
+func TestExpirySnapshot(t *testing.T) {
+	const n = 2000
+	clk := &fakeClock{now: time.Unix(1e9, 0)}
+	mk := func() *Cuckoo {
+		c := New(4, -n/(4*8)*10/9, 8, 0, 1.0, hashName)
+		c.SetExpiry(clk)
+		return c
+	}
+	// the even keys, the empty key too, expire after a minute, the odd keys never do
+	check := func(what string, lookup func(Key) (Value, bool), expired bool) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			want := i%2 == 1 || !expired
+			if v, ok := lookup(Key(i)); ok != want || ok && v != Value(i) {
+				t.Fatalf("%s: Lookup(%d)=%v,%v", what, i, v, ok)
+			}
+		}
+	}
+	c := mk()
+	ch := c.Subscribe()
+	var muts bytes.Buffer
+	done := make(chan error)
+	go func() {
+		_, err := WriteMutations(&muts, ch)
+		done <- err
+	}()
+	var log bytes.Buffer
+	rec, err := c.Record(&log)
+	if err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	var snap bytes.Buffer
+	if _, err := c.WriteTo(&snap); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		ok := false
+		if i%2 == 0 {
+			ok = c.InsertTTL(Key(i), Value(i), time.Minute)
+		} else {
+			ok = c.Insert(Key(i), Value(i))
+		}
+		if !ok {
+			t.Fatalf("insert %d", i)
+		}
+	}
+	c.Unsubscribe(ch)
+	if err := rec.Close(); err != nil {
+		t.Fatalf("Recorder: %v", err)
+	}
+	data, err := c.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("WriteMutations: %v", err)
+	}
+
+	// a snapshot, a replay, and a replica keep the expiry times
+	c2 := mk()
+	if err := c2.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	if err := c2.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c3 := mk()
+	if _, err := Replay(&log, c3); err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	c4 := mk()
+	if _, err := NewReplica(c4).ReadFrom(io.MultiReader(&snap, &muts)); err != nil {
+		t.Fatalf("Replica.ReadFrom: %v", err)
+	}
+	for _, x := range []*Cuckoo{c2, c3, c4} {
+		check("before the TTL", x.Lookup, false)
+	}
+	clk.now = clk.now.Add(time.Minute)
+	check("snapshot", c2.Lookup, true)
+	check("replay", c3.Lookup, true)
+	check("replica", c4.Lookup, true)
+
+	// without a Clock the system clock is used, it's long past 2001
+	c5 := &Cuckoo{}
+	if err := c5.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	check("system clock", c5.Lookup, true)
+	path := filepath.Join(t.TempDir(), "c.cht")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := OpenMapped(path)
+	if err != nil {
+		t.Fatalf("OpenMapped: %v", err)
+	}
+	check("OpenMapped", r.Lookup, true)
+	m := 0
+	r.Map(func(key Key, val Value) bool {
+		m++
+		return false
+	})
+	if m != n/2 {
+		t.Fatalf("Map saw %d KV pairs", m)
+	}
+	r.Close()
+
+	// the expiry times are checksummed, those of the last table are followed by their checksum
+	data[len(data)-4-1] ^= 1
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := CorruptRange{Table: 3, First: 0, Last: c.Nbuckets}
+	var ce *CorruptError
+	if err := Verify(path); !errors.As(err, &ce) || len(ce.Ranges) != 1 || ce.Ranges[0] != want {
+		t.Fatalf("Verify: %v", err)
+	}
+	if _, err := OpenMapped(path); !errors.As(err, &ce) {
+		t.Fatalf("OpenMapped: %v", err)
+	}
+	if err := c2.UnmarshalBinary(data); !errors.As(err, &ce) || len(ce.Ranges) != 1 || ce.Ranges[0] != want {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+}
+
+func TestKeyBytes(t *testing.T) {
+	// keys of 1, 2, 4, 8, and 16 bytes are copied as little endian integers, others byte by byte
+	u8, u16, u32 := uint8(0x01), uint16(0x0102), uint32(0x01020304)
+	u64, k := uint64(0x0102030405060708), Key(0x0102030405060708)
+	u128 := [2]uint64{0x0102030405060708, 0x090a0b0c0d0e0f10}
+	b3 := [3]byte{1, 2, 3}
+	for i, tc := range []struct {
+		key  interface{}
+		want []byte
+	}{
+		{&u8, []byte{1}},
+		{&u16, []byte{2, 1}},
+		{&u32, []byte{4, 3, 2, 1}},
+		{&u64, []byte{8, 7, 6, 5, 4, 3, 2, 1}},
+		{&k, []byte{8, 7, 6, 5, 4, 3, 2, 1}},
+		{&u128, []byte{8, 7, 6, 5, 4, 3, 2, 1, 16, 15, 14, 13, 12, 11, 10, 9}},
+		{&b3, []byte{1, 2, 3}},
+	} {
+		if got := KeyBytes(tc.key); !bytes.Equal(got, tc.want) {
+			t.Errorf("%d: KeyBytes=%v, want %v", i, got, tc.want)
+		}
+	}
+
+	for i, tc := range []struct {
+		key  interface{}
+		want bool
+	}{
+		{u8, true}, {u16, true}, {u32, true}, {u64, true}, {k, true}, {u128, true}, {b3, true},
+		{struct{ a, b uint32 }{}, true},
+		{struct {
+			a uint8
+			b uint32
+		}{}, false}, // padding
+		{struct{ _, b uint32 }{}, false},
+		{float64(0), false},
+		{"", false},
+		{&u8, false},
+	} {
+		if got := MemHashable(tc.key); got != tc.want {
+			t.Errorf("%d: MemHashable(%T)=%v", i, tc.key, got)
+		}
+	}
+}
+
+func benchmarkCuckooInsert(ef, add, lf float64, tables, slots int, hash string, b *testing.B) {
+	//t.Logf("BenchmarkCuckooInsert: N=%d, ef=%f, add=%f, lf=%f, tables=%d, slots=%d\n", b.N, ef, add, lf, tables, slots)
+	d := setup(b, cf)
+	//fmt.Printf("Config=%#v\n", c.Config)
+	//fmt.Printf("N=%d\n", b.N)
+	b.ResetTimer()
+
+	if true {
+		for i := 0; i < b.N; i++ {
+			d.I.Insert(ks.Keys[i%n], ks.Vals[i%n])
+		}
+	} else {
+		// func (d *DSTest) Fill(tables, buckets, slots, ibase int, flf float64, verbose, pl, progress bool, r bool) *FillStats {
+
+		fs := d.Fill(tables, b.N, slots, 1, flf, false, false, false, true)
+		fs.Fails = fs.Fails
+		//b.Logf("stats=%#v\n", fs)
+	}
+	//fmt.Printf("Config=%#v\n", c.Config)
+	//fmt.Printf("Counters=%#v\n\n", c.Counters)
+	b.ReportAllocs()
+}
+
+func benchmarkCuckooSearch(ef, add, lf float64, tables, slots int, hash string, b *testing.B) {
+	var cf = config{ef: 1.01, add: 32.0, lf: 1.0, flf: 0.8, tables: 4, slots: 8, n: 1000000}
+	d := setup(b, cf)
+	for i := 0; i < b.N; i++ {
+		d.I.Insert(ks.Keys[i%n], ks.Vals[i%n])
+	}
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		d.I.Lookup(ks.Keys[i%n])
+	}
+}
+
+func benchmarkCuckooDelete(ef, add, lf float64, tables, slots int, hash string, b *testing.B) {
+	d := setup(b, cf)
+	for i := 0; i < b.N; i++ {
+		d.I.Insert(ks.Keys[i%n], ks.Vals[i%n])
+	}
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		d.I.Delete(ks.Keys[i%n])
+	}
+}
+
+func BenchmarkCuckoo2T2SInsert(b *testing.B) {
+	benchmarkCuckooInsert(ef, add, lf, tables, slots, hashName, b)
+}
+
+func BenchmarkCuckoo2T2SSearch(b *testing.B) {
+	benchmarkCuckooSearch(ef, add, lf, tables, slots, hashName, b)
+}
+
+func BenchmarkCuckoo2T2SDelete(b *testing.B) {
+	benchmarkCuckooDelete(ef, add, lf, tables, slots, hashName, b)
+}
+
+/*
+func BenchmarkCuckoo4T4SInsert(b *testing.B) {
+	benchmarkCuckooInsert(1.0, 32.0, 0.99, 4, 4, "m332", b)
+}
+
+func BenchmarkCuckoo4T4SSearch(b *testing.B) {
+	benchmarkCuckooSearch(1.0, 32.0, 0.99, 4, 4, "m332", b)
+}
+
+func BenchmarkCuckoo4T4SDelete(b *testing.B) {
+	benchmarkCuckooDelete(1.0, 32.0, 0.99, 4, 4, "m332", b)
+}
+*/
+
+func BenchmarkCuckooInsertBatch(b *testing.B) {
+	for p := 1; p <= runtime.GOMAXPROCS(0); p *= 2 {
+		b.Run(fmt.Sprintf("p=%d", p), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				c := New(4, -len(ks.Keys)/(4*8)*100/90, 8, 0, 1.0, hashName)
+				c.SetNumericKeySize(8)
+				b.StartTimer()
+				if fails := c.InsertBatch(ks.Keys, ks.Vals, p); len(fails) != 0 {
+					b.Fatalf("%d fails", len(fails))
+				}
+			}
+		})
+	}
+}
+
+// Lookups, 90% hits, and inserts with each layout, see NewSplit. The Value is whatever
+// kv_default.go says, to compare with a big Value change it there, say to [8]uint64.
+func BenchmarkLayoutSearch(b *testing.B) {
+	for _, split := range []bool{false, true} {
+		b.Run(layoutName(split), func(b *testing.B) {
+			var cf = config{ef: 1.01, add: 32.0, lf: 1.0, flf: 0.9, tables: 4, slots: 8, n: 1000000, split: split}
+			d := setup(b, cf)
+			for i := 0; i < cf.n*9/10; i++ {
+				d.I.Insert(ks.Keys[i], ks.Vals[i])
+			}
+			b.ResetTimer()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				d.I.Lookup(ks.Keys[i%cf.n])
+			}
+		})
+	}
+}
+
+func BenchmarkLayoutInsert(b *testing.B) {
+	for _, split := range []bool{false, true} {
+		b.Run(layoutName(split), func(b *testing.B) {
+			var cf = config{ef: 1.01, add: 32.0, lf: 1.0, flf: 0.9, tables: 4, slots: 8, n: 1000000, split: split}
+			d := setup(b, cf)
+			m := cf.n * 9 / 10
+			b.ResetTimer()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if i%m == 0 && i > 0 {
+					b.StopTimer()
+					d = setup(b, cf)
+					b.StartTimer()
+				}
+				d.I.Insert(ks.Keys[i%m], ks.Vals[i%m])
+			}
+		})
+	}
 }
-*/
 
 func GoMapInsert(m map[Key]Value, nn int) {
 	for i := 0; i < nn; i++ {
@@ -365,3 +2827,7 @@ func Example() {
 }
 
 var _ DSTester = New(4, 11, 8, 0, 1.0, "aes")
+var _ DSTester = NewSync(4, 11, 8, 0, 1.0, "aes")
+var _ DSTester = NewOptimistic(4, 11, 8, 0, 1.0, "aes")
+var _ DSTester = NewConcurrent(4, 11, 8, 0, 1.0, "aes")
+var _ DSTester = NewSharded(4, 4, 11, 8, 0, 1.0, "aes")
@@ -0,0 +1,6 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+// +build !debug
+
+package cuckoo
+
+const debug = false
@@ -0,0 +1,7 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+// +build debug
+
+package cuckoo
+
+// Validate the tables after Insert, Delete, and friends, go test -tags debug, see check.
+const debug = true
@@ -0,0 +1,151 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+// Package demo makes self-contained HTML pages that animate a trace of cuckoo inserts.
+// The pages use the style sheet and drawing functions of demo.html so they look and behave the same.
+package demo
+
+import (
+	_ "embed"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+
+	"leb.io/cuckoo"
+)
+
+// The hand made demo page, the source of the style sheet and drawing functions.
+//
+//go:embed demo.html
+var HTML string
+
+// A Page is an animation of the inserts into a Cuckoo.
+// demo.html draws one cell per table and bucket, so with more than one slot
+// each slot of a table gets its own column.
+type Page struct {
+	Title    string
+	Tables   int
+	Buckets  int
+	Slots    int
+	Interval time.Duration // time between steps
+	Events   []cuckoo.TraceEvent
+}
+
+// Get the text between the first begin and the following end, begin included.
+func between(begin, end string) string {
+	i := strings.Index(HTML, begin)
+	if i < 0 {
+		panic("demo: no " + begin)
+	}
+	j := strings.Index(HTML[i:], end)
+	if j < 0 {
+		panic("demo: no " + end)
+	}
+	return HTML[i : i+j]
+}
+
+// The style sheet of demo.html.
+func Style() string {
+	return strings.TrimPrefix(between("<style>", "</style>"), "<style>")
+}
+
+// The driver and drawing functions of demo.html. driver(timer, trace) animates one step of a trace each call.
+func Script() string {
+	return between("var n = 15;", "function fill()")
+}
+
+var page = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>{{.Style}}</style>
+</head>
+<body>
+	<div id="top">
+		<table class="t1" id="tab" summary="Cuckoo Hash Tables">
+			<caption class="c1">{{.Title}}<br><br></caption>
+			<thead>
+			<tr><th>Cell</th>{{range .Columns}}<th>{{.}}</th>{{end}}</tr>
+			</thead>
+			<tbody>
+{{- range .Rows}}
+				<tr><th>{{.}}</th>{{range $.Columns}}<td class="tab"></td>{{end}}</tr>
+{{- end}}
+			</tbody>
+		</table>
+	</div>
+	<div id="bot">
+		<input type="button" id="play" value="play">
+		<input type="button" id="abort" value="abort">
+	</div>
+<script type="text/javascript">
+{{.Script}}
+function reset() {
+	var cells = document.querySelectorAll("td.tab");
+	for (var i = 0; i < cells.length; i++) {
+		cells[i].innerHTML = "";
+		cells[i].className = "tab";
+	}
+}
+
+function play() {
+	clearInterval(timer);
+	reset();
+	idx = 0;
+	next = "";
+	timer = setInterval(function(){ driver(timer, trace); }, {{.Millis}});
+}
+
+function abort() {
+	clearInterval(timer);
+}
+
+var trace = [
+{{.Trace}}];
+
+document.querySelector('#play').addEventListener('click', play);
+document.querySelector('#abort').addEventListener('click', abort);
+</script>
+</body>
+</html>
+`))
+
+// Write the page to w.
+func (p *Page) Write(w io.Writer) error {
+	if p.Tables < 1 || p.Buckets < 1 || p.Slots < 1 {
+		panic("Write")
+	}
+	var trace strings.Builder
+	jt := cuckoo.NewJSTracer(&trace)
+	for _, e := range p.Events {
+		e.Table = e.Table*p.Slots + e.Slot
+		jt.Trace(e)
+	}
+	var cols []string
+	for t := 0; t < p.Tables; t++ {
+		for s := 0; s < p.Slots; s++ {
+			if p.Slots == 1 {
+				cols = append(cols, fmt.Sprintf("Table %d", t))
+			} else {
+				cols = append(cols, fmt.Sprintf("Table %d.%d", t, s))
+			}
+		}
+	}
+	rows := make([]int, p.Buckets)
+	for i := range rows {
+		rows[i] = i
+	}
+	millis := p.Interval.Milliseconds()
+	if millis <= 0 {
+		millis = 250
+	}
+	return page.Execute(w, struct {
+		*Page
+		Style, Script, Trace string
+		Columns              []string
+		Rows                 []int
+		Millis               int64
+	}{p, Style(), Script(), trace.String(), cols, rows, millis})
+}
@@ -0,0 +1,570 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package cuckoo
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// When a Durable makes the log stable with fsync.
+type SyncPolicy int
+
+const (
+	SyncAlways SyncPolicy = iota // after every Insert and Delete
+	SyncEvery                    // every SyncInterval, a crash of the machine loses at most that much
+	SyncNever                    // leave it to the OS, a crash of the process loses nothing
+)
+
+// Options for Open, the zero value is usable.
+type DurableOptions struct {
+	Sync            SyncPolicy
+	SyncInterval    time.Duration  // for SyncEvery, 100ms if 0
+	CheckpointBytes int64          // checkpoint when the log reaches this size, 0 for only when Checkpoint is called
+	New             func() *Cuckoo // makes the table if the directory has no snapshot
+}
+
+// Log record ops. A Durable only writes opInsert and opDelete, the mutation feed opUpdate
+// and opExpire too, see WriteMutations. A Recorder has ops of its own, see recInsert.
+const (
+	opInsert = 1
+	opDelete = 2
+	opUpdate = 3
+	opExpire = 4 // the expiry time of the KV pair in the next record, in place of the sequence number
+)
+
+const (
+	walName      = "wal"
+	snapPrefix   = "snapshot-"
+	walRecHeader = 4 + 8 + 1 // crc, seq, op
+)
+
+var (
+	ErrClosed     = errors.New("cuckoo: durable table is closed")
+	ErrLogCorrupt = errors.New("cuckoo: durable table log is corrupt")
+)
+
+// A Durable is a Cuckoo whose changes survive a restart.
+// Every successful Insert and Delete appends a record to a write ahead log in its directory.
+// Checkpoint writes a snapshot, see WriteTo, and empties the log. Open loads the latest
+// snapshot and replays the log. Records have a sequence number and a CRC32C, a record torn
+// by a crash is dropped, see ErrLogCorrupt. Key and Value must not contain pointers.
+// A Durable is safe for concurrent use.
+type Durable struct {
+	mu      sync.RWMutex
+	c       *Cuckoo
+	dir     string
+	log     *os.File
+	rec     []byte // the record being written
+	seq     uint64 // sequence number of the last record
+	snap    uint64 // sequence number included in the last snapshot
+	logSize int64
+	dirty   bool  // records written since the last fsync
+	err     error // sticky, once the log can't be written nothing more is accepted
+	opts    DurableOptions
+	hooks   Hooks      // the caller's, see SetHooks
+	lost    *FailEvent // a KV pair lost by the insert being done
+	pool    sync.Pool  // *scratch for readers
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func walRecSize() int {
+	var b Bucket
+	return walRecHeader + int(unsafe.Sizeof(b.key)) + int(unsafe.Sizeof(b.val))
+}
+
+// Encode a log record into rec which must be walRecSize bytes.
+func encodeRecord(rec []byte, seq uint64, op uint8, key Key, val Value) {
+	ks, vs := int(unsafe.Sizeof(key)), int(unsafe.Sizeof(val))
+	binary.LittleEndian.PutUint64(rec[4:], seq)
+	rec[12] = op
+	copy(rec[walRecHeader:], byteView(unsafe.Pointer(&key), ks))
+	copy(rec[walRecHeader+ks:], byteView(unsafe.Pointer(&val), vs))
+	binary.LittleEndian.PutUint32(rec[0:], crc32.Checksum(rec[4:], castagnoli))
+}
+
+// Decode a log record, ok is false if the checksum is wrong or op isn't from first to last.
+func decodeRecord(rec []byte, first, last uint8) (seq uint64, op uint8, key Key, val Value, ok bool) {
+	if binary.LittleEndian.Uint32(rec[0:]) != crc32.Checksum(rec[4:], castagnoli) {
+		return
+	}
+	ks, vs := int(unsafe.Sizeof(key)), int(unsafe.Sizeof(val))
+	seq = binary.LittleEndian.Uint64(rec[4:])
+	op = rec[12]
+	copy(byteView(unsafe.Pointer(&key), ks), rec[walRecHeader:])
+	copy(byteView(unsafe.Pointer(&val), vs), rec[walRecHeader+ks:])
+	return seq, op, key, val, op >= first && op <= last
+}
+
+// Open the durable table in dir, creating dir if needed.
+// The latest snapshot is loaded, or if there isn't one a table is made by opts.New,
+// or New(4, -2048, 8, 0, 1.0, "aes") if that's nil, and then the log is replayed.
+// Hooks set on the table by opts.New are kept until SetHooks replaces them.
+func Open(dir string, opts *DurableOptions) (*Durable, error) {
+	if err := canSnapshot(); err != nil {
+		return nil, err
+	}
+	d := &Durable{dir: dir, rec: make([]byte, walRecSize())}
+	if opts != nil {
+		d.opts = *opts
+	}
+	if d.opts.SyncInterval <= 0 {
+		d.opts.SyncInterval = 100 * time.Millisecond
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := d.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := d.replay(); err != nil {
+		return nil, err
+	}
+	d.hooks = d.c.hooks
+	d.setHooks()
+	initScratchPool(&d.pool)
+	if d.opts.Sync == SyncEvery {
+		d.done = make(chan struct{})
+		d.wg.Add(1)
+		go d.syncer()
+	}
+	return d, nil
+}
+
+// Sequence numbers of the snapshots in dir, newest first.
+func snapshots(dir string) ([]uint64, error) {
+	names, err := filepath.Glob(filepath.Join(dir, snapPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, name := range names {
+		seq, err := strconv.ParseUint(strings.TrimPrefix(filepath.Base(name), snapPrefix), 16, 64)
+		if err != nil {
+			continue // a .tmp left by a crash
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] > seqs[j] })
+	return seqs, nil
+}
+
+func (d *Durable) snapPath(seq uint64) string {
+	return filepath.Join(d.dir, fmt.Sprintf("%s%016x", snapPrefix, seq))
+}
+
+func (d *Durable) loadSnapshot() error {
+	seqs, err := snapshots(d.dir)
+	if err != nil {
+		return err
+	}
+	if len(seqs) == 0 {
+		if d.opts.New != nil {
+			d.c = d.opts.New()
+		} else {
+			d.c = New(4, -2048, 8, 0, 1.0, "aes")
+		}
+		if d.c == nil {
+			return errors.New("cuckoo: Open: can't make a table")
+		}
+		return nil
+	}
+	// an older snapshot is no help, the log records it needs are gone
+	f, err := os.Open(d.snapPath(seqs[0]))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	d.c = &Cuckoo{}
+	if _, err := d.c.ReadFrom(f); err != nil {
+		return fmt.Errorf("%s: %w", f.Name(), err)
+	}
+	d.snap, d.seq = seqs[0], seqs[0]
+	return nil
+}
+
+// Apply the records in the log newer than the snapshot. Drop a torn record at the end, one that
+// is short or bad with nothing after it. A bad record with more after it returns ErrLogCorrupt
+// and the log is left alone, the records after it were acknowledged.
+func (d *Durable) replay() error {
+	f, err := os.OpenFile(filepath.Join(d.dir, walName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	d.log = f
+	r := &countReader{r: bufio.NewReaderSize(f, 1<<16)}
+	rec := make([]byte, len(d.rec))
+	good := int64(0)
+	for {
+		r.full(rec)
+		if r.err != nil {
+			break
+		}
+		seq, op, key, val, ok := decodeRecord(rec, opInsert, opDelete)
+		if !ok {
+			fi, err := f.Stat()
+			if err != nil {
+				f.Close()
+				return err
+			}
+			if fi.Size() > r.n {
+				f.Close()
+				return fmt.Errorf("%w: bad record at offset %d of %d bytes", ErrLogCorrupt, good, fi.Size())
+			}
+			break
+		}
+		good = r.n
+		if seq <= d.seq {
+			continue
+		}
+		d.seq = seq
+		switch op {
+		case opInsert:
+			if ok, _, _ := d.c.upsert(key, val); !ok {
+				f.Close()
+				return fmt.Errorf("cuckoo: replay: insert of record %d failed", seq)
+			}
+		case opDelete:
+			d.c.Delete(key)
+		}
+	}
+	if r.err != nil && r.err != io.EOF && r.err != io.ErrUnexpectedEOF {
+		f.Close()
+		return r.err
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	d.logSize = good
+	return nil
+}
+
+// fsync the log every SyncInterval.
+func (d *Durable) syncer() {
+	defer d.wg.Done()
+	t := time.NewTicker(d.opts.SyncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-t.C:
+			d.mu.Lock()
+			if d.dirty && d.err == nil {
+				d.err = d.log.Sync()
+				d.dirty = false
+			}
+			d.mu.Unlock()
+		}
+	}
+}
+
+// Append a record for a change that has been made. Called with the lock held.
+// If it can't be written the error is sticky and the caller must undo the change.
+func (d *Durable) append(op uint8, key Key, val Value) error {
+	d.seq++
+	encodeRecord(d.rec, d.seq, op, key, val)
+	if _, err := d.log.Write(d.rec); err != nil {
+		d.err = err
+		return err
+	}
+	d.logSize += int64(len(d.rec))
+	d.dirty = true
+	if d.opts.Sync == SyncAlways {
+		if err := d.log.Sync(); err != nil {
+			d.err = err
+			return err
+		}
+		d.dirty = false
+	}
+	return nil
+}
+
+// Checkpoint if the log has reached CheckpointBytes. Called with the lock held after a change is logged.
+func (d *Durable) autoCheckpoint() error {
+	if d.opts.CheckpointBytes > 0 && d.logSize >= d.opts.CheckpointBytes {
+		return d.checkpoint()
+	}
+	return nil
+}
+
+// Given key return the value and a "ok" bool indicating success or failure.
+func (d *Durable) Lookup(key Key) (v Value, ok bool) {
+	sc := d.pool.Get().(*scratch)
+	d.mu.RLock()
+	v, ok = d.c.lookup(sc, key)
+	d.mu.RUnlock()
+	d.pool.Put(sc)
+	return
+}
+
+// Given key, value insert a KV pair. When Insert returns without an error the change is
+// in the log and, depending on the SyncPolicy, on stable storage.
+// ok is false if the table couldn't hold the KV pair. If the failed insert placed key and lost
+// another KV pair instead, see FailEvent, that's logged too so a restart loses it as well.
+// If the log can't be written the change is undone and the error returned, after that
+// nothing more is accepted.
+func (d *Durable) Insert(key Key, val Value) (ok bool, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return false, d.err
+	}
+	old, had := d.c.lookup(&d.c.scratch, key)
+	d.lost = nil
+	if ok, _, _ = d.c.upsert(key, val); !ok {
+		if e := d.lost; e != nil {
+			// the lost KV pair goes first so a replay has room for key
+			if err = d.append(opDelete, e.LostKey, zeroVal); err != nil {
+				d.c.Delete(key)
+				d.c.upsert(e.LostKey, e.LostValue)
+				return
+			}
+			if err = d.append(opInsert, key, val); err != nil {
+				d.c.Delete(key)
+				return
+			}
+			err = d.autoCheckpoint()
+		}
+		return
+	}
+	if err = d.append(opInsert, key, val); err != nil {
+		if had {
+			d.c.upsert(key, old)
+		} else {
+			d.c.Delete(key)
+		}
+		return false, err
+	}
+	return ok, d.autoCheckpoint()
+}
+
+// Given key delete the KV pair. Return the value found and a bool "ok" indicating success.
+// The delete is logged before it's made, if the log can't be written the table is unchanged.
+func (d *Durable) Delete(key Key) (v Value, ok bool, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return zeroVal, false, d.err
+	}
+	if _, ok = d.c.lookup(&d.c.scratch, key); !ok {
+		d.c.Deletes++
+		return
+	}
+	if err = d.append(opDelete, key, zeroVal); err != nil {
+		return zeroVal, false, err
+	}
+	v, ok = d.c.Delete(key)
+	return v, ok, d.autoCheckpoint()
+}
+
+// Call iter for each KV pair while holding the read lock.
+// iter must not call Insert or Delete on d or it will deadlock.
+func (d *Durable) Map(iter func(c *Cuckoo, key Key, val Value) (stop bool)) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	d.c.Map(iter)
+}
+
+// Get a consistent copy of all the counters.
+func (d *Durable) GetCounters() Counters {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.c.Counters
+}
+
+// Get a consistent copy of the histograms, see Cuckoo.GetHistograms.
+func (d *Durable) GetHistograms() Histograms {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.c.GetHistograms()
+}
+
+// Check the tables are consistent, see Cuckoo.Validate.
+func (d *Durable) Validate() error {
+	sc := d.pool.Get().(*scratch)
+	defer d.pool.Put(sc)
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.c.validateS(sc)
+}
+
+// Get where key can be and where it is, see Cuckoo.Locate.
+func (d *Durable) Locate(key Key) Location {
+	sc := d.pool.Get().(*scratch)
+	defer d.pool.Put(sc)
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.c.locate(sc, key)
+}
+
+// Report what inserting key would do, see Cuckoo.ExplainInsert.
+func (d *Durable) ExplainInsert(key Key) *Explanation {
+	sc := d.pool.Get().(*scratch)
+	defer d.pool.Put(sc)
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.c.explainInsert(sc, key)
+}
+
+// Set the Logger, see Cuckoo.SetLogger.
+func (d *Durable) SetLogger(l Logger) {
+	d.mu.Lock()
+	d.c.SetLogger(l)
+	d.mu.Unlock()
+}
+
+// Set the Hooks, see Cuckoo.SetHooks, replacing the ones the table had. They're called with the write lock held.
+func (d *Durable) SetHooks(h Hooks) {
+	d.mu.Lock()
+	d.hooks = h
+	d.setHooks()
+	d.mu.Unlock()
+}
+
+// Give the table the caller's Hooks with an OnFail that notes the KV pair a failed insert lost.
+func (d *Durable) setHooks() {
+	h := d.hooks
+	h.OnFail = func(e FailEvent) {
+		if e.Lost {
+			d.lost = &e
+		}
+		if d.hooks.OnFail != nil {
+			d.hooks.OnFail(e)
+		}
+	}
+	d.c.SetHooks(h)
+}
+
+// Get a consistent copy of the counters of each table.
+func (d *Durable) GetTableCounters() []TableCounters {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.c.GetTableCounters()
+}
+
+// Get the sequence number of the last change.
+func (d *Durable) Seq() uint64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.seq
+}
+
+// fsync the log now.
+func (d *Durable) Sync() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+	d.err = d.log.Sync()
+	d.dirty = false
+	return d.err
+}
+
+// Write a snapshot of the table and empty the log.
+func (d *Durable) Checkpoint() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.err != nil {
+		return d.err
+	}
+	return d.checkpoint()
+}
+
+// The snapshot is written to a temporary file and renamed so a crash leaves either the old
+// or the new one. The log isn't emptied until the new snapshot is in place, replay skips
+// the records a snapshot already has.
+func (d *Durable) checkpoint() error {
+	if d.seq == d.snap {
+		return nil
+	}
+	path := d.snapPath(d.seq)
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = d.c.WriteTo(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err == nil {
+		err = syncDir(d.dir)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	os.Remove(d.snapPath(d.snap))
+	d.snap = d.seq
+	if err := d.log.Truncate(0); err != nil {
+		d.err = err
+		return err
+	}
+	if _, err := d.log.Seek(0, io.SeekStart); err != nil {
+		d.err = err
+		return err
+	}
+	d.logSize = 0
+	d.err = d.log.Sync()
+	d.dirty = false
+	return d.err
+}
+
+// Sync the log and close it. The table can't be used after Close.
+func (d *Durable) Close() error {
+	if d.done != nil {
+		close(d.done)
+		d.wg.Wait()
+		d.done = nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.log == nil {
+		return ErrClosed
+	}
+	err := d.err
+	if serr := d.log.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := d.log.Close(); err == nil {
+		err = cerr
+	}
+	d.log = nil
+	d.err = ErrClosed
+	return err
+}
+
+// Make a rename in dir stable. Not every system can sync a directory, so that error is ignored.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	f.Sync()
+	return f.Close()
+}
@@ -54,12 +54,14 @@ var startLevel = flag.Int("sl", 2000, "starting level")
 var lowLevel = flag.Int("ll", -8000, "lowest level")
 var lf = flag.Float64("lf", 0.96, "maximum load factor")
 var flf = flag.Float64("flf", 1.0, "fill load factor")
+var par = flag.Int("p", 1, "fill with InsertBatch using this many goroutines if > 1")
 
 var pl = flag.Bool("pl", false, "print level of each insert")
 var pt = flag.Bool("pt", false, "print summary for each trail")
 var ps = flag.Bool("ps", false, "print stats at the end of all trails")
 var pr = flag.Bool("pr", false, "print progress")
 var pf = flag.Bool("pf", false, "print info on failure")
+var ph = flag.Bool("ph", false, "print histograms of the work per insert and bucket occupancy after each fill")
 var trace = flag.Bool("trace", false, "produce trace on stdout")
 var verbose = flag.Bool("v", false, "verbose")
 
@@ -169,6 +171,7 @@ func trials(tables, buckets, slots, trials int, eseed int64, lf float64, ibase i
 			c.Trace = true
 		}
 		d = dstest.NewTester(c, *startLevel, bseed) // ???
+		d.P = *par
 		//d.I = c
 
 		siz := int(unsafe.Sizeof(key))
@@ -208,6 +211,10 @@ func trials(tables, buckets, slots, trials int, eseed int64, lf float64, ibase i
 		durations[1] = tdiff(start, stop)
 		print(1, fs.Used)
 		//c.Print() // xxx
+		if *ph {
+			h := c.GetHistograms()
+			h.Print(os.Stdout)
+		}
 
 		tot += fs.Load
 		//fmt.Printf("fs=%#v\n", fs)
@@ -0,0 +1,170 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package cuckoo
+
+import "time"
+
+// A Clock tells the time for expiry, see SetExpiry. Lookups can call Now at the same time
+// from more than one goroutine, see SyncCuckoo.
+type Clock interface {
+	Now() time.Time
+}
+
+// The clock used if SetExpiry is passed nil.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Keep an expiry time for every slot from now on, read from clock, or the system clock if it's nil.
+// A KV pair inserted by InsertTTL expires after its TTL: Lookup and Map don't see it, Delete
+// reports it missing, and an insert takes its slot as if it were empty. Until then it's still
+// counted in Elements, use Sweep to reclaim expired KV pairs before an insert gets to them.
+// The KV pairs already in the tables never expire. Snapshots keep expiry times, see WriteTo.
+// Not available once c is wrapped by a ConcurrentCuckoo.
+func (c *Cuckoo) SetExpiry(clock Clock) {
+	if c.concurrent {
+		panic("SetExpiry")
+	}
+	if clock == nil {
+		clock = systemClock{}
+	}
+	if c.clock == nil {
+		for _, t := range c.tables {
+			t.exp = make([]int64, t.Size)
+		}
+	}
+	c.clock = clock
+}
+
+// Get the time in unix nanoseconds.
+func (c *Cuckoo) now() int64 {
+	return c.clock.Now().UnixNano()
+}
+
+// Given key, value, and a TTL insert a KV pair that expires after the TTL and return ok.
+// SetExpiry must have been called. The expiry time moves with the KV pair when it's evicted.
+// Inserting the key again with Insert gives it no expiry time. Subscribers get the expiry time,
+// see Mutation, and a Recorder logs it, see Record.
+func (c *Cuckoo) InsertTTL(key Key, val Value, ttl time.Duration) (ok bool) {
+	if c.clock == nil {
+		panic("InsertTTL")
+	}
+	c.exp = c.now() + int64(ttl)
+	if c.exp == 0 {
+		c.exp = 1 // 0 means never
+	}
+	ok, _ = c.InsertL(key, val)
+	c.exp = 0
+	return
+}
+
+// Set the expiry time of slot s of bucket b if the table has them.
+func (t *Table) setExp(b uint64, s int, e int64) {
+	if t.exp != nil {
+		t.exp[int(b)*t.Nslots+s] = e
+	}
+}
+
+// Has the KV pair in slot s of bucket b expired by now?
+func (t *Table) expired(b uint64, s int, now int64) bool {
+	if t.exp == nil {
+		return false
+	}
+	e := t.exp[int(b)*t.Nslots+s]
+	return e != 0 && e <= now
+}
+
+// Has the KV pair in slot s of bucket b expired? Only reads the clock if it has an expiry time.
+func (t *Table) expiredNow(b uint64, s int) bool {
+	e := t.exp[int(b)*t.Nslots+s]
+	return e != 0 && e <= t.c.now()
+}
+
+// Is the empty key stored and expired?
+func (c *Cuckoo) emptyExpired() bool {
+	return c.emptyKeyValid && c.emptyExp != 0 && c.emptyExp <= c.now()
+}
+
+// Reclaim the expired KV pair in slot s of bucket b of table t, it's deleted but not counted as a delete.
+func (c *Cuckoo) reclaim(t *Table, b uint64, s int) {
+	k := t.key(b, s)
+	t.beginWrite(b)
+	t.setKey(b, s, c.emptyKey)
+	t.endWrite(b)
+	t.Elements--
+	c.Elements--
+	c.Expired++
+	c.Mutations++
+	if c.subs != nil {
+		c.emit(MutationDelete, k, t.val(b, s))
+	}
+}
+
+// Reclaim the expired empty key.
+func (c *Cuckoo) reclaimEmpty() {
+	c.emptyKeyValid = false
+	c.Elements--
+	c.Expired++
+	c.Mutations++
+	if c.subs != nil {
+		c.emit(MutationDelete, c.emptyKey, c.emptyValue)
+	}
+}
+
+// Reclaim the KV pairs expired by now in the buckets key could go in and return how many.
+func (c *Cuckoo) reclaimBuckets(key Key, now int64) (n int) {
+	if key == c.emptyKey {
+		if c.emptyExpired() {
+			c.reclaimEmpty()
+			n++
+		}
+		return
+	}
+	for _, t := range c.tables {
+		b := t.calcHashForTable(key) % uint64(t.Nbuckets)
+		for s := 0; s < t.Nslots; s++ {
+			if t.key(b, s) != c.emptyKey && t.expired(b, s, now) {
+				c.reclaim(t, b, s)
+				n++
+			}
+		}
+	}
+	return
+}
+
+// Reclaim the expired KV pairs in the next budget buckets and return how many. Each call starts
+// where the last one stopped and goes from table to table, so calling it now and then with
+// a small budget sweeps all the tables a bit at a time. The empty key is checked at the start
+// of each sweep. Does nothing if SetExpiry wasn't called.
+func (c *Cuckoo) Sweep(budget int) (n int) {
+	if c.clock == nil {
+		return 0
+	}
+	if debug {
+		defer c.check("Sweep")
+	}
+	now := c.now()
+	for ; budget > 0; budget-- {
+		if c.sweepT >= len(c.tables) {
+			c.sweepT, c.sweepB = 0, 0
+		}
+		if c.sweepT == 0 && c.sweepB == 0 {
+			n += c.reclaimBuckets(c.emptyKey, now)
+		}
+		t := c.tables[c.sweepT]
+		b := uint64(c.sweepB)
+		for s := 0; s < t.Nslots; s++ {
+			if t.key(b, s) != c.emptyKey && t.expired(b, s, now) {
+				c.reclaim(t, b, s)
+				n++
+			}
+		}
+		c.sweepB++
+		if c.sweepB >= t.Nbuckets {
+			c.sweepT, c.sweepB = c.sweepT+1, 0
+		}
+	}
+	return
+}
@@ -0,0 +1,175 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package cuckoo
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// A Location says where a key can be and where it is.
+type Location struct {
+	Key        Key
+	Candidates []int // Candidates[t] is the bucket key hashes to in table t
+	Found      bool  // key is in the Cuckoo
+	Table      int   // where key is if Found, all -1 for the empty key, which lives outside the tables, see New
+	Bucket     int
+	Slot       int
+}
+
+// Get the bucket key hashes to in each table and the table, bucket, and slot it's in, if any.
+// Unlike Lookup it looks at every table, so it finds a key stored twice, see Validate, the first time.
+func (c *Cuckoo) Locate(key Key) Location {
+	return c.locate(&c.scratch, key)
+}
+
+// Same as Locate but the key is serialized into sc, so it can be called by concurrent readers.
+func (c *Cuckoo) locate(sc *scratch, key Key) Location {
+	l := Location{Key: key, Candidates: make([]int, len(c.tables)), Table: -1, Bucket: -1, Slot: -1}
+	for ti, t := range c.tables {
+		l.Candidates[ti] = int(t.calcHashForTableS(sc, key) % uint64(t.Nbuckets))
+	}
+	if key == c.emptyKey {
+		l.Found = c.emptyKeyValid
+		return l
+	}
+	for ti, t := range c.tables {
+		b := l.Candidates[ti]
+		for s := 0; s < t.Nslots; s++ {
+			if t.key(uint64(b), s) == key {
+				l.Found, l.Table, l.Bucket, l.Slot = true, ti, b, s
+				return l
+			}
+		}
+	}
+	return l
+}
+
+func (l Location) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "key %v:", l.Key)
+	for t, b := range l.Candidates {
+		fmt.Fprintf(&sb, " t%d/b%d", t, b)
+	}
+	switch {
+	case !l.Found:
+		sb.WriteString(", not found")
+	case l.Table < 0:
+		sb.WriteString(", found outside the tables")
+	default:
+		fmt.Fprintf(&sb, ", found at t%d/b%d/s%d", l.Table, l.Bucket, l.Slot)
+	}
+	return sb.String()
+}
+
+// An Explanation says what inserting a key would do, see ExplainInsert.
+type Explanation struct {
+	Location                // where the key is before the insert
+	OK         bool         // the insert would succeed
+	Level      int          // the level InsertL would return, 0 if refused by the load factor limit
+	Grew       bool         // a table would be added, see SetGrow
+	Probes     int          // slots looked at
+	Bumps      int          // KV pairs evicted, the length of the displacement path
+	Iterations int          // passes through all the tables
+	Path       []TraceEvent // the TraceInsert events: the key's slot, then the new slot of each KV pair evicted on the way
+	Events     []TraceEvent // every step, in the format of a Tracer, see demo.Page
+}
+
+// Collect the trace events of a dry run.
+type eventList []TraceEvent
+
+func (el *eventList) Trace(e TraceEvent) {
+	*el = append(*el, e)
+}
+
+// Make a copy of c to try inserts on. It shares nothing with c that an insert changes,
+// it has no Logger or Hooks, and its eviction random numbers are in the same state as c's.
+func (c *Cuckoo) scratchCopy() *Cuckoo {
+	nc := new(Cuckoo)
+	*nc = *c
+	nc.scratch = newScratch()
+	nc.subs, nc.rec, nc.tracer, nc.Trace = nil, nil, nil, false
+	nc.logger, nc.hooks = nopLogger{}, Hooks{}
+	src := *c.src
+	nc.src = &src
+	nc.rnd = rand.New(nc.src)
+	nc.tables = make([]*Table, len(c.tables))
+	for ti, t := range c.tables {
+		nt := new(Table)
+		*nt = *t
+		nt.c = nc
+		nt.versions = nil
+		nt.exp = append([]int64(nil), t.exp...)
+		if t.keys != nil {
+			nt.keys = append([]Key(nil), t.keys...)
+			nt.vals = append([]Value(nil), t.vals...)
+		} else {
+			nt.buckets = make([]Slots, len(t.buckets))
+			for b := range t.buckets {
+				nt.buckets[b] = makeSlots(nt.buckets[b], len(t.buckets[b]))
+				copy(nt.buckets[b][:], t.buckets[b][:])
+			}
+		}
+		nc.tables[ti] = nt
+	}
+	return nc
+}
+
+// Do a dry run of an insert of key on a scratch copy of c and report the random walk it would
+// take: each slot probed, each KV pair evicted, and where each one ends up. The scratch copy
+// uses the same eviction random numbers as c, so if the next operation on c is an insert of key
+// it does exactly this. c is not changed. It takes time proportional to the size of c, which
+// is copied, and to the length of the walk.
+func (c *Cuckoo) ExplainInsert(key Key) *Explanation {
+	return c.explainInsert(&c.scratch, key)
+}
+
+// Same as ExplainInsert but c is only read and the key is serialized into sc, so it can be called
+// by concurrent readers.
+func (c *Cuckoo) explainInsert(sc *scratch, key Key) *Explanation {
+	nc := c.scratchCopy()
+	var el eventList
+	nc.tracer = &el
+	x := &Explanation{Location: c.locate(sc, key)}
+	if c.multi {
+		x.OK, x.Level = nc.insert(key, zeroVal, nc.StartLevel)
+	} else {
+		x.OK, x.Level, _ = nc.upsert(key, zeroVal)
+	}
+	x.Grew = nc.Ntables > c.Ntables
+	x.Probes, x.Bumps, x.Iterations = nc.Probes-c.Probes, nc.Bumps-c.Bumps, nc.Iterations-c.Iterations
+	x.Events = el
+	for _, e := range el {
+		if e.Op == TraceInsert {
+			x.Path = append(x.Path, e)
+		}
+	}
+	return x
+}
+
+func (x *Explanation) String() string {
+	var sb strings.Builder
+	sb.WriteString(x.Location.String())
+	sb.WriteString("\n")
+	for i, e := range x.Path {
+		if i == 0 {
+			fmt.Fprintf(&sb, "insert %v at t%d/b%d/s%d", e.Key, e.Table, e.Bucket, e.Slot)
+		} else {
+			fmt.Fprintf(&sb, "move %v to t%d/b%d/s%d", e.Key, e.Table, e.Bucket, e.Slot)
+		}
+		sb.WriteString("\n")
+	}
+	switch {
+	case x.OK && x.Grew:
+		sb.WriteString("succeeds after adding a table")
+	case x.OK:
+		sb.WriteString("succeeds")
+	case x.Level == 0:
+		sb.WriteString("refused by the load factor limit")
+	default:
+		sb.WriteString("fails")
+	}
+	fmt.Fprintf(&sb, ", level=%d, probes=%d, bumps=%d, iterations=%d\n", x.Level, x.Probes, x.Bumps, x.Iterations)
+	return sb.String()
+}
@@ -0,0 +1,59 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package cuckoo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"reflect"
+	"unsafe"
+)
+
+// Close the log of d out from under it so the next write to it fails.
+func (d *Durable) CloseLog() error {
+	return d.log.Close()
+}
+
+// Insert without looking for key first, so a second copy can end up in another table.
+func (c *Cuckoo) InsertNoLookup(key Key, val Value) bool {
+	ok, _ := c.insert(key, val, c.StartLevel)
+	return ok
+}
+
+// Get the Cuckoo that holds the tables of m.
+func (m *Multimap) Cuckoo() *Cuckoo {
+	return m.c
+}
+
+// Rewrite the snapshot in b so its first table claims nbuckets buckets and size slots,
+// with a good header checksum.
+func ResizeSnapshotTable(b []byte, nbuckets, size int64) []byte {
+	cr := &countReader{r: bytes.NewReader(b)}
+	si, err := readSnapInfo(cr)
+	if err != nil {
+		panic(err)
+	}
+	b = append([]byte(nil), b...)
+	h := si.snapHeader
+	h.Size += size - si.tables[0].Size
+	var hb bytes.Buffer
+	binary.Write(&hb, binary.LittleEndian, &h)
+	copy(b, hb.Bytes())
+	off := hb.Len() + 4 + len(si.hashName) + 4 + len(si.layout) + len(si.emptyKey) + len(si.emptyValue) + 8*len(si.counters)
+	binary.LittleEndian.PutUint64(b[off+8:], uint64(nbuckets))
+	binary.LittleEndian.PutUint64(b[off+24:], uint64(size))
+	binary.LittleEndian.PutUint32(b[cr.n-4:], crc32.Checksum(b[:cr.n-4], castagnoli))
+	return b
+}
+
+// Get the bytes of the key k points to as _calcHash hashes them, see putKey.
+func KeyBytes(k interface{}) []byte {
+	v := reflect.ValueOf(k)
+	return append([]byte(nil), new(buf).putKey(unsafe.Pointer(v.Pointer()), int(v.Elem().Type().Size()))...)
+}
+
+// Can a Key of the same type as k be hashed from its bytes in memory?
+func MemHashable(k interface{}) bool {
+	return memHashable(reflect.TypeOf(k))
+}
@@ -0,0 +1,225 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+// Package exporter publishes the counters of cuckoo hash tables as Prometheus metrics and with expvar.
+// Every field of cuckoo.Counters becomes a metric named cuckoo_ and the field name in snake case,
+// with _total added for the ones that only go up. The fields of cuckoo.TableCounters become
+// cuckoo_table_ metrics with a table label holding the table's index.
+// Each source is told apart by a label, "name" by default, holding the name it was added with.
+//
+//	e := exporter.New()
+//	e.Add("users", users)
+//	http.Handle("/metrics", e)
+//	e.Publish("cuckoo")
+package exporter
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"leb.io/cuckoo"
+)
+
+// A Source is anything with counters: a Cuckoo, SyncCuckoo, OptimisticCuckoo, ConcurrentCuckoo,
+// Sharded, Durable, or ReadOnly. Its methods must be safe to call from the http server's goroutine,
+// so a plain Cuckoo that's being written needs a wrapper.
+type Source interface {
+	GetCounters() cuckoo.Counters
+	GetTableCounters() []cuckoo.TableCounters
+}
+
+// An Exporter is a set of named Sources. It's an http.Handler that serves the Prometheus text format.
+type Exporter struct {
+	Label string // name of the label that holds the name of a source, "name" if empty
+
+	mu      sync.Mutex
+	sources map[string]Source
+}
+
+// Fields that only go up, the rest are gauges.
+var counters = map[string]bool{
+	"Inserts":    true,
+	"Probes":     true,
+	"Iterations": true,
+	"Deletes":    true,
+	"Lookups":    true,
+	"Aborts":     true,
+	"Fails":      true,
+	"Bumps":      true,
+	"TableGrows": true,
+	"TraceCnt":   true,
+	"Mutations":  true,
+}
+
+// Make an empty Exporter.
+func New() *Exporter {
+	return &Exporter{sources: make(map[string]Source)}
+}
+
+// Add a source, replacing any with the same name.
+func (e *Exporter) Add(name string, s Source) {
+	e.mu.Lock()
+	e.sources[name] = s
+	e.mu.Unlock()
+}
+
+// Remove the source with name.
+func (e *Exporter) Remove(name string) {
+	e.mu.Lock()
+	delete(e.sources, name)
+	e.mu.Unlock()
+}
+
+// A snapshot of the counters of a source.
+type sample struct {
+	name   string
+	cs     cuckoo.Counters
+	tables []cuckoo.TableCounters
+}
+
+// Read the counters of all the sources, sorted by name.
+func (e *Exporter) samples() []sample {
+	e.mu.Lock()
+	ss := make([]sample, 0, len(e.sources))
+	for name, s := range e.sources {
+		ss = append(ss, sample{name: name, cs: s.GetCounters(), tables: s.GetTableCounters()})
+	}
+	e.mu.Unlock()
+	sort.Slice(ss, func(i, j int) bool { return ss[i].name < ss[j].name })
+	return ss
+}
+
+// CamelCase to snake_case, MaxPathLen is max_path_len.
+func snake(s string) string {
+	var sb strings.Builder
+	for i, r := range s {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				sb.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// The value of an int or bool field as a sample value.
+func value(v reflect.Value) (string, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), true
+	case reflect.Bool:
+		if v.Bool() {
+			return "1", true
+		}
+		return "0", true
+	}
+	return "", false
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Write the metrics of all the sources in the Prometheus text format.
+func (e *Exporter) WriteTo(w io.Writer) (int64, error) {
+	label := e.Label
+	if label == "" {
+		label = "name"
+	}
+	ss := e.samples()
+	cw := &countWriter{w: bufio.NewWriter(w)}
+
+	ct := reflect.TypeOf(cuckoo.Counters{})
+	for f := 0; f < ct.NumField(); f++ {
+		fd := ct.Field(f)
+		name, kind := "cuckoo_"+snake(fd.Name), "gauge"
+		if counters[fd.Name] {
+			name, kind = name+"_total", "counter"
+		}
+		header := false
+		for _, s := range ss {
+			x, ok := value(reflect.ValueOf(s.cs).Field(f))
+			if !ok {
+				break
+			}
+			if !header {
+				fmt.Fprintf(cw, "# HELP %s Counters.%s of a cuckoo hash table.\n# TYPE %s %s\n", name, fd.Name, name, kind)
+				header = true
+			}
+			fmt.Fprintf(cw, "%s{%s=\"%s\"} %s\n", name, label, escaper.Replace(s.name), x)
+		}
+	}
+
+	tt := reflect.TypeOf(cuckoo.TableCounters{})
+	for f := 0; f < tt.NumField(); f++ {
+		fd := tt.Field(f)
+		name, kind := "cuckoo_table_"+snake(fd.Name), "gauge"
+		if counters[fd.Name] {
+			name, kind = name+"_total", "counter"
+		}
+		header := false
+		for _, s := range ss {
+			for ti, tc := range s.tables {
+				x, ok := value(reflect.ValueOf(tc).Field(f))
+				if !ok {
+					break
+				}
+				if !header {
+					fmt.Fprintf(cw, "# HELP %s TableCounters.%s of a table of a cuckoo hash table.\n# TYPE %s %s\n", name, fd.Name, name, kind)
+					header = true
+				}
+				fmt.Fprintf(cw, "%s{%s=\"%s\",table=\"%d\"} %s\n", name, label, escaper.Replace(s.name), ti, x)
+			}
+		}
+	}
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// Serve the metrics in the Prometheus text format.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	e.WriteTo(w)
+}
+
+// Publish the counters with expvar as varName, a map from each source's name to its
+// Counters and TableCounters. Like expvar.Publish it panics if varName is already taken.
+func (e *Exporter) Publish(varName string) {
+	expvar.Publish(varName, expvar.Func(func() interface{} {
+		m := make(map[string]interface{})
+		for _, s := range e.samples() {
+			m[s.name] = struct {
+				Counters cuckoo.Counters
+				Tables   []cuckoo.TableCounters
+			}{s.cs, s.tables}
+		}
+		return m
+	}))
+}
+
+// Count what's written and keep the first error.
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
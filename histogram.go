@@ -0,0 +1,168 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package cuckoo
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// Number of buckets in a Histogram, enough for any int that isn't negative.
+const HistogramBuckets = 64
+
+// A Histogram counts values by powers of 2. Bucket 0 counts the zeros and bucket i > 0
+// counts the values in [2^(i-1), 2^i), so 1 is in bucket 1, 2 and 3 are in bucket 2, and so on.
+type Histogram [HistogramBuckets]int
+
+// Get the bucket v is counted in.
+func histogramBucket(v int) int {
+	return bits.Len64(uint64(v))
+}
+
+// Get the range of values [lo, hi) counted in bucket i.
+func HistogramRange(i int) (lo, hi int) {
+	switch i {
+	case 0:
+		return 0, 1
+	case HistogramBuckets - 1:
+		return 1 << uint(i-1), math.MaxInt64
+	}
+	return 1 << uint(i-1), 1 << uint(i)
+}
+
+// Count v, which must not be negative.
+func (h *Histogram) Add(v int) {
+	h[histogramBucket(v)]++
+}
+
+// Add the counts of o.
+func (h *Histogram) Merge(o *Histogram) {
+	for i := range h {
+		h[i] += o[i]
+	}
+}
+
+// Get the number of values counted.
+func (h *Histogram) Total() (n int) {
+	for _, c := range h {
+		n += c
+	}
+	return
+}
+
+// Get an upper bound of the q quantile, 0 <= q <= 1: at least q of the values are less than it.
+// Quantile(.99) is the p99. Values are only known to a power of 2, 0 if nothing was counted.
+func (h *Histogram) Quantile(q float64) int {
+	n := h.Total()
+	if n == 0 {
+		return 0
+	}
+	want := int(q*float64(n) + 0.5)
+	switch {
+	case want < 1:
+		want = 1
+	case want > n:
+		want = n
+	}
+	seen := 0
+	for i, c := range h {
+		seen += c
+		if seen >= want {
+			_, hi := HistogramRange(i)
+			return hi
+		}
+	}
+	panic("Quantile")
+}
+
+// The distributions of the work done by each insert and of how full the buckets are.
+type Histograms struct {
+	Probes     Histogram // slots looked at per insert
+	Bumps      Histogram // evictions per insert, the length of the displacement path
+	Iterations Histogram // passes through all the tables per insert
+	Occupancy  []int     // Occupancy[n] is the number of buckets with n of their slots used, only filled in by GetHistograms
+}
+
+// Add the counts of o.
+func (h *Histograms) Merge(o *Histograms) {
+	h.Probes.Merge(&o.Probes)
+	h.Bumps.Merge(&o.Bumps)
+	h.Iterations.Merge(&o.Iterations)
+	for len(h.Occupancy) < len(o.Occupancy) {
+		h.Occupancy = append(h.Occupancy, 0)
+	}
+	for i, n := range o.Occupancy {
+		h.Occupancy[i] += n
+	}
+}
+
+// Count the work of one insert.
+func (h *Histograms) record(probes, bumps, iterations int) {
+	h.Probes.Add(probes)
+	h.Bumps.Add(bumps)
+	h.Iterations.Add(iterations)
+}
+
+// Get a copy of the histograms of the work done by inserts since New, and the occupancy of the buckets now.
+func (c *Cuckoo) GetHistograms() Histograms {
+	h := c.hists
+	h.Occupancy = make([]int, c.Nslots+1)
+	for _, t := range c.tables {
+		for b := 0; b < t.Nbuckets; b++ {
+			n := 0
+			for s := 0; s < t.Nslots; s++ {
+				if t.key(uint64(b), s) != c.emptyKey {
+					n++
+				}
+			}
+			h.Occupancy[n]++
+		}
+	}
+	return h
+}
+
+// Print a summary of the histograms: the count, p50, p90, p99, p99.9, and max of each of the
+// per insert histograms, the count of each of their buckets, and the bucket occupancy.
+// The quantiles are upper bounds, see Quantile.
+func (h *Histograms) Print(w io.Writer) {
+	var hs = []struct {
+		name string
+		h    *Histogram
+	}{{"probes", &h.Probes}, {"bumps", &h.Bumps}, {"iterations", &h.Iterations}}
+
+	fmt.Fprintf(w, "%-12s %10s %8s %8s %8s %8s %8s\n", "per insert", "count", "p50", "p90", "p99", "p99.9", "max")
+	for _, x := range hs {
+		fmt.Fprintf(w, "%-12s %10d %8d %8d %8d %8d %8d\n", x.name, x.h.Total(),
+			x.h.Quantile(.5), x.h.Quantile(.9), x.h.Quantile(.99), x.h.Quantile(.999), x.h.Quantile(1))
+	}
+	for _, x := range hs {
+		n := x.h.Total()
+		if n == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%-12s %10s %8s %8s\n", x.name, "count", "%", "cum %")
+		cum := 0
+		for i, c := range x.h {
+			if c == 0 {
+				continue
+			}
+			cum += c
+			lo, hi := HistogramRange(i)
+			fmt.Fprintf(w, "%-12s %10d %8.3f %8.3f\n", fmt.Sprintf("[%d, %d)", lo, hi),
+				c, 100*float64(c)/float64(n), 100*float64(cum)/float64(n))
+		}
+	}
+	if len(h.Occupancy) == 0 {
+		return
+	}
+	n := 0
+	for _, c := range h.Occupancy {
+		n += c
+	}
+	fmt.Fprintf(w, "\n%-12s %10s %8s\n", "slots used", "buckets", "%")
+	for i, c := range h.Occupancy {
+		fmt.Fprintf(w, "%-12d %10d %8.3f\n", i, c, 100*float64(c)/float64(n))
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package cuckoo
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A Logger gets the messages about tables being added, inserts failing, and the load factor
+// limit, see SetLogger. args are alternating keys and values, so a *slog.Logger is a Logger.
+type Logger interface {
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// The default Logger writes each message and its args, key=value, as a line on stdout.
+type stdoutLogger struct{}
+
+func (stdoutLogger) print(level, msg string, args []interface{}) {
+	var sb strings.Builder
+	sb.WriteString(level)
+	sb.WriteString(" ")
+	sb.WriteString(msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&sb, " %v=%v", args[i], args[i+1])
+	}
+	fmt.Println(sb.String())
+}
+
+func (l stdoutLogger) Info(msg string, args ...interface{})  { l.print("INFO", msg, args) }
+func (l stdoutLogger) Warn(msg string, args ...interface{})  { l.print("WARN", msg, args) }
+func (l stdoutLogger) Error(msg string, args ...interface{}) { l.print("ERROR", msg, args) }
+
+// Drops the messages, see SetLogger.
+type nopLogger struct{}
+
+func (nopLogger) Info(msg string, args ...interface{})  {}
+func (nopLogger) Warn(msg string, args ...interface{})  {}
+func (nopLogger) Error(msg string, args ...interface{}) {}
+
+// Set the Logger, nil to drop the messages. By default they're written to stdout.
+func (c *Cuckoo) SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	c.logger = l
+}
+
+// Get the Logger.
+func (c *Cuckoo) log() Logger {
+	if c.logger == nil {
+		return stdoutLogger{}
+	}
+	return c.logger
+}
+
+// A GrowEvent says a table was added because an insert couldn't place a key, see SetGrow.
+type GrowEvent struct {
+	Tables int // number of tables, including the new one
+	Key    Key // the key that couldn't be placed
+	Level  int
+}
+
+// An AbortEvent says an insert aborted, it reached level 0, see SetStartLevel, and then
+// recovered, it got every KV pair back into a table.
+type AbortEvent struct {
+	Key        Key
+	Level      int // the level the insert returned, below 0
+	Iterations int // passes through all the tables
+}
+
+// A FailEvent says an insert failed. The KV pair that has no slot may not be Key's, one that
+// was already in the Cuckoo can be evicted and not placed again. If so it's lost.
+type FailEvent struct {
+	Key       Key
+	Value     Value
+	Level     int
+	Lost      bool // LostKey and LostValue were in the Cuckoo and are no longer
+	LostKey   Key
+	LostValue Value
+}
+
+// A LimitEvent says an insert was refused because the Cuckoo has MaxElements, see New.
+type LimitEvent struct {
+	Key         Key
+	Elements    int
+	MaxElements int
+}
+
+// Functions called when something goes wrong, or nearly, during an insert, see SetHooks.
+// Any of them can be nil. They're called by the writer in the middle of an insert, so they must
+// not use the Cuckoo. A ConcurrentCuckoo calls them from any number of goroutines at once.
+type Hooks struct {
+	OnGrow  func(e GrowEvent)  // a table was added, TableGrows went up
+	OnAbort func(e AbortEvent) // an insert aborted and recovered, Aborts went up
+	OnFail  func(e FailEvent)  // an insert failed
+	OnLimit func(e LimitEvent) // an insert was refused by the load factor limit, called for each one
+}
+
+// Set the functions called when a table is added, an insert aborts and recovers, an insert fails,
+// or an insert is refused by the load factor limit. The zero Hooks removes them.
+func (c *Cuckoo) SetHooks(h Hooks) {
+	c.hooks = h
+}
+
+// A table was added while inserting k.
+func (c *Cuckoo) grew(k Key, level int) {
+	c.log().Info("cuckoo: added a table", "tables", c.Ntables, "key", k, "level", level)
+	if c.hooks.OnGrow != nil {
+		c.hooks.OnGrow(GrowEvent{Tables: c.Ntables, Key: k, Level: level})
+	}
+}
+
+// The insert of key failed and k is the key left with no slot.
+func (c *Cuckoo) failed(key Key, val Value, k Key, v Value, level int) {
+	lost := k != key || v != val // another copy of key in a Multimap
+	if lost {
+		c.log().Error("cuckoo: insert failed", "key", key, "level", level, "lost", k)
+	} else {
+		c.log().Error("cuckoo: insert failed", "key", key, "level", level)
+	}
+	if c.hooks.OnFail != nil {
+		e := FailEvent{Key: key, Value: val, Level: level, Lost: lost}
+		if lost {
+			e.LostKey, e.LostValue = k, v
+		}
+		c.hooks.OnFail(e)
+	}
+}
+
+// The insert of key was refused by the load factor limit, first is true the first time.
+func (c *Cuckoo) limited(key Key, elements int, first bool) {
+	if first {
+		c.log().Warn("cuckoo: load factor limit reached", "elements", elements, "maxElements", c.MaxElements)
+	}
+	if c.hooks.OnLimit != nil {
+		c.hooks.OnLimit(LimitEvent{Key: key, Elements: elements, MaxElements: c.MaxElements})
+	}
+}
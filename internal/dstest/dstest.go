@@ -20,6 +20,16 @@ type DSTester interface {
 	GetTableCounter(t int, stat string) int
 }
 
+// data structures that can check their own consistency
+type Validator interface {
+	Validate() error
+}
+
+// data structures that can insert many KV pairs at once, in parallel
+type BatchInserter interface {
+	InsertBatch(keys []c.Key, vals []c.Value, parallelism int) (fails []int)
+}
+
 //var r = rand.Float64
 
 // return information about what happened during a fill
@@ -40,6 +50,7 @@ type DSTest struct {
 	Seed      int64      // seed used to control fill stream
 	Mr        int        // Max remaining
 	Ll        int        // Lowest level
+	P         int        // parallelism, fill with InsertBatch if > 1 and I is a BatchInserter
 	FillStats            // stats
 	I         DSTester   // functions
 	R         *rand.Rand // random number generator with no lock
@@ -96,7 +107,12 @@ func (d *DSTest) _fill(tables, buckets, slots, ibase int, flf float64, verbose,
 		fmt.Printf("F: ")
 	}
 
-	for i := base; i < amax; i++ {
+	start := base
+	if bi, ok := d.I.(BatchInserter); ok && d.P > 1 {
+		svi = d.fillBatch(bi, &fs, base, amax)
+		start = amax
+	}
+	for i := start; i < amax; i++ {
 		//fmt.Printf("%d\n", i)
 		ok, l := d.I.InsertL(c.Key(i), c.Value(uint64(cnt)))
 		if l < lowestLevel && l != 0 {
@@ -171,6 +187,29 @@ func (d *DSTest) _fill(tables, buckets, slots, ibase int, flf float64, verbose,
 	return &fs
 }
 
+// fill [base, amax) with one InsertBatch, return the first key that failed or amax
+// keys after a failure are still inserted but Verify and Delete won't look at them
+func (d *DSTest) fillBatch(bi BatchInserter, fs *FillStats, base, amax int) int {
+	keys := make([]c.Key, amax-base)
+	vals := make([]c.Value, amax-base)
+	for i := range keys {
+		keys[i] = c.Key(base + i)
+		vals[i] = c.Value(uint64(i + 1))
+	}
+	fails := bi.InsertBatch(keys, vals, d.P)
+	fs.Fails = len(fails)
+	if len(fails) == 0 {
+		return amax
+	}
+	if d.I.GetCounter("limited") != 0 {
+		fs.Limited = true
+	} else {
+		fs.Failed = true
+	}
+	fs.Used = fails[0]
+	return base + fails[0]
+}
+
 func (d *DSTest) Fill(tables, buckets, slots, ibase int, flf float64, verbose, pl, progress bool, r bool) *FillStats {
 	fs := d._fill(tables, buckets, slots, ibase, flf, verbose, pl, progress, r)
 	if verbose {
@@ -203,8 +242,8 @@ func (d *DSTest) Verify(base, n int, progress bool) bool {
 			return false
 		}
 		//fmt.Printf("Verify: check i=%d, cnt=%d == v=%d\n", i, cnt, uint32(v))
-		if uint32(cnt) != uint32(v) {
-			fmt.Printf("Verify: FAIL i=%d, cnt=%d != v=%d\n", i, cnt, uint64(v))
+		if v != c.Value(uint64(cnt)) {
+			fmt.Printf("Verify: FAIL i=%d, cnt=%d != v=%v\n", i, cnt, v)
 			return false
 		}
 		if progress && cnt > thresh {
@@ -215,6 +254,12 @@ func (d *DSTest) Verify(base, n int, progress bool) bool {
 	if progress {
 		fmt.Printf("\n")
 	}
+	if v, ok := d.I.(Validator); ok {
+		if err := v.Validate(); err != nil {
+			fmt.Printf("Verify: %v\n", err)
+			return false
+		}
+	}
 	//fmt.Printf("Verify: OK\n")
 	return true
 }
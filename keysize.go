@@ -0,0 +1,67 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package cuckoo
+
+import (
+	"encoding/binary"
+	"reflect"
+	"unsafe"
+)
+
+// Can values of type t be hashed from their bytes in memory? Two of them must be == exactly when
+// their bytes are the same, so no pointers, strings, or interfaces, no floats, where +0 == -0 and
+// NaN != NaN, and no padding or blank fields, whose bytes can be anything.
+func memHashable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return true
+	case reflect.Array:
+		return memHashable(t.Elem())
+	case reflect.Struct:
+		var off uintptr
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Name == "_" || f.Offset != off || !memHashable(f.Type) {
+				return false
+			}
+			off += f.Type.Size()
+		}
+		return off == t.Size()
+	}
+	return false
+}
+
+// Get the size of the Key if it's hashed from its bytes in memory, see memHashable, otherwise 0
+// and each key is serialized before it's hashed. New sets NumericKeySize to it.
+func keySize() int {
+	t := reflect.TypeOf(zeroKey)
+	if n := int(t.Size()); n > 0 && n <= len(buf{}.base) && memHashable(t) {
+		return n
+	}
+	return 0
+}
+
+// Copy the n bytes of the key at p into b and return them. Keys of 2, 4, 8, and 16 bytes are
+// copied as integers in little endian order, so an integer key has the same bytes, and hash,
+// on any machine. p must not escape, the key would move to the heap.
+func (b *buf) putKey(p unsafe.Pointer, n int) []byte {
+	switch n {
+	case 1:
+		b.base[0] = *(*uint8)(p)
+	case 2:
+		binary.LittleEndian.PutUint16(b.base[:], *(*uint16)(p))
+	case 4:
+		binary.LittleEndian.PutUint32(b.base[:], *(*uint32)(p))
+	case 8:
+		binary.LittleEndian.PutUint64(b.base[:], *(*uint64)(p))
+	case 16:
+		binary.LittleEndian.PutUint64(b.base[:], (*[2]uint64)(p)[0])
+		binary.LittleEndian.PutUint64(b.base[8:], (*[2]uint64)(p)[1])
+	default:
+		for i := 0; i < n; i++ {
+			b.base[i] = *(*byte)(unsafe.Pointer(uintptr(p) + uintptr(i)))
+		}
+	}
+	return b.base[0:n]
+}
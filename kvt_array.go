@@ -9,3 +9,8 @@ type Slots [Nslots]Bucket // slots
 func makeSlots(s Slots, slots int) Slots {
 	return s
 }
+
+// The buckets of a table are one contiguous array so they can be viewed as bytes all at once.
+func slotsContiguous() bool {
+	return true
+}
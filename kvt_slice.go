@@ -3,8 +3,16 @@
 
 package cuckoo
 
+// The number of slots of the default build, with slices any number works.
+const Nslots = 8
+
 type Slots []Bucket
 
 func makeSlots(s Slots, slots int) Slots {
 	return make(Slots, slots, slots)
 }
+
+// Each bucket's slots are a separate allocation.
+func slotsContiguous() bool {
+	return false
+}
@@ -0,0 +1,95 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package cuckoo
+
+import "unsafe"
+
+// A table has one of three layouts, chosen by New, NewSplit, or NewSet. Interleaved, the default,
+// each bucket is an array of Bucket, a key next to its value. Split, the keys of all the buckets
+// are in one array and the values in another, a probe of a bucket reads Nslots keys in a row and
+// only the value of the key it finds. Keys only is the split layout with no values at all, every
+// value is the zero Value. The methods below hide the differences from everything but the hottest loops.
+const (
+	layoutInterleaved = iota
+	layoutSplit
+	layoutKeys
+)
+
+// Get the key in slot s of bucket b.
+func (t *Table) key(b uint64, s int) Key {
+	if t.keys != nil {
+		return t.keys[int(b)*t.Nslots+s]
+	}
+	return t.buckets[b][s].key
+}
+
+// Get the value in slot s of bucket b.
+func (t *Table) val(b uint64, s int) Value {
+	if t.keys != nil {
+		if t.vals == nil {
+			return zeroVal
+		}
+		return t.vals[int(b)*t.Nslots+s]
+	}
+	return t.buckets[b][s].val
+}
+
+// Set the key and value in slot s of bucket b, with no expiry time.
+func (t *Table) set(b uint64, s int, k Key, v Value) {
+	if t.exp != nil {
+		t.exp[int(b)*t.Nslots+s] = 0
+	}
+	if t.keys != nil {
+		i := int(b)*t.Nslots + s
+		t.keys[i] = k
+		if t.vals != nil {
+			t.vals[i] = v
+		}
+		return
+	}
+	t.buckets[b][s] = Bucket{key: k, val: v}
+}
+
+// Set the key in slot s of bucket b, the value is left alone.
+func (t *Table) setKey(b uint64, s int, k Key) {
+	if t.keys != nil {
+		t.keys[int(b)*t.Nslots+s] = k
+		return
+	}
+	t.buckets[b][s].key = k
+}
+
+// Set the value in slot s of bucket b.
+func (t *Table) setVal(b uint64, s int, v Value) {
+	if t.keys != nil {
+		if t.vals != nil {
+			t.vals[int(b)*t.Nslots+s] = v
+		}
+		return
+	}
+	t.buckets[b][s].val = v
+}
+
+// Move the KV pairs of the interleaved buckets of t to the split layout, or just the keys.
+func (t *Table) split(keysOnly bool) {
+	t.keys = make([]Key, t.Nbuckets*t.Nslots)
+	if !keysOnly {
+		t.vals = make([]Value, t.Nbuckets*t.Nslots)
+	}
+	for b := range t.buckets {
+		for s := range t.buckets[b] {
+			t.set(uint64(b), s, t.buckets[b][s].key, t.buckets[b][s].val)
+		}
+	}
+	t.buckets = nil
+}
+
+// Copy bucket b of a split table to sl and get its raw bytes, the bytes of the same bucket of an
+// interleaved table, so snapshots and checksums are the same for both layouts.
+func (t *Table) splitBucketBytes(b int, sl *Slots) []byte {
+	for s := range *sl {
+		(*sl)[s] = Bucket{key: t.key(uint64(b), s), val: t.val(uint64(b), s)}
+	}
+	var bk Bucket
+	return byteView(unsafe.Pointer(&(*sl)[0]), t.Nslots*int(unsafe.Sizeof(bk)))
+}
@@ -0,0 +1,236 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package cuckoo
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A Shape is everything needed to build a Cuckoo and insert keys into it the same way every time.
+// The table doesn't grow, see SetGrow, so a failure stays a failure.
+type Shape struct {
+	Tables      int
+	Buckets     int // see New
+	Slots       int
+	Seed        int64 // eviction seed, see SetEvictionSeed
+	LoadFactor  float64
+	HashName    string
+	KeySize     int // see SetNumericKeySize, 0 for what New picks
+	StartLevel  int // 0 for InitialStartLevel
+	LowestLevel int // 0 for InitialLowestLevel
+}
+
+// Make an empty Cuckoo of shape s with no Logger, nil if New fails.
+func (s Shape) New() *Cuckoo {
+	c := New(s.Tables, s.Buckets, s.Slots, s.Seed, s.LoadFactor, s.HashName)
+	if c == nil {
+		return nil
+	}
+	c.SetGrow(false)
+	c.SetLogger(nil)
+	if s.KeySize != 0 {
+		c.SetNumericKeySize(s.KeySize)
+	}
+	if s.StartLevel != 0 {
+		c.SetStartLevel(s.StartLevel)
+	}
+	if s.LowestLevel != 0 {
+		c.SetLowestLevel(s.LowestLevel)
+	}
+	return c
+}
+
+// Insert keys in order into a new Cuckoo of shape s and report if any insert failed,
+// not counting ones refused by the load factor limit.
+func (s Shape) Fails(keys []Key) bool {
+	c := s.New()
+	if c == nil {
+		return false
+	}
+	for _, k := range keys {
+		room := c.Elements < c.MaxElements
+		if ok, _ := c.InsertL(k, zeroVal); !ok && room {
+			return true
+		}
+	}
+	return false
+}
+
+// Shrink a failing insert sequence. Keys are removed by delta debugging and then the number
+// of tables and buckets is made as small as possible, alternating until neither shrinks.
+// The table is only shrunk as far as the failure stays the same kind, see FindConflicts,
+// since a small enough table makes any failure a true cycle.
+// The keys returned are in their original order and still fail with the Shape returned.
+// If keys don't fail with s they are returned as is.
+func Minimize(s Shape, keys []Key) (Shape, []Key) {
+	if !s.Fails(keys) {
+		return s, keys
+	}
+	s.Buckets = s.New().Nbuckets
+	keys = ddmin(keys, s.Fails)
+	placeable := FindConflicts(s, keys).Placeable
+	fails := func(s Shape) bool {
+		return s.Fails(keys) && FindConflicts(s, keys).Placeable == placeable
+	}
+	for {
+		ns := s
+		for ns.Tables = 1; ns.Tables < s.Tables && !fails(ns); ns.Tables++ {
+		}
+		for ns.Buckets = 1; ns.Buckets < s.Buckets && !fails(ns); ns.Buckets++ {
+		}
+		if ns.Tables == s.Tables && ns.Buckets == s.Buckets {
+			return s, keys
+		}
+		s = ns
+		keys = ddmin(keys, s.Fails)
+	}
+}
+
+// Find a smallest subset of keys, keeping their order, for which fails is still true.
+// This is Zeller's ddmin, the result is 1-minimal: removing any one key makes it pass.
+func ddmin(keys []Key, fails func([]Key) bool) []Key {
+	n := 2
+	for len(keys) >= 2 {
+		chunk := func(i int) (lo, hi int) {
+			return i * len(keys) / n, (i + 1) * len(keys) / n
+		}
+		reduced := false
+		for i := 0; i < n && !reduced; i++ {
+			lo, hi := chunk(i)
+			if sub := keys[lo:hi]; fails(sub) {
+				keys, n, reduced = append([]Key(nil), sub...), 2, true
+			}
+		}
+		for i := 0; i < n && !reduced; i++ {
+			lo, hi := chunk(i)
+			comp := append(append([]Key(nil), keys[:lo]...), keys[hi:]...)
+			if fails(comp) {
+				keys, reduced = comp, true
+				if n > 2 {
+					n--
+				}
+			}
+		}
+		if !reduced {
+			if n >= len(keys) {
+				break
+			}
+			n *= 2
+			if n > len(keys) {
+				n = len(keys)
+			}
+		}
+	}
+	return keys
+}
+
+// The Conflicts of some keys say which bucket each key hashes to in each table
+// and whether the keys can all be placed at all.
+type Conflicts struct {
+	Shape
+	Keys      []Key
+	Candidate [][]int  // Candidate[i][t] is the bucket key i hashes to in table t
+	Placeable bool     // there is a placement of every key, a failure is walk exhaustion
+	Cycle     []int    // if not Placeable the keys, by index, that need more slots than their buckets have
+	Crowded   [][2]int // the {table, bucket} of each bucket the keys of Cycle hash to
+}
+
+// Work out the conflict structure of keys in a Cuckoo of shape s.
+// If every key can be placed the keys are Placeable and a failure to insert them means the random
+// walk gave up too soon, see SetStartLevel and SetLowestLevel. Otherwise Cycle is a set of keys
+// whose candidate buckets, Crowded as {table, bucket} pairs, have fewer slots than there are keys:
+// no amount of work inserts them, it takes more slots, buckets, or tables.
+func FindConflicts(s Shape, keys []Key) *Conflicts {
+	c := s.New()
+	if c == nil {
+		panic("FindConflicts")
+	}
+	s.Buckets = c.Nbuckets
+	cf := &Conflicts{Shape: s, Keys: keys, Placeable: true}
+	for _, k := range keys {
+		cand := make([]int, len(c.tables))
+		for ti, t := range c.tables {
+			cand[ti] = int(t.calcHashForTable(k) % uint64(t.Nbuckets))
+		}
+		cf.Candidate = append(cf.Candidate, cand)
+	}
+
+	// bipartite matching of keys to slots by augmenting paths, each bucket holds Slots keys
+	nt, nb := len(c.tables), c.Nbuckets
+	held := make([][]int, nt*nb) // keys placed in each bucket
+	var seen []bool
+	var augment func(i int) bool
+	augment = func(i int) bool {
+		for t, b := range cf.Candidate[i] {
+			x := t*nb + b
+			if seen[x] {
+				continue
+			}
+			seen[x] = true
+			if len(held[x]) < c.Nslots {
+				held[x] = append(held[x], i)
+				return true
+			}
+			for j, o := range held[x] {
+				if augment(o) {
+					held[x][j] = i
+					return true
+				}
+			}
+		}
+		return false
+	}
+	dup := make(map[Key]bool)
+	for i, k := range keys {
+		if k == c.emptyKey || dup[k] {
+			continue // lives outside the tables or replaces the earlier one
+		}
+		dup[k] = true
+		seen = make([]bool, nt*nb)
+		if augment(i) {
+			continue
+		}
+		// the keys and buckets reachable from i are the ones it competes with, they're all full
+		cf.Placeable = false
+		inCycle := map[int]bool{i: true}
+		cf.Cycle = append(cf.Cycle, i)
+		for x := range seen {
+			if !seen[x] {
+				continue
+			}
+			cf.Crowded = append(cf.Crowded, [2]int{x / nb, x % nb})
+			for _, o := range held[x] {
+				if !inCycle[o] {
+					inCycle[o] = true
+					cf.Cycle = append(cf.Cycle, o)
+				}
+			}
+		}
+		break
+	}
+	return cf
+}
+
+func (cf *Conflicts) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "tables=%d, buckets=%d, slots=%d, keys=%d, seed=%d, hash=%q\n",
+		cf.Tables, cf.Buckets, cf.Slots, len(cf.Keys), cf.Seed, cf.HashName)
+	for i, k := range cf.Keys {
+		fmt.Fprintf(&sb, "key %v:", k)
+		for t, b := range cf.Candidate[i] {
+			fmt.Fprintf(&sb, " t%d/b%d", t, b)
+		}
+		sb.WriteString("\n")
+	}
+	if cf.Placeable {
+		sb.WriteString("every key has a place: walk exhaustion, raise the start level or lower the lowest level\n")
+		return sb.String()
+	}
+	fmt.Fprintf(&sb, "true cycle: %d keys compete for %d buckets with %d slots:", len(cf.Cycle), len(cf.Crowded), len(cf.Crowded)*cf.Slots)
+	for _, i := range cf.Cycle {
+		fmt.Fprintf(&sb, " %v", cf.Keys[i])
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
@@ -0,0 +1,22 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package cuckoo
+
+import (
+	"io"
+	"os"
+)
+
+// No mmap here, read the file into memory. It still isn't scanned by the GC.
+func mapFile(f *os.File, size int) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,18 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package cuckoo
+
+import (
+	"os"
+	"syscall"
+)
+
+// Map the whole file read only. The pages are shared with every other process that maps it.
+func mapFile(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func unmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,244 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package cuckoo
+
+import "fmt"
+
+// A Multimap is a cuckoo hash table that holds any number of values for each key.
+// Each KV pair gets a slot of its own in one of the key's candidate buckets, one per table,
+// so a key can have as many values in the tables as it has candidate slots. Heavy keys fill
+// their candidate buckets and every insert that lands there evicts a copy of them, which
+// makes the random walks long. So once a key has spill values in the tables, see SetSpill,
+// the rest go to an overflow map, as do the values of the empty key, see New, and any KV pair
+// left with no slot by a failed insert. MaxMultiplicity in the counters is the most values
+// seen for one key. Like a Cuckoo it's not safe for concurrent use.
+type Multimap struct {
+	c         *Cuckoo
+	overflow  map[Key][]Value // values that didn't go in a table
+	nover     int             // number of values in overflow
+	spill     int             // values of a key in the tables before the rest go to overflow
+	Overflows int             // number of KV pairs put in overflow
+}
+
+// Create a new multimap. The arguments are the same as New.
+func NewMultimap(tables, buckets, slots int, eseed int64, loadFactor float64, hashName string, emptyKey ...Key) *Multimap {
+	c := New(tables, buckets, slots, eseed, loadFactor, hashName, emptyKey...)
+	if c == nil {
+		return nil
+	}
+	m := &Multimap{c: c, overflow: make(map[Key][]Value), spill: slots}
+	c.multi = true
+	c.SetLogger(nil)
+	c.SetHooks(Hooks{OnFail: func(e FailEvent) {
+		if e.Lost {
+			m.over(e.LostKey, e.LostValue)
+		} else {
+			m.over(e.Key, e.Value)
+		}
+	}})
+	return m
+}
+
+// Set the number of values a key can have in the tables before the rest go to overflow.
+// The default is the number of slots in a bucket.
+func (m *Multimap) SetSpill(n int) {
+	if n < 1 {
+		panic("SetSpill")
+	}
+	m.spill = n
+}
+
+// Set whether a table is added when an insert fails, see Cuckoo.SetGrow. If not, the KV pair
+// left with no slot goes to overflow.
+func (m *Multimap) SetGrow(b bool) {
+	m.c.SetGrow(b)
+}
+
+// Put a KV pair in overflow.
+func (m *Multimap) over(key Key, val Value) {
+	m.overflow[key] = append(m.overflow[key], val)
+	m.nover++
+	m.Overflows++
+}
+
+// Call f with the table, bucket, and slot of each value of key in the tables, stop if it returns true.
+func (m *Multimap) slots(key Key, f func(t *Table, b uint64, s int) (stop bool)) {
+	if key == m.c.emptyKey {
+		return
+	}
+	for _, t := range m.c.tables {
+		b := t.calcHashForTable(key) % uint64(t.Nbuckets)
+		for s := 0; s < t.Nslots; s++ {
+			if t.key(b, s) == key && f(t, b, s) {
+				return
+			}
+		}
+	}
+}
+
+// Get the number of values of key.
+func (m *Multimap) Count(key Key) int {
+	n := len(m.overflow[key])
+	m.slots(key, func(t *Table, b uint64, s int) bool {
+		n++
+		return false
+	})
+	return n
+}
+
+// Add a KV pair and return ok. key keeps any values it already has, even val.
+// False if the multimap is full, see New, a failed insert puts a KV pair in overflow, see SetGrow.
+func (m *Multimap) Add(key Key, val Value) (ok bool) {
+	c := m.c
+	n := m.Count(key)
+	if n+1 > c.MaxMultiplicity {
+		c.MaxMultiplicity = n + 1
+	}
+	if key == c.emptyKey || n-len(m.overflow[key]) >= m.spill {
+		c.Inserts++
+		m.over(key, val)
+		return true
+	}
+	o := m.Overflows
+	ok, _ = c.InsertL(key, val)
+	return ok || m.Overflows > o
+}
+
+// Call iter with each value of key, stop if it returns true.
+func (m *Multimap) LookupAll(key Key, iter func(val Value) (stop bool)) {
+	m.c.Lookups++
+	stop := false
+	m.slots(key, func(t *Table, b uint64, s int) bool {
+		stop = iter(t.val(b, s))
+		return stop
+	})
+	if stop {
+		return
+	}
+	for _, v := range m.overflow[key] {
+		if iter(v) {
+			return
+		}
+	}
+}
+
+// Empty slot s of bucket b of table t.
+func (m *Multimap) free(t *Table, b uint64, s int) {
+	c := m.c
+	t.beginWrite(b)
+	t.setKey(b, s, c.emptyKey)
+	t.endWrite(b)
+	t.Elements--
+	c.Elements--
+	c.Mutations++
+}
+
+// Delete one KV pair with key and val and return true if there was one.
+func (m *Multimap) DeleteOne(key Key, val Value) (ok bool) {
+	c := m.c
+	c.Deletes++
+	if debug {
+		defer c.check("DeleteOne")
+	}
+	m.slots(key, func(t *Table, b uint64, s int) bool {
+		if t.val(b, s) == val {
+			m.free(t, b, s)
+			ok = true
+		}
+		return ok
+	})
+	if ok {
+		return
+	}
+	vs := m.overflow[key]
+	for i, v := range vs {
+		if v == val {
+			vs[i] = vs[len(vs)-1]
+			m.setOverflow(key, vs[:len(vs)-1])
+			m.nover--
+			c.Mutations++
+			return true
+		}
+	}
+	return false
+}
+
+// Set the overflow values of key.
+func (m *Multimap) setOverflow(key Key, vs []Value) {
+	if len(vs) == 0 {
+		delete(m.overflow, key)
+		return
+	}
+	m.overflow[key] = vs
+}
+
+// Delete every value of key and return how many there were.
+func (m *Multimap) DeleteAll(key Key) (n int) {
+	c := m.c
+	c.Deletes++
+	if debug {
+		defer c.check("DeleteAll")
+	}
+	m.slots(key, func(t *Table, b uint64, s int) bool {
+		m.free(t, b, s)
+		n++
+		return false
+	})
+	if vs, ok := m.overflow[key]; ok {
+		n += len(vs)
+		m.nover -= len(vs)
+		c.Mutations++
+		delete(m.overflow, key)
+	}
+	return
+}
+
+// Call iter for each KV pair, stop if it returns true. The values of a key in overflow come
+// after all the KV pairs in the tables.
+func (m *Multimap) Map(iter func(key Key, val Value) (stop bool)) {
+	stop := false
+	m.c.Map(func(c *Cuckoo, key Key, val Value) bool {
+		stop = iter(key, val)
+		return stop
+	})
+	if stop {
+		return
+	}
+	for k, vs := range m.overflow {
+		for _, v := range vs {
+			if iter(k, v) {
+				return
+			}
+		}
+	}
+}
+
+// Get the number of KV pairs.
+func (m *Multimap) Len() int {
+	return m.c.Elements + m.nover
+}
+
+// Get a copy of the counters, see Cuckoo.GetCounters. Elements doesn't count the KV pairs in overflow.
+func (m *Multimap) GetCounters() Counters {
+	return m.c.GetCounters()
+}
+
+// Get the value of some of the counters, see Cuckoo.GetCounter.
+func (m *Multimap) GetCounter(stat string) int {
+	return m.c.GetCounter(stat)
+}
+
+// Check the tables are consistent, see Cuckoo.Validate, and that the empty key is only in overflow.
+func (m *Multimap) Validate() error {
+	if err := m.c.Validate(); err != nil {
+		return err
+	}
+	n := 0
+	for _, vs := range m.overflow {
+		n += len(vs)
+	}
+	if n != m.nover || m.c.emptyKeyValid {
+		return fmt.Errorf("%w: %d values in overflow, count=%d, emptyKeyValid=%v", ErrInvalid, n, m.nover, m.c.emptyKeyValid)
+	}
+	return nil
+}
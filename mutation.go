@@ -0,0 +1,220 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package cuckoo
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// What a Mutation did.
+type MutationOp uint8
+
+const (
+	MutationInsert MutationOp = opInsert // a new key
+	MutationDelete MutationOp = opDelete
+	MutationUpdate MutationOp = opUpdate // a new value for a key that was already there
+)
+
+func (op MutationOp) String() string {
+	switch op {
+	case MutationInsert:
+		return "insert"
+	case MutationDelete:
+		return "delete"
+	case MutationUpdate:
+		return "update"
+	}
+	return fmt.Sprintf("MutationOp(%d)", uint8(op))
+}
+
+// A Mutation is a change made to a Cuckoo. Seq is the value of the Mutations counter after
+// the change, so the first Mutation after a snapshot has the snapshot's Mutations + 1.
+// For a delete Value is the value that was deleted.
+type Mutation struct {
+	Seq     uint64
+	Op      MutationOp
+	Key     Key
+	Value   Value
+	Expires int64 // for an insert or update the expiry time in unix nanoseconds, 0 for never, see InsertTTL
+}
+
+// Size of a subscriber's channel.
+const SubscribeBuffer = 1024
+
+var ErrMutationGap = errors.New("cuckoo: mutation out of sequence")
+
+// Get a channel that receives every successful Insert, update, and Delete from now on, in order.
+// When the channel is full, Insert and Delete wait, so a subscriber must keep up.
+// While there are subscribers Insert looks for the key first, to tell an insert from an update.
+// Take a snapshot, see WriteTo, right after Subscribe to bootstrap a Replica.
+// Not available once c is wrapped by a ConcurrentCuckoo.
+func (c *Cuckoo) Subscribe() <-chan Mutation {
+	if c.concurrent {
+		panic("Subscribe")
+	}
+	ch := make(chan Mutation, SubscribeBuffer)
+	c.subs = append(c.subs, ch)
+	return ch
+}
+
+// Stop sending to ch and close it.
+func (c *Cuckoo) Unsubscribe(ch <-chan Mutation) {
+	for i, sub := range c.subs {
+		if sub == ch {
+			close(sub)
+			c.subs = append(c.subs[:i], c.subs[i+1:]...)
+			break
+		}
+	}
+	if len(c.subs) == 0 {
+		c.subs = nil
+	}
+}
+
+// Send a mutation to all the subscribers.
+func (c *Cuckoo) emit(op MutationOp, key Key, val Value) {
+	m := Mutation{Seq: uint64(c.Mutations), Op: op, Key: key, Value: val}
+	if op != MutationDelete {
+		m.Expires = c.exp
+	}
+	for _, ch := range c.subs {
+		ch <- m
+	}
+}
+
+// Encode the mutations from ch to w until ch is closed, in the same format as the log
+// records of a Durable. A mutation with an expiry time is preceded by a record that holds it.
+// Use with Replica.ReadFrom to replicate over a pipe.
+func WriteMutations(w io.Writer, ch <-chan Mutation) (n int64, err error) {
+	bw := bufio.NewWriter(w)
+	rec := make([]byte, walRecSize())
+	for m := range ch {
+		if m.Expires != 0 {
+			encodeRecord(rec, uint64(m.Expires), opExpire, zeroKey, zeroVal)
+			if _, err = bw.Write(rec); err != nil {
+				return
+			}
+			n += int64(len(rec))
+		}
+		encodeRecord(rec, m.Seq, uint8(m.Op), m.Key, m.Value)
+		if _, err = bw.Write(rec); err != nil {
+			return
+		}
+		n += int64(len(rec))
+		// don't hold a mutation back waiting for the next one
+		if len(ch) == 0 {
+			if err = bw.Flush(); err != nil {
+				return
+			}
+		}
+	}
+	err = bw.Flush()
+	return
+}
+
+// A Replica keeps a Cuckoo a copy of another by applying its mutations in order.
+// The Cuckoo starts out as a snapshot of the primary, or empty if the primary was empty
+// when it was subscribed to.
+type Replica struct {
+	c *Cuckoo
+}
+
+// Make c a replica. Mutations up to c's Mutations counter are assumed to be in c already.
+func NewReplica(c *Cuckoo) *Replica {
+	return &Replica{c: c}
+}
+
+// Get the sequence number of the last mutation applied.
+func (r *Replica) Seq() uint64 {
+	return uint64(r.c.Mutations)
+}
+
+// Apply a mutation. Ones already applied are skipped. A mutation that skips ahead
+// returns ErrMutationGap, the replica has missed some and needs a new snapshot.
+// Expiry times are kept if the replica has a Clock, see SetExpiry. If the replica holds the
+// tables of a Multimap an insert adds another copy of the key instead of replacing it.
+func (r *Replica) Apply(m Mutation) error {
+	c := r.c
+	switch {
+	case m.Seq <= uint64(c.Mutations):
+		return nil
+	case m.Seq != uint64(c.Mutations)+1:
+		return fmt.Errorf("%w: got %d after %d", ErrMutationGap, m.Seq, c.Mutations)
+	}
+	if debug {
+		defer c.check("Apply")
+	}
+	switch m.Op {
+	case MutationInsert, MutationUpdate:
+		if c.clock != nil {
+			c.exp = m.Expires
+			defer func() { c.exp = 0 }()
+		}
+		var ok bool
+		if c.multi {
+			// a Multimap keeps every copy of a key, so an insert adds one
+			ok, _ = c.insert(m.Key, m.Value, c.StartLevel)
+		} else {
+			ok, _, _ = c.upsert(m.Key, m.Value)
+		}
+		if !ok {
+			return fmt.Errorf("cuckoo: replica: insert of mutation %d failed", m.Seq)
+		}
+		c.Mutations = int(m.Seq)
+		if c.subs != nil {
+			c.emit(m.Op, m.Key, m.Value) // replicas can be chained
+		}
+		return nil
+	case MutationDelete:
+		c.Delete(m.Key) // sends to c's subscribers
+	default:
+		return fmt.Errorf("cuckoo: replica: bad mutation op %d", m.Op)
+	}
+	c.Mutations = int(m.Seq)
+	return nil
+}
+
+// Apply the mutations from ch until it's closed.
+func (r *Replica) Follow(ch <-chan Mutation) error {
+	for m := range ch {
+		if err := r.Apply(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read a snapshot, see Cuckoo.ReadFrom, and then apply the mutations that follow it,
+// see WriteMutations, until EOF.
+func (r *Replica) ReadFrom(rd io.Reader) (n int64, err error) {
+	if n, err = r.c.ReadFrom(rd); err != nil {
+		return
+	}
+	cr := &countReader{r: bufio.NewReader(rd)}
+	rec := make([]byte, walRecSize())
+	var exp int64
+	for {
+		cr.full(rec)
+		if cr.err == io.EOF {
+			return n + cr.n, nil
+		}
+		if cr.err != nil {
+			return n + cr.n, cr.err
+		}
+		seq, op, key, val, ok := decodeRecord(rec, opInsert, opExpire)
+		if !ok {
+			return n + cr.n, ErrSnapshotCorrupt
+		}
+		if op == opExpire {
+			exp = int64(seq)
+			continue
+		}
+		if err = r.Apply(Mutation{Seq: seq, Op: MutationOp(op), Key: key, Value: val, Expires: exp}); err != nil {
+			return n + cr.n, err
+		}
+		exp = 0
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package cuckoo
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// An OptimisticCuckoo is a Cuckoo where Lookup doesn't take a lock.
+// Every bucket carries a version (a seqlock) that writers make odd while they change the bucket.
+// A reader notes the version, scans the slots, and retries if the version was odd or changed.
+// Writers are serialized by a single mutex. Insert moves KV pairs between tables, and while
+// a pair is in flight it is in no table at all, so a reader that misses also checks the
+// writer sequence, which is odd while an Insert is running, and retries if it moved.
+// A Lookup that has retried optimisticTries times takes the writer lock instead.
+// Key and Value must be pointer free.
+// This is the approach taken by MemC3 and libcuckoo and suits read mostly tables.
+type OptimisticCuckoo struct {
+	lookups int64        // number of lookups, atomic and first so it is 64 bit aligned
+	retries int64        // number of times a lookup had to retry, atomic
+	wseq    uint32       // writer sequence, odd while an insert is in progress
+	mu      sync.Mutex   // serializes writers
+	c       *Cuckoo      // the table
+	tables  atomic.Value // []*Table, so readers see tables added by a grow
+	pool    sync.Pool    // *scratch for readers
+}
+
+// Create a new cuckoo hash table with lock free readers. The arguments are the same as New.
+// Returns nil if Key or Value contain pointers, see NewOptimisticFrom.
+func NewOptimistic(tables, buckets, slots int, eseed int64, loadFactor float64, hashName string, emptyKey ...Key) *OptimisticCuckoo {
+	if canSnapshot() != nil {
+		return nil
+	}
+	c := New(tables, buckets, slots, eseed, loadFactor, hashName, emptyKey...)
+	if c == nil {
+		return nil
+	}
+	return NewOptimisticFrom(c)
+}
+
+// Wrap an existing cuckoo hash table. The caller must not use c directly after this call.
+// Key and Value must not contain pointers, readers can see a torn one, see probe.
+func NewOptimisticFrom(c *Cuckoo) *OptimisticCuckoo {
+	if canSnapshot() != nil {
+		panic("NewOptimisticFrom")
+	}
+	o := &OptimisticCuckoo{c: c}
+	c.setVersioned()
+	o.tables.Store(c.tables)
+	initScratchPool(&o.pool)
+	return o
+}
+
+// Lookups that keep seeing writers give up on being optimistic after this many tries and take
+// the writer lock, so a steady stream of writers can't starve a reader.
+const optimisticTries = 64
+
+// Look in bucket b of table t for key, skipping KV pairs expired by now, and say if the bucket's
+// version was stable. If it wasn't v and ok mean nothing.
+// The slots are read with plain loads while a writer may be changing them, so a torn key or value
+// can be read. That's safe here: Key and Value have no pointers, see NewOptimisticFrom, and the
+// version check throws away anything read while the bucket changed. The race detector can't see
+// the version check, so go test -race reports these reads.
+func (o *OptimisticCuckoo) probe(t *Table, b uint64, key Key, now int64) (v Value, ok, stable bool) {
+	v1 := atomic.LoadUint32(&t.versions[b])
+	if v1&1 != 0 {
+		return zeroVal, false, false
+	}
+	v, ok = zeroVal, false
+	for s := 0; s < t.Nslots; s++ {
+		if t.key(b, s) == key && !t.expired(b, s, now) {
+			v, ok = t.val(b, s), true
+			break
+		}
+	}
+	return v, ok, atomic.LoadUint32(&t.versions[b]) == v1
+}
+
+// Given key return the value and a "ok" bool indicating success or failure.
+// Lookup doesn't block, except for the empty key which is kept outside the tables,
+// and when it has retried optimisticTries times because of writers.
+func (o *OptimisticCuckoo) Lookup(key Key) (Value, bool) {
+	atomic.AddInt64(&o.lookups, 1)
+	if key == o.c.emptyKey {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		return o.c.lookup(&o.c.scratch, key)
+	}
+
+	sc := o.pool.Get().(*scratch)
+	defer o.pool.Put(sc)
+	var now int64
+	if o.c.clock != nil {
+		now = o.c.now()
+	}
+	for try := 0; try < optimisticTries; try++ {
+		ws := atomic.LoadUint32(&o.wseq)
+		stable := true
+		for _, t := range o.tables.Load().([]*Table) {
+			b := t.calcHashForTableS(sc, key) % uint64(t.Nbuckets)
+			v, ok, st := o.probe(t, b, key, now)
+			if !st {
+				stable = false
+				break
+			}
+			if ok {
+				return v, true
+			}
+		}
+		// a miss is only believable if no insert ran while we looked
+		if stable && ws&1 == 0 && atomic.LoadUint32(&o.wseq) == ws {
+			return zeroVal, false
+		}
+		atomic.AddInt64(&o.retries, 1)
+		runtime.Gosched()
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.c.lookup(sc, key)
+}
+
+// Given key, value insert a KV pair and return ok.
+func (o *OptimisticCuckoo) Insert(key Key, val Value) (ok bool) {
+	ok, _ = o.InsertL(key, val)
+	return
+}
+
+// Given key, value insert a KV pair and return ok and level needed to insert
+func (o *OptimisticCuckoo) InsertL(key Key, val Value) (ok bool, rlevel int) {
+	o.mu.Lock()
+	atomic.AddUint32(&o.wseq, 1)
+	ok, rlevel = o.c.InsertL(key, val)
+	if len(o.c.tables) != len(o.tables.Load().([]*Table)) {
+		o.tables.Store(o.c.tables)
+	}
+	atomic.AddUint32(&o.wseq, 1)
+	o.mu.Unlock()
+	return
+}
+
+// Given key delete the bucket. Return the value found and a bool "ok" indicating success
+// Delete doesn't move KV pairs so it only needs the bucket version.
+func (o *OptimisticCuckoo) Delete(key Key) (v Value, ok bool) {
+	o.mu.Lock()
+	v, ok = o.c.Delete(key)
+	o.mu.Unlock()
+	return
+}
+
+// Call iter for each KV pair while holding the writer lock.
+// iter must not call Insert or Delete on o or it will deadlock.
+func (o *OptimisticCuckoo) Map(iter func(c *Cuckoo, key Key, val Value) (stop bool)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.c.Map(iter)
+}
+
+// If the Key is a numeric data type set the length here. Call before the table is shared.
+func (o *OptimisticCuckoo) SetNumericKeySize(size int) {
+	o.mu.Lock()
+	o.c.SetNumericKeySize(size)
+	o.mu.Unlock()
+}
+
+// Set the Logger, see Cuckoo.SetLogger.
+func (o *OptimisticCuckoo) SetLogger(l Logger) {
+	o.mu.Lock()
+	o.c.SetLogger(l)
+	o.mu.Unlock()
+}
+
+// Set the Hooks, see Cuckoo.SetHooks. They're called with the writer's lock held.
+func (o *OptimisticCuckoo) SetHooks(h Hooks) {
+	o.mu.Lock()
+	o.c.SetHooks(h)
+	o.mu.Unlock()
+}
+
+// Get the number of times a Lookup had to retry because of a concurrent write.
+func (o *OptimisticCuckoo) Retries() int {
+	return int(atomic.LoadInt64(&o.retries))
+}
+
+// Get a consistent copy of all the counters.
+func (o *OptimisticCuckoo) GetCounters() Counters {
+	o.mu.Lock()
+	cs := o.c.Counters
+	o.mu.Unlock()
+	cs.Lookups += int(atomic.LoadInt64(&o.lookups))
+	return cs
+}
+
+// Get a consistent copy of the histograms, see Cuckoo.GetHistograms.
+func (o *OptimisticCuckoo) GetHistograms() Histograms {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.c.GetHistograms()
+}
+
+// Check the tables are consistent, see Cuckoo.Validate.
+func (o *OptimisticCuckoo) Validate() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.c.Validate()
+}
+
+// Get where key can be and where it is, see Cuckoo.Locate.
+func (o *OptimisticCuckoo) Locate(key Key) Location {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.c.Locate(key)
+}
+
+// Report what inserting key would do, see Cuckoo.ExplainInsert.
+func (o *OptimisticCuckoo) ExplainInsert(key Key) *Explanation {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.c.ExplainInsert(key)
+}
+
+// Get the value of some of the counters, see Cuckoo.GetCounter
+func (o *OptimisticCuckoo) GetCounter(stat string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.c.GetCounter(stat)
+}
+
+// Get a consistent copy of the counters of each table.
+func (o *OptimisticCuckoo) GetTableCounters() []TableCounters {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.c.GetTableCounters()
+}
+
+// Get the value of some of the table counters, see Cuckoo.GetTableCounter
+func (o *OptimisticCuckoo) GetTableCounter(t int, stat string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.c.GetTableCounter(t, stat)
+}
@@ -0,0 +1,8 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+// +build race
+
+package cuckoo_test
+
+func init() {
+	raceEnabled = true
+}
@@ -0,0 +1,217 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package cuckoo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+// A ReadOnly is a snapshot, see WriteTo, mapped into memory.
+// Lookups are served straight from the mapped pages. Nothing is copied into the Go heap
+// and since Key and Value have no pointers the GC never looks at the buckets.
+// Processes that map the same file share one physical copy.
+// KV pairs with an expiry time, see InsertTTL, expire by the system clock.
+// A ReadOnly is safe for concurrent use. It must not be used after Close.
+type ReadOnly struct {
+	c      *Cuckoo    // config, counters, and hash functions, its tables have no buckets
+	tables [][]Bucket // the buckets of each table, Nbuckets * Nslots of them, in the mapped file
+	exps   [][]int64  // the expiry time of each slot of each table, in the mapped file, nil if there are none
+	data   []byte     // the mapped file
+	pool   sync.Pool  // *scratch for readers
+}
+
+// Map the snapshot file at path read only and check its header, see ReadFrom.
+// The checksums are checked so every page is read once, a damaged file returns a *CorruptError.
+// Only available if Key and Value are fixed size and have no pointers.
+func OpenMapped(path string) (*ReadOnly, error) {
+	if err := canSnapshot(); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if int64(int(fi.Size())) != fi.Size() {
+		return nil, ErrSnapshotCorrupt
+	}
+	data, err := mapFile(f, int(fi.Size()))
+	if err != nil {
+		return nil, err
+	}
+	r, err := newReadOnly(data)
+	if err != nil {
+		unmapFile(data)
+		return nil, err
+	}
+	return r, nil
+}
+
+// Check the header and find the buckets of each table in data.
+func newReadOnly(data []byte) (*ReadOnly, error) {
+	var bk Bucket
+	cr := &countReader{r: bytes.NewReader(data)}
+	c, si, err := (&Cuckoo{}).readSnapMeta(cr)
+	if err != nil {
+		return nil, err
+	}
+	r := &ReadOnly{c: c, data: data}
+	ce := &CorruptError{}
+	off := cr.n
+	for ti, t := range c.tables {
+		off = (off + snapAlign - 1) / snapAlign * snapAlign
+		n := int64(t.Nbuckets) * int64(t.Nslots)
+		size := n * int64(unsafe.Sizeof(bk))
+		sumsSize := 4 * int64((t.Nbuckets+snapChunk-1)/snapChunk)
+		if off+size+sumsSize > int64(len(data)) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		bounds := chunkBounds(t.Nbuckets)
+		var b []Bucket
+		h := (*reflect.SliceHeader)(unsafe.Pointer(&b))
+		h.Data, h.Len, h.Cap = uintptr(unsafe.Pointer(&data[off])), int(n), int(n)
+		r.tables = append(r.tables, b)
+		chunk := int64(snapChunk) * int64(t.Nslots) * int64(unsafe.Sizeof(bk))
+		got := make([]uint32, len(bounds))
+		want := make([]uint32, len(bounds))
+		for i := range bounds {
+			lo, hi := off+int64(i)*chunk, off+int64(i+1)*chunk
+			if hi > off+size {
+				hi = off + size
+			}
+			got[i] = crc32.Checksum(data[lo:hi], castagnoli)
+			want[i] = binary.LittleEndian.Uint32(data[off+size+4*int64(i):])
+		}
+		ce.Ranges = append(ce.Ranges, sumRanges(ti, t.Nbuckets, got, want)...)
+		off += size + sumsSize
+		if si.Expiry {
+			off = (off + snapAlign - 1) / snapAlign * snapAlign
+			esize := int64(t.Size) * 8
+			if off+esize+4 > int64(len(data)) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			var e []int64
+			h := (*reflect.SliceHeader)(unsafe.Pointer(&e))
+			h.Data, h.Len, h.Cap = uintptr(unsafe.Pointer(&data[off])), t.Size, t.Size
+			r.exps = append(r.exps, e)
+			if crc32.Checksum(data[off:off+esize], castagnoli) != binary.LittleEndian.Uint32(data[off+esize:]) {
+				ce.table(ti, t.Nbuckets)
+			}
+			off += esize + 4
+		}
+	}
+	if si.Expiry {
+		c.clock = systemClock{}
+	}
+	if len(ce.Ranges) > 0 {
+		return nil, ce
+	}
+	initScratchPool(&r.pool)
+	return r, nil
+}
+
+// Has the KV pair in slot i of table ti expired by now?
+func (r *ReadOnly) expired(ti, i int, now int64) bool {
+	if r.exps == nil {
+		return false
+	}
+	e := r.exps[ti][i]
+	return e != 0 && e <= now
+}
+
+// Get the time in unix nanoseconds if there are expiry times.
+func (r *ReadOnly) now() int64 {
+	if r.exps == nil {
+		return 0
+	}
+	return r.c.now()
+}
+
+// Given key return the value and a "ok" bool indicating success or failure.
+func (r *ReadOnly) Lookup(key Key) (Value, bool) {
+	c := r.c
+	if key == c.emptyKey {
+		if c.emptyKeyValid && (r.exps == nil || !c.emptyExpired()) {
+			return c.emptyValue, true
+		}
+		return zeroVal, false
+	}
+
+	sc := r.pool.Get().(*scratch)
+	for ti, t := range c.tables {
+		b := t.calcHashForTableS(sc, key) % uint64(t.Nbuckets)
+		slots := r.tables[ti][b*uint64(t.Nslots) : (b+1)*uint64(t.Nslots)]
+		for s := range slots {
+			if slots[s].key == key && !r.expired(ti, int(b)*t.Nslots+s, r.now()) {
+				r.pool.Put(sc)
+				return slots[s].val, true
+			}
+		}
+	}
+	r.pool.Put(sc)
+	return zeroVal, false
+}
+
+// Get the number of KV pairs.
+func (r *ReadOnly) Len() int {
+	return r.c.Elements
+}
+
+// Call iter for each KV pair, in the same order as Cuckoo.Map, until it returns true.
+func (r *ReadOnly) Map(iter func(key Key, val Value) (stop bool)) {
+	c := r.c
+	now := r.now()
+	if c.emptyKeyValid && (r.exps == nil || !c.emptyExpired()) {
+		if iter(c.emptyKey, c.emptyValue) {
+			return
+		}
+	}
+	for ti, t := range r.tables {
+		for i, b := range t {
+			if b.key != c.emptyKey && !r.expired(ti, i, now) {
+				if iter(b.key, b.val) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Get the Config the snapshot was written with.
+func (r *ReadOnly) GetConfig() Config {
+	return r.c.Config
+}
+
+// Get the counters as they were when the snapshot was written.
+func (r *ReadOnly) GetCounters() Counters {
+	return r.c.Counters
+}
+
+// Get the counters of each table as they were when the snapshot was written.
+func (r *ReadOnly) GetTableCounters() []TableCounters {
+	return r.c.GetTableCounters()
+}
+
+// Unmap the file.
+func (r *ReadOnly) Close() error {
+	data := r.data
+	r.data, r.tables = nil, nil
+	if data == nil {
+		return nil
+	}
+	return unmapFile(data)
+}
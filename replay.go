@@ -0,0 +1,194 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package cuckoo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// A Recorder logs the operations applied to a Cuckoo so a failure can be reproduced offline, see Replay.
+// The log starts with a snapshot of the Cuckoo, see WriteTo, followed by one record per Insert,
+// Delete, InsertBatch, or ReadFrom, in the record format of the log of a Durable but with ops of
+// its own. The record of an InsertTTL is preceded by one with its expiry time. Each record is written before the operation is done so the last one is the operation
+// that was running if the process dies, but a ReadFrom is logged after with a snapshot of what it loaded.
+type Recorder struct {
+	c   *Cuckoo
+	w   *bufio.Writer
+	rec []byte
+	n   uint64 // number of operations recorded
+	err error
+}
+
+// Recorder record ops, a range of their own so the log of a Recorder can't pass for the log
+// of a Durable, or the other way around.
+const (
+	recInsert = 0x81 + iota
+	recDelete
+	recUpsert // an Insert that looked for the key first
+	recBatch  // an InsertBatch
+	recLoad   // a ReadFrom, followed by a snapshot of what was loaded
+	recExpire // the expiry time of the KV pair in the next record, see opExpire
+)
+
+// Start recording the operations on c to w.
+// The eviction random numbers are reseeded from c's own, see SetEvictionSeed, so the snapshot
+// holds the seed that every random choice after it derives from.
+// Only available if Key and Value are fixed size and have no pointers, and not once c is wrapped
+// by a ConcurrentCuckoo.
+func (c *Cuckoo) Record(w io.Writer) (*Recorder, error) {
+	if c.rec != nil || c.concurrent {
+		panic("Record")
+	}
+	c.SetEvictionSeed(c.rnd.Int63())
+	r := &Recorder{c: c, w: bufio.NewWriter(w), rec: make([]byte, walRecSize())}
+	if _, err := c.WriteTo(r.w); err != nil {
+		return nil, err
+	}
+	c.rec = r
+	return r, nil
+}
+
+// Log an operation, preceded by the expiry time of an InsertTTL.
+func (r *Recorder) log(op uint8, key Key, val Value) {
+	if r.err != nil {
+		return
+	}
+	if r.c.exp != 0 {
+		encodeRecord(r.rec, uint64(r.c.exp), recExpire, zeroKey, zeroVal)
+		if _, r.err = r.w.Write(r.rec); r.err != nil {
+			return
+		}
+	}
+	r.n++
+	encodeRecord(r.rec, r.n, op, key, val)
+	_, r.err = r.w.Write(r.rec)
+}
+
+// Log an InsertBatch, a record with the number of KV pairs and the parallelism, n<<32 | p,
+// followed by a record for each pair.
+func (r *Recorder) logBatch(keys []Key, vals []Value, p int) {
+	if r.err != nil {
+		return
+	}
+	encodeRecord(r.rec, uint64(len(keys))<<32|uint64(uint32(p)), recBatch, zeroKey, zeroVal)
+	if _, r.err = r.w.Write(r.rec); r.err != nil {
+		return
+	}
+	for i := range keys {
+		r.log(recInsert, keys[i], vals[i])
+	}
+}
+
+// Log a ReadFrom, a record followed by a snapshot of what was loaded. Written after the load,
+// the snapshot holds the eviction seed it restarted from.
+func (r *Recorder) logLoad() {
+	if r.err != nil {
+		return
+	}
+	r.n++
+	encodeRecord(r.rec, r.n, recLoad, zeroKey, zeroVal)
+	if _, r.err = r.w.Write(r.rec); r.err != nil {
+		return
+	}
+	_, r.err = r.c.WriteTo(r.w)
+}
+
+// Get the first write error, after one nothing more is recorded.
+func (r *Recorder) Err() error {
+	return r.err
+}
+
+// Write out the records buffered so far.
+func (r *Recorder) Flush() error {
+	if r.err != nil {
+		return r.err
+	}
+	r.err = r.w.Flush()
+	return r.err
+}
+
+// Stop recording and write out the buffered records.
+func (r *Recorder) Close() error {
+	if r.c.rec == r {
+		r.c.rec = nil
+	}
+	return r.Flush()
+}
+
+// Load the snapshot at the start of a log made by a Recorder into c and apply the operations
+// that follow until EOF, taking exactly the same probes and evictions as the original did.
+// Set a Tracer, see SetTracer, on c first to watch them. ops is the number of operations applied.
+// c's configuration comes from the log, its Tracer and Clock are kept. Expiry times are absolute,
+// give c a Clock, see SetExpiry, with the times of the original run to see the same expirations.
+// A log cut off in the middle of a record, by a crash, is replayed up to the last whole one.
+func Replay(rd io.Reader, c *Cuckoo) (ops int, err error) {
+	if _, err = c.ReadFrom(rd); err != nil {
+		return
+	}
+	defer func() { c.exp = 0 }()
+	cr := &countReader{r: bufio.NewReader(rd)}
+	rec := make([]byte, walRecSize())
+	var keys []Key
+	var vals []Value
+	var exp int64
+	for {
+		cr.full(rec)
+		if cr.err == io.EOF || cr.err == io.ErrUnexpectedEOF {
+			return ops, nil
+		}
+		if cr.err != nil {
+			return ops, cr.err
+		}
+		n, op, key, val, ok := decodeRecord(rec, recInsert, recExpire)
+		if !ok {
+			return ops, fmt.Errorf("%w: replay: bad record after %d operations", ErrSnapshotCorrupt, ops)
+		}
+		if op == recExpire {
+			exp = int64(n)
+			continue
+		}
+		if c.clock != nil {
+			c.exp = exp
+		}
+		exp = 0
+		switch op {
+		case recInsert:
+			if ok, _ = c.insert(key, val, c.StartLevel); ok {
+				c.Mutations++
+			}
+		case recUpsert:
+			var mop MutationOp
+			if ok, _, mop = c.upsert(key, val); ok {
+				c.Mutations++
+				if c.subs != nil {
+					c.emit(mop, key, val)
+				}
+			}
+		case recDelete:
+			c.Delete(key)
+		case recLoad:
+			if _, err = c.ReadFrom(cr.r); err != nil {
+				return ops, err
+			}
+		case recBatch:
+			cnt, p := int(n>>32), int(uint32(n))
+			keys, vals = keys[:0], vals[:0]
+			for i := 0; i < cnt; i++ {
+				cr.full(rec)
+				if cr.err != nil {
+					return ops, nil // the process died before the batch was recorded
+				}
+				if _, op, key, val, ok = decodeRecord(rec, recInsert, recInsert); !ok {
+					return ops, fmt.Errorf("%w: replay: bad batch record after %d operations", ErrSnapshotCorrupt, ops)
+				}
+				keys, vals = append(keys, key), append(vals, val)
+			}
+			c.InsertBatch(keys, vals, p)
+		default:
+			return ops, fmt.Errorf("%w: replay: bad op %d after %d operations", ErrSnapshotCorrupt, op, ops)
+		}
+		ops++
+	}
+}
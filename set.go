@@ -0,0 +1,118 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package cuckoo
+
+// A Set is a cuckoo hash table of keys with no values. It uses the split layout, see NewSplit,
+// with no value array, so a slot is just a Key and BucketSize is the size of the Key.
+// Like a Cuckoo it's not safe for concurrent use.
+type Set struct {
+	c *Cuckoo
+}
+
+// Create a new set. The arguments are the same as New.
+func NewSet(tables, buckets, slots int, eseed int64, loadFactor float64, hashName string, emptyKey ...Key) *Set {
+	c := newCuckoo(layoutKeys, tables, buckets, slots, eseed, loadFactor, hashName, emptyKey...)
+	if c == nil {
+		return nil
+	}
+	return &Set{c: c}
+}
+
+// Add key to the set and return ok, true if it was already there.
+// False if the set is full, see New, or, if it doesn't grow, the insert failed.
+func (s *Set) Add(key Key) (ok bool) {
+	if s.has(key) {
+		s.c.Inserts++
+		return true
+	}
+	ok, _ = s.c.InsertL(key, zeroVal)
+	return
+}
+
+// Is key in the set? Unlike Contains it doesn't count a lookup.
+func (s *Set) has(key Key) bool {
+	if key == s.c.emptyKey {
+		return s.c.emptyKeyValid
+	}
+	_, _, _, found := s.c.find(&s.c.scratch, key)
+	return found
+}
+
+// Is key in the set?
+func (s *Set) Contains(key Key) bool {
+	_, ok := s.c.Lookup(key)
+	return ok
+}
+
+// Remove key from the set and return true if it was there.
+func (s *Set) Remove(key Key) bool {
+	_, ok := s.c.Delete(key)
+	return ok
+}
+
+// Call iter for each key, stop if it returns true. Keys can be removed from the set,
+// but not added, while it's running.
+func (s *Set) Map(iter func(key Key) (stop bool)) {
+	s.c.Map(func(c *Cuckoo, key Key, val Value) bool {
+		return iter(key)
+	})
+}
+
+// Get the number of keys.
+func (s *Set) Len() int {
+	return s.c.Elements
+}
+
+// Add every key of o to s. Return ok, false if some key couldn't be added, see Add.
+func (s *Set) Union(o *Set) (ok bool) {
+	ok = true
+	o.Map(func(key Key) bool {
+		if !s.Add(key) {
+			ok = false
+		}
+		return false
+	})
+	return
+}
+
+// Remove every key of s that isn't in o.
+func (s *Set) Intersect(o *Set) {
+	s.Map(func(key Key) bool {
+		if !o.has(key) {
+			s.Remove(key)
+		}
+		return false
+	})
+}
+
+// Remove every key of s that is in o.
+func (s *Set) Difference(o *Set) {
+	if o.Len() < s.Len() {
+		o.Map(func(key Key) bool {
+			s.Remove(key)
+			return false
+		})
+		return
+	}
+	s.Map(func(key Key) bool {
+		if o.has(key) {
+			s.Remove(key)
+		}
+		return false
+	})
+}
+
+// Get a copy of the counters, see Cuckoo.GetCounters.
+func (s *Set) GetCounters() Counters {
+	return s.c.GetCounters()
+}
+
+// Get the value of some of the counters, see Cuckoo.GetCounter.
+func (s *Set) GetCounter(stat string) int {
+	return s.c.GetCounter(stat)
+}
+
+// Check the tables are consistent, see Cuckoo.Validate.
+func (s *Set) Validate() error {
+	return s.c.Validate()
+}
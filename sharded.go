@@ -0,0 +1,322 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package cuckoo
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Seed used to pick a shard. The tables in a shard use seeds 1, 2, 3...
+// so the shard a key goes to tells you nothing about where it lives in the shard.
+const shardSeed = 0x9e3779b97f4a7c15
+
+// A Sharded table is N independent Cuckoo tables, each with its own lock, eviction
+// random numbers, and counters. Keys are routed to a shard by a hash of the key.
+// Operations on different shards run in parallel and bulk loads use a goroutine per shard.
+type Sharded struct {
+	shards []*shard
+	pool   sync.Pool // *scratch for routing
+}
+
+type shard struct {
+	mu sync.Mutex
+	c  *Cuckoo
+}
+
+// Create n shards, each a cuckoo hash table of size tables * buckets * slots.
+// Shard i uses eseed+i for evictions. The other arguments are the same as New.
+func NewSharded(n, tables, buckets, slots int, eseed int64, loadFactor float64, hashName string, emptyKey ...Key) *Sharded {
+	if n < 1 {
+		return nil
+	}
+	s := &Sharded{shards: make([]*shard, n)}
+	for i := range s.shards {
+		c := New(tables, buckets, slots, eseed+int64(i), loadFactor, hashName, emptyKey...)
+		if c == nil {
+			return nil
+		}
+		s.shards[i] = &shard{c: c}
+	}
+	initScratchPool(&s.pool)
+	return s
+}
+
+// Pick the shard for key.
+func (s *Sharded) route(key Key) int {
+	c := s.shards[0].c
+	sc := s.pool.Get().(*scratch)
+	h := c.calcHash(sc, c.hf, shardSeed, key)
+	s.pool.Put(sc)
+	return int(h % uint64(len(s.shards)))
+}
+
+// Get the number of shards.
+func (s *Sharded) Shards() int {
+	return len(s.shards)
+}
+
+// Given key return the value and a "ok" bool indicating success or failure.
+func (s *Sharded) Lookup(key Key) (v Value, ok bool) {
+	sh := s.shards[s.route(key)]
+	sh.mu.Lock()
+	v, ok = sh.c.Lookup(key)
+	sh.mu.Unlock()
+	return
+}
+
+// Given key, value insert a KV pair and return ok.
+func (s *Sharded) Insert(key Key, val Value) (ok bool) {
+	ok, _ = s.InsertL(key, val)
+	return
+}
+
+// Given key, value insert a KV pair and return ok and level needed to insert
+func (s *Sharded) InsertL(key Key, val Value) (ok bool, rlevel int) {
+	sh := s.shards[s.route(key)]
+	sh.mu.Lock()
+	ok, rlevel = sh.c.InsertL(key, val)
+	sh.mu.Unlock()
+	return
+}
+
+// Given key delete the bucket. Return the value found and a bool "ok" indicating success
+func (s *Sharded) Delete(key Key) (v Value, ok bool) {
+	sh := s.shards[s.route(key)]
+	sh.mu.Lock()
+	v, ok = sh.c.Delete(key)
+	sh.mu.Unlock()
+	return
+}
+
+// Call iter for each KV pair, one shard at a time, holding that shard's lock.
+// iter is passed the shard's Cuckoo and must not call Insert or Delete on s.
+func (s *Sharded) Map(iter func(c *Cuckoo, key Key, val Value) (stop bool)) {
+	stopped := false
+	wrap := func(c *Cuckoo, key Key, val Value) bool {
+		stopped = iter(c, key, val)
+		return stopped
+	}
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		sh.c.Map(wrap)
+		sh.mu.Unlock()
+		if stopped {
+			return
+		}
+	}
+}
+
+// Insert keys[i], vals[i] for all i with one goroutine per shard.
+// Returns the indexes of the KV pairs that could not be inserted, in order.
+func (s *Sharded) Load(keys []Key, vals []Value) (fails []int) {
+	var wg sync.WaitGroup
+
+	if len(keys) != len(vals) {
+		panic("Load: len(keys) != len(vals)")
+	}
+	parts := make([][]int, len(s.shards))
+	for i, k := range keys {
+		n := s.route(k)
+		parts[n] = append(parts[n], i)
+	}
+	pfails := make([][]int, len(s.shards))
+	for n, sh := range s.shards {
+		wg.Add(1)
+		go func(n int, sh *shard) {
+			defer wg.Done()
+			sh.mu.Lock()
+			defer sh.mu.Unlock()
+			for _, i := range parts[n] {
+				if !sh.c.Insert(keys[i], vals[i]) {
+					pfails[n] = append(pfails[n], i)
+				}
+			}
+		}(n, sh)
+	}
+	wg.Wait()
+	for _, f := range pfails {
+		fails = append(fails, f...)
+	}
+	sort.Ints(fails)
+	return
+}
+
+// If the Key is a numeric data type set the length here, for all shards.
+func (s *Sharded) SetNumericKeySize(size int) {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		sh.c.SetNumericKeySize(size)
+		sh.mu.Unlock()
+	}
+}
+
+// Set if hash tables can be added dynamically if an insert fails, for all shards.
+func (s *Sharded) SetGrow(b bool) {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		sh.c.SetGrow(b)
+		sh.mu.Unlock()
+	}
+}
+
+// Set the Logger of all shards, see Cuckoo.SetLogger. It must be safe to call from any number of goroutines.
+func (s *Sharded) SetLogger(l Logger) {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		sh.c.SetLogger(l)
+		sh.mu.Unlock()
+	}
+}
+
+// Set the Hooks of all shards, see Cuckoo.SetHooks. They're called holding the lock of a shard,
+// so shards can call them at the same time.
+func (s *Sharded) SetHooks(h Hooks) {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		sh.c.SetHooks(h)
+		sh.mu.Unlock()
+	}
+}
+
+// Get the current load factor over all the shards.
+func (s *Sharded) GetLoadFactor() float64 {
+	cs := s.GetCounters()
+	return float64(cs.Elements) / float64(s.size())
+}
+
+func (s *Sharded) size() (size int) {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		size += sh.c.Size
+		sh.mu.Unlock()
+	}
+	return
+}
+
+// Get the counters of all the shards added together.
+func (s *Sharded) GetCounters() Counters {
+	var cs Counters
+
+	cs.InitCounters()
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		cs.CountersAdd(&sh.c.Counters)
+		cs.BucketSize, cs.SlotsSize = sh.c.BucketSize, sh.c.SlotsSize
+		sh.mu.Unlock()
+	}
+	return cs
+}
+
+// Get the histograms of all the shards added together, see Cuckoo.GetHistograms.
+func (s *Sharded) GetHistograms() Histograms {
+	var h Histograms
+
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		shh := sh.c.GetHistograms()
+		sh.mu.Unlock()
+		h.Merge(&shh)
+	}
+	return h
+}
+
+// Check the tables of every shard are consistent and each key is in the right shard, see Cuckoo.Validate.
+func (s *Sharded) Validate() (err error) {
+	for i, sh := range s.shards {
+		sh.mu.Lock()
+		err = sh.c.Validate()
+		sh.c.Map(func(c *Cuckoo, key Key, val Value) bool {
+			if err == nil && s.route(key) != i {
+				err = fmt.Errorf("%w: key %v in shard %d belongs in shard %d", ErrInvalid, key, i, s.route(key))
+			}
+			return err != nil
+		})
+		sh.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Get the shard key belongs in and where in it key can be and is, see Cuckoo.Locate.
+func (s *Sharded) Locate(key Key) (shard int, l Location) {
+	shard = s.route(key)
+	sh := s.shards[shard]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return shard, sh.c.Locate(key)
+}
+
+// Report what inserting key into its shard would do, see Cuckoo.ExplainInsert.
+func (s *Sharded) ExplainInsert(key Key) (shard int, x *Explanation) {
+	shard = s.route(key)
+	sh := s.shards[shard]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return shard, sh.c.ExplainInsert(key)
+}
+
+// Get a copy of the counters of shard i.
+func (s *Sharded) GetShardCounters(i int) Counters {
+	sh := s.shards[i]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.c.Counters
+}
+
+// Get the value of some of the counters added up over all the shards, see Cuckoo.GetCounter
+func (s *Sharded) GetCounter(stat string) int {
+	switch stat {
+	case "size":
+		return s.size()
+	case "bumps":
+		return s.GetCounters().Bumps
+	case "inserts":
+		return s.GetCounters().Inserts
+	case "elements":
+		return s.GetCounters().Elements
+	case "MaxPathLen":
+		return s.GetCounters().MaxPathLen
+	case "limited":
+		if s.GetCounters().Limited {
+			return 1
+		}
+		return 0
+	default:
+		panic("GetCounter")
+	}
+}
+
+// Get the counters of each table added up over all the shards.
+func (s *Sharded) GetTableCounters() []TableCounters {
+	var tcs []TableCounters
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		for i, t := range sh.c.tables {
+			if i == len(tcs) {
+				tcs = append(tcs, TableCounters{})
+			}
+			tcs[i].Size += t.Size
+			tcs[i].Elements += t.Elements
+			tcs[i].Bumps += t.Bumps
+		}
+		sh.mu.Unlock()
+	}
+	return tcs
+}
+
+// Get the value of some of the table counters for table t added up over all the shards.
+// Shards that haven't grown to t tables add nothing.
+func (s *Sharded) GetTableCounter(t int, stat string) (v int) {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		if t < len(sh.c.tables) {
+			v += sh.c.GetTableCounter(t, stat)
+		}
+		sh.mu.Unlock()
+	}
+	return
+}
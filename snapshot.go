@@ -0,0 +1,658 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package cuckoo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"reflect"
+	"unsafe"
+)
+
+// A snapshot is a header, a few variable length items, per table headers, and a CRC32C of all that.
+// Then for each table the raw buckets, aligned to snapAlign bytes so the file can be mapped,
+// followed by a CRC32C of every snapChunk buckets, and if there is a Clock, see SetExpiry,
+// the raw expiry time of each slot, also aligned, followed by a CRC32C of them.
+// Everything but the buckets and expiry times is little endian. They are written in the native
+// byte order, which is recorded, so a load is a straight copy and nothing is rehashed.
+const (
+	SnapshotVersion = 1
+	snapAlign       = 64
+	snapChunk       = 1 << 12
+)
+
+var snapMagic = [8]byte{'C', 'U', 'C', 'K', 'O', 'O', 'H', 'T'}
+
+var (
+	ErrSnapshotMagic   = errors.New("cuckoo: not a snapshot")
+	ErrSnapshotVersion = errors.New("cuckoo: unsupported snapshot version")
+	ErrSnapshotHash    = errors.New("cuckoo: snapshot written with a different hash function")
+	ErrSnapshotLayout  = errors.New("cuckoo: snapshot written with a different Key, Value, or Slots layout")
+	ErrSnapshotCorrupt = errors.New("cuckoo: snapshot is corrupt")
+	ErrNotPointerFree  = errors.New("cuckoo: Key and Value must not contain pointers to be written as a snapshot")
+)
+
+// Fixed size part of the snapshot.
+type snapHeader struct {
+	Magic          [8]byte
+	Version        uint32
+	LittleEndian   bool // byte order of the buckets
+	KeySize        uint32
+	ValueSize      uint32
+	BucketSize     uint32
+	ValueOffset    uint32
+	Nslots         uint32
+	Fingerprint    uint64 // hash of the zero key with seed 1
+	MaxLoadFactor  float64
+	StartLevel     int64
+	LowestLevel    int64
+	Ntables        int64
+	Nbuckets       int64
+	Size           int64
+	MaxElements    int64
+	NumericKeySize int64
+	Rot            int64
+	Calls          int64
+	Eseed          int64
+	Grow           bool
+	EmptyKeyValid  bool
+	Ncounters      uint32
+	NtableCounters uint32
+}
+
+// Expiry part of the snapshot, after the table headers.
+type snapExpiry struct {
+	Expiry   bool  // the tables have expiry times
+	EmptyExp int64 // expiry time of the empty key
+}
+
+// Fixed size part of each table.
+type snapTable struct {
+	Seed        uint64
+	Nbuckets    int64
+	Nslots      int64
+	Size        int64
+	MaxElements int64
+}
+
+var littleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// View n bytes at p as a slice, no copy.
+func byteView(p unsafe.Pointer, n int) []byte {
+	var b []byte
+	h := (*reflect.SliceHeader)(unsafe.Pointer(&b))
+	h.Data, h.Len, h.Cap = uintptr(p), n, n
+	return b
+}
+
+// Can values of type t be written as raw bytes?
+func pointerFree(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return true
+	case reflect.Array:
+		return pointerFree(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if !pointerFree(t.Field(i).Type) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Describe the memory layout of t, two types with the same description can be copied as bytes.
+func layoutOf(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Array:
+		return fmt.Sprintf("[%d]%s", t.Len(), layoutOf(t.Elem()))
+	case reflect.Struct:
+		s := "struct{"
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			s += fmt.Sprintf("@%d %s;", f.Offset, layoutOf(f.Type))
+		}
+		return s + "}"
+	}
+	return fmt.Sprintf("%s:%d", t.Kind(), t.Size())
+}
+
+// Counters are written as a count followed by each field as an int64,
+// so fields added later don't break old snapshots.
+func intFields(v reflect.Value) []int64 {
+	r := make([]int64, v.NumField())
+	for i := range r {
+		f := v.Field(i)
+		if f.Kind() == reflect.Bool {
+			if f.Bool() {
+				r[i] = 1
+			}
+			continue
+		}
+		r[i] = f.Int()
+	}
+	return r
+}
+
+func setIntFields(v reflect.Value, r []int64) {
+	for i := 0; i < v.NumField() && i < len(r); i++ {
+		f := v.Field(i)
+		if f.Kind() == reflect.Bool {
+			f.SetBool(r[i] != 0)
+			continue
+		}
+		f.SetInt(r[i])
+	}
+}
+
+// Hash of a known key used to detect a hash function that has the same name but hashes differently.
+func (c *Cuckoo) fingerprint() uint64 {
+	return c.calcHash(&c.scratch, c.getHash(c.HashName, 1), 1, zeroKey)
+}
+
+// Return an error if Key and Value can't be written as raw bytes.
+func canSnapshot() error {
+	var b Bucket
+	if !pointerFree(reflect.TypeOf(b.key)) || !pointerFree(reflect.TypeOf(b.val)) {
+		return ErrNotPointerFree
+	}
+	return nil
+}
+
+// Keeps track of the offset in the stream so the buckets can be aligned.
+// If crc isn't nil everything written is added to it.
+type countWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+	crc hash.Hash32
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	if cw.crc != nil {
+		cw.crc.Write(p[:n])
+	}
+	return n, err
+}
+
+func (cw *countWriter) put(v interface{}) {
+	if cw.err == nil {
+		cw.err = binary.Write(cw, binary.LittleEndian, v)
+	}
+}
+
+func (cw *countWriter) putBytes(b []byte) {
+	cw.put(uint32(len(b)))
+	cw.Write(b)
+}
+
+func (cw *countWriter) align() {
+	var zeros [snapAlign]byte
+	if pad := (snapAlign - cw.n%snapAlign) % snapAlign; pad > 0 {
+		cw.Write(zeros[:pad])
+	}
+}
+
+type countReader struct {
+	r     io.Reader
+	n     int64
+	err   error
+	crc   hash.Hash32
+	limit int64 // if > 0 the bytes r had left when it was wrapped, see remaining
+}
+
+// Get the number of bytes left in r, or 0 if r doesn't say.
+func remaining(r io.Reader) int64 {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len())
+	case *io.SectionReader:
+		if off, err := r.Seek(0, io.SeekCurrent); err == nil {
+			return r.Size() - off
+		}
+	case *os.File:
+		fi, err := r.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return 0
+		}
+		if off, err := r.Seek(0, io.SeekCurrent); err == nil {
+			return fi.Size() - off
+		}
+	}
+	return 0
+}
+
+// Fail with io.ErrUnexpectedEOF if r is known to have fewer than n bytes left, so a header
+// that claims a huge table doesn't allocate it.
+func (cr *countReader) need(n int64) {
+	if cr.err == nil && cr.limit > 0 && n > cr.limit-cr.n {
+		cr.err = io.ErrUnexpectedEOF
+	}
+}
+
+func (cr *countReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	if cr.crc != nil {
+		cr.crc.Write(p[:n])
+	}
+	return n, err
+}
+
+func (cr *countReader) get(v interface{}) {
+	if cr.err == nil {
+		cr.err = binary.Read(cr, binary.LittleEndian, v)
+	}
+}
+
+func (cr *countReader) getBytes(max uint32) []byte {
+	var n uint32
+	cr.get(&n)
+	if cr.err != nil {
+		return nil
+	}
+	if n > max {
+		cr.err = ErrSnapshotCorrupt
+		return nil
+	}
+	b := make([]byte, n)
+	cr.full(b)
+	return b
+}
+
+func (cr *countReader) full(b []byte) {
+	if cr.err == nil {
+		_, cr.err = io.ReadFull(cr, b)
+	}
+}
+
+func (cr *countReader) align() {
+	var pad [snapAlign]byte
+	cr.full(pad[:(snapAlign-cr.n%snapAlign)%snapAlign])
+}
+
+// The raw bytes of buckets [lo, hi) of a table. Unless the buckets are contiguous hi must be lo+1.
+func (t *Table) bucketBytes(lo, hi int) []byte {
+	var bk Bucket
+	return byteView(unsafe.Pointer(&t.buckets[lo][0]), (hi-lo)*t.Nslots*int(unsafe.Sizeof(bk)))
+}
+
+// The raw bytes of the expiry times of a table.
+func (t *Table) expBytes() []byte {
+	return byteView(unsafe.Pointer(&t.exp[0]), len(t.exp)*8)
+}
+
+// Empty all the buckets of a table.
+func (t *Table) clear(emptyKey Key, emptyValue Value) {
+	t.buckets = make([]Slots, t.Nbuckets)
+	for b := range t.buckets {
+		t.buckets[b] = makeSlots(t.buckets[b], t.Nslots)
+		for s := range t.buckets[b] {
+			t.buckets[b][s] = Bucket{key: emptyKey, val: emptyValue}
+		}
+	}
+	if t.exp != nil {
+		t.exp = make([]int64, t.Size)
+	}
+	t.Elements = 0
+}
+
+// Fill in the snapshot header for c.
+func (c *Cuckoo) snapHeader() snapHeader {
+	var b Bucket
+	return snapHeader{
+		Magic:          snapMagic,
+		Version:        SnapshotVersion,
+		LittleEndian:   littleEndian,
+		KeySize:        uint32(unsafe.Sizeof(b.key)),
+		ValueSize:      uint32(unsafe.Sizeof(b.val)),
+		BucketSize:     uint32(unsafe.Sizeof(b)),
+		ValueOffset:    uint32(unsafe.Offsetof(b.val)),
+		Nslots:         uint32(c.Nslots),
+		MaxLoadFactor:  c.MaxLoadFactor,
+		StartLevel:     int64(c.StartLevel),
+		LowestLevel:    int64(c.LowestLevel),
+		Ntables:        int64(len(c.tables)),
+		Nbuckets:       int64(c.Nbuckets),
+		Size:           int64(c.Size),
+		MaxElements:    int64(c.MaxElements),
+		NumericKeySize: int64(c.NumericKeySize),
+		Rot:            int64(c.rot),
+		Calls:          int64(c.calls),
+		Eseed:          c.eseed,
+		Grow:           c.grow,
+		EmptyKeyValid:  c.emptyKeyValid,
+		Ncounters:      uint32(reflect.TypeOf(c.Counters).NumField()),
+		NtableCounters: uint32(reflect.TypeOf(TableCounters{}).NumField()),
+	}
+}
+
+// Write a snapshot of c to w. Key and Value must not contain pointers.
+// WriteTo implements io.WriterTo.
+func (c *Cuckoo) WriteTo(w io.Writer) (n int64, err error) {
+	if err = canSnapshot(); err != nil {
+		return
+	}
+	bw := bufio.NewWriterSize(w, 1<<16)
+	cw := &countWriter{w: bw, crc: crc32.New(castagnoli)}
+	h := c.snapHeader()
+	h.Fingerprint = c.fingerprint()
+	cw.put(&h)
+	cw.putBytes([]byte(c.HashName))
+	cw.putBytes([]byte(layoutOf(reflect.TypeOf(Bucket{}))))
+	cw.Write(byteView(unsafe.Pointer(&c.emptyKey), int(h.KeySize)))
+	cw.Write(byteView(unsafe.Pointer(&c.emptyValue), int(h.ValueSize)))
+	cw.put(intFields(reflect.ValueOf(c.Counters)))
+	for _, t := range c.tables {
+		st := snapTable{Seed: t.seed, Nbuckets: int64(t.Nbuckets), Nslots: int64(t.Nslots),
+			Size: int64(t.Size), MaxElements: int64(t.MaxElements)}
+		cw.put(&st)
+		cw.put(intFields(reflect.ValueOf(t.TableCounters)))
+	}
+	cw.put(&snapExpiry{Expiry: c.clock != nil, EmptyExp: c.emptyExp})
+	sum := cw.crc.Sum32()
+	cw.crc = nil
+	cw.put(sum)
+	for _, t := range c.tables {
+		cw.align()
+		if t.keys != nil {
+			// the same bytes as an interleaved table
+			sl := makeSlots(Slots{}, t.Nslots)
+			for b := 0; b < t.Nbuckets; b++ {
+				cw.Write(t.splitBucketBytes(b, &sl))
+			}
+		} else if slotsContiguous() {
+			cw.Write(t.bucketBytes(0, len(t.buckets)))
+		} else {
+			for b := range t.buckets {
+				cw.Write(t.bucketBytes(b, b+1))
+			}
+		}
+		cw.put(t.chunkSums())
+		if c.clock != nil {
+			cw.align()
+			cw.crc = crc32.New(castagnoli)
+			cw.Write(t.expBytes())
+			sum := cw.crc.Sum32()
+			cw.crc = nil
+			cw.put(sum)
+		}
+	}
+	if cw.err == nil {
+		cw.err = bw.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// Read a snapshot written by WriteTo and replace the contents of c with it.
+// Slot positions are restored exactly. c can be a zero Cuckoo or one made by New or NewSplit, it keeps its layout.
+// If c already has a hash function it must match the one the snapshot was written with.
+// Snapshots written with a different hash function, Key, Value, or Slots layout are refused.
+// If a table's checksums are wrong, or the snapshot is truncated, a *CorruptError is returned.
+// On error c is unchanged, unless salvage is set, see SetSalvage.
+// Whatever a snapshot doesn't hold is kept: the Logger, Hooks, Tracer, subscribers, Recorder,
+// which logs the load, histograms, and expiry Clock. The eviction random numbers start over
+// from the snapshot's seed, see SetEvictionSeed. If the snapshot has expiry times and c has
+// no Clock the system clock is used, see SetExpiry.
+// ReadFrom implements io.ReaderFrom.
+func (c *Cuckoo) ReadFrom(r io.Reader) (n int64, err error) {
+	if err = canSnapshot(); err != nil {
+		return
+	}
+	cr := &countReader{r: r, limit: remaining(r)}
+	nc, si, err := c.readSnapMeta(cr)
+	if err != nil {
+		return cr.n, err
+	}
+	ce := &CorruptError{}
+	for ti, t := range nc.tables {
+		cr.align()
+		cr.need(int64(t.Size) * int64(si.BucketSize))
+		if cr.err == nil {
+			t.buckets = make([]Slots, t.Nbuckets)
+			if slotsContiguous() {
+				cr.full(t.bucketBytes(0, len(t.buckets)))
+			} else {
+				for b := range t.buckets {
+					t.buckets[b] = makeSlots(t.buckets[b], t.Nslots)
+					cr.full(t.bucketBytes(b, b+1))
+				}
+			}
+			want := make([]uint32, len(chunkBounds(t.Nbuckets)))
+			cr.get(want)
+			if cr.err == nil {
+				ce.Ranges = append(ce.Ranges, sumRanges(ti, t.Nbuckets, t.chunkSums(), want)...)
+			}
+		}
+		if si.Expiry {
+			cr.align()
+			cr.need(int64(t.Size) * 8)
+		}
+		if si.Expiry && cr.err == nil {
+			t.exp = make([]int64, t.Size)
+			cr.crc = crc32.New(castagnoli)
+			cr.full(t.expBytes())
+			sum := cr.crc.Sum32()
+			cr.crc = nil
+			var want uint32
+			cr.get(&want)
+			if cr.err == nil && want != sum {
+				ce.table(ti, t.Nbuckets)
+			}
+		}
+		if cr.err == io.EOF || cr.err == io.ErrUnexpectedEOF {
+			ce.Truncated = true
+			for ; ti < len(nc.tables); ti++ {
+				ce.Ranges = append(ce.Ranges, CorruptRange{Table: ti, First: 0, Last: nc.tables[ti].Nbuckets})
+			}
+			break
+		}
+		if cr.err != nil {
+			return cr.n, cr.err
+		}
+	}
+	if ce.Truncated || len(ce.Ranges) > 0 {
+		if !c.salvage {
+			return cr.n, ce
+		}
+		ce.Salvaged = true
+		nc.Elements = 0
+		if nc.emptyKeyValid {
+			nc.Elements++
+		}
+		for ti, t := range nc.tables {
+			if ce.damaged(ti) {
+				t.clear(nc.emptyKey, nc.emptyValue)
+			}
+			nc.Elements += t.Elements
+		}
+		err = ce
+	}
+	nc.Split, nc.keysOnly = c.Split, c.keysOnly
+	nc.salvage, nc.subs, nc.clock = c.salvage, c.subs, c.clock
+	if si.Expiry && nc.clock == nil {
+		nc.clock = systemClock{}
+	}
+	for _, t := range nc.tables {
+		if nc.Split {
+			t.split(nc.keysOnly)
+		}
+		if nc.versioned {
+			t.versions = make([]uint32, t.Nbuckets)
+		}
+		if nc.clock != nil && t.exp == nil {
+			t.exp = make([]int64, t.Size)
+		}
+		t.c = c
+	}
+	nc.multi, nc.concurrent, nc.arena, nc.rec, nc.hists, nc.checks = c.multi, c.concurrent, c.arena, c.rec, c.hists, c.checks
+	*c = *nc
+	if c.rec != nil {
+		c.rec.logLoad()
+	}
+	return cr.n, err
+}
+
+// What a snapshot holds before the buckets.
+type snapInfo struct {
+	snapHeader
+	snapExpiry
+	hashName      string
+	layout        string
+	emptyKey      []byte
+	emptyValue    []byte
+	counters      []int64
+	tables        []snapTable
+	tableCounters [][]int64
+}
+
+// Read and check everything up to the buckets, without caring if this build can load it.
+func readSnapInfo(cr *countReader) (*snapInfo, error) {
+	var si snapInfo
+	meta := &CorruptError{Meta: true}
+	cr.crc = crc32.New(castagnoli)
+	cr.get(&si.snapHeader)
+	if cr.err != nil {
+		return nil, cr.err
+	}
+	h := &si.snapHeader
+	if h.Magic != snapMagic {
+		return nil, ErrSnapshotMagic
+	}
+	if h.Version != SnapshotVersion {
+		return nil, fmt.Errorf("%w: %d", ErrSnapshotVersion, h.Version)
+	}
+	if h.Ntables < 1 || h.Ntables > 1<<16 || h.Nslots < 1 || h.Nslots > 1<<16 ||
+		h.KeySize > 1<<16 || h.ValueSize > 1<<16 || h.BucketSize < h.KeySize+h.ValueSize || h.BucketSize > 1<<17 ||
+		h.Ncounters > 1<<10 || h.NtableCounters > 1<<10 {
+		return nil, meta
+	}
+	si.hashName = string(cr.getBytes(64))
+	si.layout = string(cr.getBytes(4096))
+	si.emptyKey = make([]byte, h.KeySize)
+	si.emptyValue = make([]byte, h.ValueSize)
+	cr.full(si.emptyKey)
+	cr.full(si.emptyValue)
+	si.counters = make([]int64, h.Ncounters)
+	cr.get(si.counters)
+	si.tables = make([]snapTable, h.Ntables)
+	si.tableCounters = make([][]int64, h.Ntables)
+	size := int64(0)
+	for i := range si.tables {
+		cr.get(&si.tables[i])
+		si.tableCounters[i] = make([]int64, h.NtableCounters)
+		cr.get(si.tableCounters[i])
+		st := si.tables[i]
+		if cr.err == nil && (st.Nslots != int64(h.Nslots) || st.Nbuckets < 1 || st.Nbuckets > 1<<40 ||
+			st.Size != st.Nbuckets*st.Nslots || st.Size > 1<<40) {
+			cr.err = meta
+		}
+		size += st.Size
+	}
+	cr.get(&si.snapExpiry)
+	sum := cr.crc.Sum32()
+	cr.crc = nil
+	var want uint32
+	cr.get(&want)
+	if cr.err == nil && (want != sum || h.Size != size) {
+		cr.err = meta
+	}
+	if cr.err != nil {
+		if cr.err == io.EOF {
+			cr.err = io.ErrUnexpectedEOF
+		}
+		return nil, cr.err
+	}
+	return &si, nil
+}
+
+// Read everything up to the buckets and check it can be loaded by c.
+// Returns a new Cuckoo, with tables that have no buckets yet, so c isn't touched on error.
+func (c *Cuckoo) readSnapMeta(cr *countReader) (*Cuckoo, *snapInfo, error) {
+	var s Slots
+	si, err := readSnapInfo(cr)
+	if err != nil {
+		return nil, nil, err
+	}
+	h := &si.snapHeader
+	want := c.snapHeader()
+	if h.LittleEndian != want.LittleEndian || h.KeySize != want.KeySize || h.ValueSize != want.ValueSize ||
+		h.BucketSize != want.BucketSize || h.ValueOffset != want.ValueOffset ||
+		(len(s) > 0 && int(h.Nslots) != len(s)) || si.layout != layoutOf(reflect.TypeOf(Bucket{})) {
+		return nil, nil, fmt.Errorf("%w: %s/%d slots", ErrSnapshotLayout, si.layout, h.Nslots)
+	}
+	if c.HashName != "" && c.HashName != si.hashName {
+		return nil, nil, fmt.Errorf("%w: %q not %q", ErrSnapshotHash, si.hashName, c.HashName)
+	}
+
+	nc := &Cuckoo{}
+	hashno, err := nc.setHash(si.hashName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %q", ErrSnapshotHash, si.hashName)
+	}
+	nc.hashno = hashno
+	nc.HashName = si.hashName
+	nc.scratch = newScratch()
+	nc.NumericKeySize = int(h.NumericKeySize)
+	if nc.fingerprint() != h.Fingerprint {
+		return nil, nil, fmt.Errorf("%w: %q hashes differently", ErrSnapshotHash, si.hashName)
+	}
+	nc.MaxLoadFactor = h.MaxLoadFactor
+	nc.StartLevel, nc.LowestLevel = int(h.StartLevel), int(h.LowestLevel)
+	nc.Ntables, nc.Nbuckets, nc.Nslots = int(h.Ntables), int(h.Nbuckets), int(h.Nslots)
+	nc.Size, nc.MaxElements = int(h.Size), int(h.MaxElements)
+	nc.rot, nc.calls = int(h.Rot), int(h.Calls)
+	nc.SetEvictionSeed(h.Eseed)
+	nc.grow = h.Grow
+	nc.emptyKeyValid = h.EmptyKeyValid
+	nc.emptyExp = si.EmptyExp
+	nc.versioned, nc.Trace, nc.tracer = c.versioned, c.Trace, c.tracer
+	nc.logger, nc.hooks = c.logger, c.hooks
+	copy(byteView(unsafe.Pointer(&nc.emptyKey), int(h.KeySize)), si.emptyKey)
+	copy(byteView(unsafe.Pointer(&nc.emptyValue), int(h.ValueSize)), si.emptyValue)
+	nc.ekiz = nc.emptyKey == zeroKey
+	setIntFields(reflect.ValueOf(&nc.Counters).Elem(), si.counters)
+	for i, st := range si.tables {
+		t := &Table{c: nc, seed: st.Seed, Nbuckets: int(st.Nbuckets), Nslots: int(st.Nslots),
+			Size: int(st.Size), MaxElements: int(st.MaxElements)}
+		setIntFields(reflect.ValueOf(&t.TableCounters).Elem(), si.tableCounters[i])
+		t.hfs = nc.getHash(si.hashName, t.seed)
+		nc.tables = append(nc.tables, t)
+	}
+	return nc, si, nil
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler, see WriteTo.
+func (c *Cuckoo) MarshalBinary() ([]byte, error) {
+	var b bytes.Buffer
+	if _, err := c.WriteTo(&b); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler, see ReadFrom.
+func (c *Cuckoo) UnmarshalBinary(data []byte) error {
+	_, err := c.ReadFrom(bytes.NewReader(data))
+	return err
+}
@@ -0,0 +1,202 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package cuckoo
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A SyncCuckoo is a Cuckoo that is safe for concurrent use.
+// Insert and Delete take the write lock. Lookup and Map take the read lock,
+// and each reader gets its own scratch space to serialize the key so Lookups run in parallel.
+// The counters changed by readers are kept as atomics and merged in when they are read.
+type SyncCuckoo struct {
+	lookups int64 // number of lookups, atomic and first so it is 64 bit aligned
+	mu      sync.RWMutex
+	c       *Cuckoo
+	pool    sync.Pool // *scratch for readers
+}
+
+// Create a new thread safe cuckoo hash table. The arguments are the same as New.
+func NewSync(tables, buckets, slots int, eseed int64, loadFactor float64, hashName string, emptyKey ...Key) *SyncCuckoo {
+	c := New(tables, buckets, slots, eseed, loadFactor, hashName, emptyKey...)
+	if c == nil {
+		return nil
+	}
+	return NewSyncFrom(c)
+}
+
+// Wrap an existing cuckoo hash table. The caller must not use c directly after this call.
+func NewSyncFrom(c *Cuckoo) *SyncCuckoo {
+	s := &SyncCuckoo{c: c}
+	initScratchPool(&s.pool)
+	return s
+}
+
+// Readers get their scratch space from a pool so they don't allocate on each call.
+func initScratchPool(p *sync.Pool) {
+	p.New = func() interface{} {
+		sc := newScratch()
+		return &sc
+	}
+}
+
+// Given key return the value and a "ok" bool indicating success or failure.
+func (s *SyncCuckoo) Lookup(key Key) (v Value, ok bool) {
+	sc := s.pool.Get().(*scratch)
+	s.mu.RLock()
+	v, ok = s.c.lookup(sc, key)
+	s.mu.RUnlock()
+	s.pool.Put(sc)
+	atomic.AddInt64(&s.lookups, 1)
+	return
+}
+
+// Given key, value insert a KV pair and return ok.
+func (s *SyncCuckoo) Insert(key Key, val Value) (ok bool) {
+	s.mu.Lock()
+	ok = s.c.Insert(key, val)
+	s.mu.Unlock()
+	return
+}
+
+// Given key, value insert a KV pair and return ok and level needed to insert
+func (s *SyncCuckoo) InsertL(key Key, val Value) (ok bool, rlevel int) {
+	s.mu.Lock()
+	ok, rlevel = s.c.InsertL(key, val)
+	s.mu.Unlock()
+	return
+}
+
+// Given key, value, and a TTL insert a KV pair that expires after the TTL, see Cuckoo.InsertTTL.
+func (s *SyncCuckoo) InsertTTL(key Key, val Value, ttl time.Duration) (ok bool) {
+	s.mu.Lock()
+	ok = s.c.InsertTTL(key, val, ttl)
+	s.mu.Unlock()
+	return
+}
+
+// Reclaim the expired KV pairs in the next budget buckets, see Cuckoo.Sweep.
+func (s *SyncCuckoo) Sweep(budget int) (n int) {
+	s.mu.Lock()
+	n = s.c.Sweep(budget)
+	s.mu.Unlock()
+	return
+}
+
+// Given key delete the bucket. Return the value found and a bool "ok" indicating success
+func (s *SyncCuckoo) Delete(key Key) (v Value, ok bool) {
+	s.mu.Lock()
+	v, ok = s.c.Delete(key)
+	s.mu.Unlock()
+	return
+}
+
+// Call iter for each KV pair while holding the read lock.
+// iter must not call Insert or Delete on s or it will deadlock.
+func (s *SyncCuckoo) Map(iter func(c *Cuckoo, key Key, val Value) (stop bool)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.c.Map(iter)
+}
+
+// If the Key is a numeric data type set the length here.
+func (s *SyncCuckoo) SetNumericKeySize(size int) {
+	s.mu.Lock()
+	s.c.SetNumericKeySize(size)
+	s.mu.Unlock()
+}
+
+// Set the Logger, see Cuckoo.SetLogger.
+func (s *SyncCuckoo) SetLogger(l Logger) {
+	s.mu.Lock()
+	s.c.SetLogger(l)
+	s.mu.Unlock()
+}
+
+// Set the Hooks, see Cuckoo.SetHooks. They're called with the write lock held.
+func (s *SyncCuckoo) SetHooks(h Hooks) {
+	s.mu.Lock()
+	s.c.SetHooks(h)
+	s.mu.Unlock()
+}
+
+// Keep an expiry time for every slot from now on, see Cuckoo.SetExpiry.
+func (s *SyncCuckoo) SetExpiry(clock Clock) {
+	s.mu.Lock()
+	s.c.SetExpiry(clock)
+	s.mu.Unlock()
+}
+
+// Get the current load factor.
+func (s *SyncCuckoo) GetLoadFactor() float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.c.GetLoadFactor()
+}
+
+// Get a consistent copy of all the counters.
+func (s *SyncCuckoo) GetCounters() Counters {
+	s.mu.RLock()
+	cs := s.c.Counters
+	s.mu.RUnlock()
+	cs.Lookups += int(atomic.LoadInt64(&s.lookups))
+	return cs
+}
+
+// Get a consistent copy of the histograms, see Cuckoo.GetHistograms.
+func (s *SyncCuckoo) GetHistograms() Histograms {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.c.GetHistograms()
+}
+
+// Check the tables are consistent, see Cuckoo.Validate.
+func (s *SyncCuckoo) Validate() error {
+	sc := s.pool.Get().(*scratch)
+	defer s.pool.Put(sc)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.c.validateS(sc)
+}
+
+// Get where key can be and where it is, see Cuckoo.Locate.
+func (s *SyncCuckoo) Locate(key Key) Location {
+	sc := s.pool.Get().(*scratch)
+	defer s.pool.Put(sc)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.c.locate(sc, key)
+}
+
+// Report what inserting key would do, see Cuckoo.ExplainInsert.
+func (s *SyncCuckoo) ExplainInsert(key Key) *Explanation {
+	sc := s.pool.Get().(*scratch)
+	defer s.pool.Put(sc)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.c.explainInsert(sc, key)
+}
+
+// Get the value of some of the counters, see Cuckoo.GetCounter
+func (s *SyncCuckoo) GetCounter(stat string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.c.GetCounter(stat)
+}
+
+// Get a consistent copy of the counters of each table.
+func (s *SyncCuckoo) GetTableCounters() []TableCounters {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.c.GetTableCounters()
+}
+
+// Get the value of some of the table counters, see Cuckoo.GetTableCounter
+func (s *SyncCuckoo) GetTableCounter(t int, stat string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.c.GetTableCounter(t, stat)
+}
@@ -0,0 +1,155 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package cuckoo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+)
+
+// What the insert routine did to a slot.
+type TraceOp byte
+
+const (
+	TraceProbe  TraceOp = 'P' // looked at a slot
+	TraceInsert TraceOp = 'I' // stored a KV pair in a slot
+	TraceEvict  TraceOp = 'E' // took a KV pair out of a slot to make room, Key and Value are the victim's
+)
+
+func (op TraceOp) String() string {
+	return string(op)
+}
+
+// A TraceEvent is one step of an insert.
+type TraceEvent struct {
+	Seq    int     // the value of TraceCnt, counts every event
+	Level  int     // the insert's level, see SetStartLevel
+	Op     TraceOp // what happened
+	Table  int     // index of the table
+	Bucket int
+	Slot   int
+	Key    Key
+	Value  Value
+}
+
+// A Tracer receives each step of every insert, see SetTracer.
+// It's called by the writer with the Cuckoo in the middle of an insert so it must not use the Cuckoo.
+type Tracer interface {
+	Trace(e TraceEvent)
+}
+
+// Set a Tracer to receive the steps of every insert, nil to stop.
+// Setting Trace with no Tracer writes the steps to stdout in the format demo.html uses.
+func (c *Cuckoo) SetTracer(tr Tracer) {
+	c.tracer = tr
+}
+
+var stdoutTracer = NewJSTracer(os.Stdout)
+
+// Send an event to the tracer.
+func (c *Cuckoo) trace(level int, op TraceOp, t, b, s int, k Key, v Value) {
+	tr := c.tracer
+	if tr == nil {
+		tr = stdoutTracer
+	}
+	tr.Trace(TraceEvent{Seq: c.TraceCnt, Level: level, Op: op, Table: t, Bucket: b, Slot: s, Key: k, Value: v})
+}
+
+// A JSONTracer writes each event as a line of JSON.
+// Err is the first write error, after one the events are dropped.
+type JSONTracer struct {
+	enc *json.Encoder
+	Err error
+}
+
+type jsonEvent struct {
+	Seq    int    `json:"seq"`
+	Level  int    `json:"level"`
+	Op     string `json:"op"`
+	Table  int    `json:"table"`
+	Bucket int    `json:"bucket"`
+	Slot   int    `json:"slot"`
+	Key    Key    `json:"key"`
+	Value  Value  `json:"value"`
+}
+
+// Make a Tracer that writes JSON Lines to w.
+func NewJSONTracer(w io.Writer) *JSONTracer {
+	return &JSONTracer{enc: json.NewEncoder(w)}
+}
+
+func (jt *JSONTracer) Trace(e TraceEvent) {
+	if jt.Err != nil {
+		return
+	}
+	jt.Err = jt.enc.Encode(jsonEvent{e.Seq, e.Level, e.Op.String(), e.Table, e.Bucket, e.Slot, e.Key, e.Value})
+}
+
+// A RingTracer keeps the last events in memory.
+type RingTracer struct {
+	events []TraceEvent
+	next   int  // where the next event goes
+	full   bool // events has wrapped
+}
+
+// Make a Tracer that keeps the last n events.
+func NewRingTracer(n int) *RingTracer {
+	if n <= 0 {
+		panic("NewRingTracer")
+	}
+	return &RingTracer{events: make([]TraceEvent, n)}
+}
+
+func (rt *RingTracer) Trace(e TraceEvent) {
+	rt.events[rt.next] = e
+	rt.next++
+	if rt.next == len(rt.events) {
+		rt.next, rt.full = 0, true
+	}
+}
+
+// Get a copy of the events kept, oldest first.
+func (rt *RingTracer) Events() []TraceEvent {
+	if !rt.full {
+		return append([]TraceEvent(nil), rt.events[:rt.next]...)
+	}
+	return append(append([]TraceEvent(nil), rt.events[rt.next:]...), rt.events[:rt.next]...)
+}
+
+// Forget the events kept.
+func (rt *RingTracer) Reset() {
+	rt.next, rt.full = 0, false
+}
+
+// A JSTracer writes each event as an element of the JavaScript arrays demo.html animates,
+// one per line with a trailing comma. Err is the first write error.
+type JSTracer struct {
+	w   io.Writer
+	Err error
+}
+
+// Make a Tracer that writes the demo.html format to w.
+func NewJSTracer(w io.Writer) *JSTracer {
+	return &JSTracer{w: w}
+}
+
+func (jt *JSTracer) Trace(e TraceEvent) {
+	if jt.Err != nil {
+		return
+	}
+	_, jt.Err = fmt.Fprintf(jt.w, "{%q: %d, %q: %d, %q: %q, %q: %d, %q: %d, %q: %d, %q: %s, %q: %s},\n",
+		"i", e.Seq, "l", e.Level, "op", e.Op.String(), "t", e.Table, "b", e.Bucket, "s", e.Slot,
+		"k", jsLiteral(e.Key), "v", jsLiteral(e.Value))
+}
+
+// Format a Key or Value as a JavaScript literal.
+func jsLiteral(x interface{}) string {
+	if v := reflect.ValueOf(x); v.Kind() == reflect.String {
+		return strconv.Quote(v.String())
+	}
+	return fmt.Sprintf("%v", x)
+}
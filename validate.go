@@ -0,0 +1,112 @@
+// Copyright © 2014-2017 Lawrence E. Bakst. All rights reserved.
+
+package cuckoo
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Validate returns an error wrapping ErrInvalid if the tables are inconsistent.
+var ErrInvalid = errors.New("cuckoo: table is inconsistent")
+
+// Check the tables are consistent: every key is in the bucket its table's hash maps it to,
+// no key is stored twice, the Elements of each table and of the Cuckoo match the slots used
+// plus the empty key if it's stored, see New, and Size and MaxElements match the tables.
+// It looks at every slot so it's slow. With the debug build tag, go test -tags debug, it's
+// called after Insert, Delete, InsertBatch, and Replica.Apply and panics if it fails, see check.
+func (c *Cuckoo) Validate() error {
+	return c.validateS(&c.scratch)
+}
+
+// Same as Validate but keys are serialized into sc, so it can be called by concurrent readers.
+func (c *Cuckoo) validateS(sc *scratch) error {
+	tes := make([]int, len(c.tables))
+	for i, t := range c.tables {
+		tes[i] = t.Elements
+	}
+	return c.validate(sc, c.Elements, tes)
+}
+
+// Validate the tables against counts kept somewhere else, elements for the Cuckoo and tes for each table.
+func (c *Cuckoo) validate(sc *scratch, elements int, tes []int) error {
+	if len(c.tables) != c.Ntables {
+		return fmt.Errorf("%w: %d tables, Ntables=%d", ErrInvalid, len(c.tables), c.Ntables)
+	}
+	seen := make(map[Key][3]int, elements)
+	used, size := 0, 0
+	for ti, t := range c.tables {
+		if t.Size != t.Nbuckets*t.Nslots {
+			return fmt.Errorf("%w: table %d Size=%d, Nbuckets*Nslots=%d", ErrInvalid, ti, t.Size, t.Nbuckets*t.Nslots)
+		}
+		if c.Split {
+			nv := t.Size
+			if c.keysOnly {
+				nv = 0
+			}
+			if t.buckets != nil || len(t.keys) != t.Size || len(t.vals) != nv {
+				return fmt.Errorf("%w: split table %d has %d keys and %d values, Size=%d", ErrInvalid, ti, len(t.keys), len(t.vals), t.Size)
+			}
+		} else if t.keys != nil || len(t.buckets) != t.Nbuckets {
+			return fmt.Errorf("%w: table %d has %d buckets, Nbuckets=%d", ErrInvalid, ti, len(t.buckets), t.Nbuckets)
+		}
+		if c.clock != nil && len(t.exp) != t.Size || c.clock == nil && t.exp != nil {
+			return fmt.Errorf("%w: table %d has %d expiry times, Size=%d", ErrInvalid, ti, len(t.exp), t.Size)
+		}
+		size += t.Size
+		n := 0
+		for b := 0; b < t.Nbuckets; b++ {
+			if !c.Split && len(t.buckets[b]) != t.Nslots {
+				return fmt.Errorf("%w: table %d bucket %d has %d slots, Nslots=%d", ErrInvalid, ti, b, len(t.buckets[b]), t.Nslots)
+			}
+			for s := 0; s < t.Nslots; s++ {
+				k := t.key(uint64(b), s)
+				if k == c.emptyKey {
+					continue
+				}
+				n++
+				if hb := int(t.calcHashForTableS(sc, k) % uint64(t.Nbuckets)); hb != b {
+					return fmt.Errorf("%w: key %v in table %d bucket %d slot %d hashes to bucket %d", ErrInvalid, k, ti, b, s, hb)
+				}
+				if p, ok := seen[k]; ok && !c.multi {
+					return fmt.Errorf("%w: key %v in table %d bucket %d slot %d and table %d bucket %d slot %d",
+						ErrInvalid, k, p[0], p[1], p[2], ti, b, s)
+				}
+				seen[k] = [3]int{ti, b, s}
+			}
+		}
+		if n != tes[ti] {
+			return fmt.Errorf("%w: table %d has %d keys, Elements=%d", ErrInvalid, ti, n, tes[ti])
+		}
+		used += n
+	}
+	if c.emptyKeyValid {
+		used++
+	}
+	if used != elements {
+		return fmt.Errorf("%w: %d keys, emptyKeyValid=%v, Elements=%d", ErrInvalid, used, c.emptyKeyValid, elements)
+	}
+	if size != c.Size {
+		return fmt.Errorf("%w: tables hold %d slots, Size=%d", ErrInvalid, size, c.Size)
+	}
+	if max := int(float64(c.Size) * c.MaxLoadFactor); c.MaxElements != max {
+		return fmt.Errorf("%w: MaxElements=%d, Size*MaxLoadFactor=%d", ErrInvalid, c.MaxElements, max)
+	}
+	return nil
+}
+
+// Tables with more slots than this are validated after fewer operations, see check.
+const debugSlots = 1 << 14
+
+// Panic if the tables are inconsistent, called after each operation with the debug build tag.
+// Validate looks at every slot, so tables bigger than debugSlots are only validated after
+// operations 1, 2, 4, 8, ... otherwise filling a big table would take forever.
+func (c *Cuckoo) check(op string) {
+	c.checks++
+	if c.Size > debugSlots && c.checks&(c.checks-1) != 0 {
+		return
+	}
+	if err := c.Validate(); err != nil {
+		panic(op + ": " + err.Error())
+	}
+}